@@ -0,0 +1,92 @@
+package cube_websocket_gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+	"github.com/akaumov/cube-websocket-gateway/lib"
+)
+
+// getNodeEventsTenant returns the tenant of node events channel, ok is false for other channels.
+func (h *Handler) getNodeEventsTenant(channel cube.Channel) (lib.TenantId, bool) {
+
+	if channel == cube.Channel("wsNodeEvents") || channel == h.nodeEventsChannel {
+		return "", true
+	}
+
+	prefix := string(h.nodeEventsChannel) + "."
+	if !strings.HasPrefix(string(channel), prefix) {
+		return "", false
+	}
+
+	return lib.TenantId(strings.TrimPrefix(string(channel), prefix)), true
+}
+
+// onNodeEvent replicates users of other nodes into the presence registry.
+func (h *Handler) onNodeEvent(tenantId lib.TenantId, message cube.Message) {
+
+	if message.Params == nil {
+		fmt.Println("onNodeEvent: no params")
+		return
+	}
+
+	var err error
+
+	switch message.Method {
+	case "onNodeStarted", "onNodeStopped":
+		var params js.NodeParams
+		err = json.Unmarshal(*message.Params, &params)
+		if err == nil {
+			h.server.OnNodeChanged(params)
+		}
+	case "onUserAttached", "onUserDetached":
+		var params js.NodeUserParams
+		err = json.Unmarshal(*message.Params, &params)
+		if err == nil {
+			h.server.OnNodeUserChanged(tenantId, params, message.Method == "onUserAttached")
+		}
+	case "onNodeSnapshot":
+		if tenantId != "" {
+			fmt.Println("onNodeEvent: snapshot in tenant channel")
+			return
+		}
+
+		var params js.NodeSnapshotParams
+		err = json.Unmarshal(*message.Params, &params)
+		if err == nil {
+			h.server.OnNodeSnapshot(params)
+		}
+	default:
+		fmt.Println("onNodeEvent: unknown event", message.Method)
+		return
+	}
+
+	if err != nil {
+		fmt.Println("onNodeEvent: wrong params", message.Method)
+	}
+}
+
+func (h *Handler) onGetPresence(tenantId lib.TenantId, request cube.Request) cube.Response {
+
+	if request.Params == nil {
+		return cube.NewErrorResponse("", "WrongParams", "no params")
+	}
+
+	var params js.GetPresenceParams
+	err := json.Unmarshal(*request.Params, &params)
+	if err != nil {
+		return cube.NewErrorResponse("", "WrongParams", "wrong params")
+	}
+
+	userIds := []lib.UserId{}
+	for _, userId := range params.UserIds {
+		userIds = append(userIds, lib.UserId(userId))
+	}
+
+	return packResult(js.GetPresenceResult{
+		Users: h.server.GetPresence(tenantId, userIds),
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/akaumov/cube-executor"
 	"github.com/akaumov/cube-websocket-gateway"
@@ -40,11 +42,126 @@ func main() {
 			EnvVar: "GATEWAY_ENDPOINTS_MAP",
 			Usage:  "map endpoint to channel",
 		},
+		cli.StringFlag{
+			Name:   "routing-config",
+			EnvVar: "GATEWAY_ROUTING_CONFIG",
+			Usage:  "path to json or yaml routing config, reloaded on change and SIGHUP",
+		},
 		cli.StringFlag{
 			Name:   "input-channel",
 			EnvVar: "GATEWAY_INPUT_CHANNEL",
 			Usage:  "input channel, default \"wsinput\"",
 		},
+		cli.StringFlag{
+			Name:   "instance-id",
+			EnvVar: "GATEWAY_INSTANCE_ID",
+			Usage:  "id of the gateway instance, default is the host name",
+		},
+		cli.BoolFlag{
+			Name:   "cluster",
+			EnvVar: "GATEWAY_CLUSTER",
+			Usage:  "announce users of the instance, so backends can publish to \"<input channel>.node.<instance id>\"",
+		},
+		cli.StringFlag{
+			Name:   "node-events-channel",
+			EnvVar: "GATEWAY_NODE_EVENTS_CHANNEL",
+			Usage:  "channel of instance and user announcements, default \"wsNodes\"",
+		},
+		cli.IntFlag{
+			Name:   "presence-interval",
+			EnvVar: "GATEWAY_PRESENCE_INTERVAL",
+			Usage:  "milliseconds between presence snapshots of the instance, default 10000",
+		},
+		cli.IntFlag{
+			Name:   "presence-grace-period",
+			EnvVar: "GATEWAY_PRESENCE_GRACE_PERIOD",
+			Usage:  "milliseconds a user may reconnect within without \"onUserOffline\"",
+		},
+		cli.StringFlag{
+			Name:   "presence-channel",
+			EnvVar: "GATEWAY_PRESENCE_CHANNEL",
+			Usage:  "channel of user and device presence events, default is \"wsOutput\" without device events",
+		},
+		cli.IntFlag{
+			Name:   "max-presence-watches",
+			EnvVar: "GATEWAY_MAX_PRESENCE_WATCHES",
+			Usage:  "maximum number of users watched by a connection, default 100",
+		},
+		cli.StringFlag{
+			Name:   "presence-auth-channel",
+			EnvVar: "GATEWAY_PRESENCE_AUTH_CHANNEL",
+			Usage:  "channel approving watch lists with \"authorizePresenceWatch\" request",
+		},
+		cli.IntFlag{
+			Name:   "session-window",
+			EnvVar: "GATEWAY_SESSION_WINDOW",
+			Usage:  "milliseconds messages of resumable sessions are kept for reconnecting clients, 0 disables sessions",
+		},
+		cli.IntFlag{
+			Name:   "session-buffer-size",
+			EnvVar: "GATEWAY_SESSION_BUFFER_SIZE",
+			Usage:  "maximum number of messages kept per session, default 100",
+		},
+		cli.StringFlag{
+			Name:   "inbox-dir",
+			EnvVar: "GATEWAY_INBOX_DIR",
+			Usage:  "directory of the offline inbox for messages published with \"store\"",
+		},
+		cli.IntFlag{
+			Name:   "inbox-max-messages",
+			EnvVar: "GATEWAY_INBOX_MAX_MESSAGES",
+			Usage:  "maximum number of stored messages per user, default 100",
+		},
+		cli.IntFlag{
+			Name:   "inbox-ttl",
+			EnvVar: "GATEWAY_INBOX_TTL",
+			Usage:  "maximum milliseconds messages are stored, default 7 days",
+		},
+		cli.StringFlag{
+			Name:   "retained-dir",
+			EnvVar: "GATEWAY_RETAINED_DIR",
+			Usage:  "directory to persist retained messages, they are kept in memory only if it's empty",
+		},
+		cli.IntFlag{
+			Name:   "retained-max-keys",
+			EnvVar: "GATEWAY_RETAINED_MAX_KEYS",
+			Usage:  "maximum number of retained messages per user, default 100",
+		},
+		cli.IntFlag{
+			Name:   "dedup-window",
+			EnvVar: "GATEWAY_DEDUP_WINDOW",
+			Usage:  "milliseconds ids of published messages are remembered to drop duplicates, default 60000",
+		},
+		cli.IntFlag{
+			Name:   "max-scheduled-messages",
+			EnvVar: "GATEWAY_MAX_SCHEDULED_MESSAGES",
+			Usage:  "maximum number of messages waiting for \"deliverAt\", default 10000",
+		},
+		cli.IntFlag{
+			Name:   "max-endpoint-leases",
+			EnvVar: "GATEWAY_MAX_ENDPOINT_LEASES",
+			Usage:  "maximum number of endpoints registered over the bus, default 1000",
+		},
+		cli.IntFlag{
+			Name:   "delivery-retry-interval",
+			EnvVar: "GATEWAY_DELIVERY_RETRY_INTERVAL",
+			Usage:  "milliseconds before the first retransmission of reliable messages, doubled after every attempt, default 2000",
+		},
+		cli.IntFlag{
+			Name:   "delivery-max-attempts",
+			EnvVar: "GATEWAY_DELIVERY_MAX_ATTEMPTS",
+			Usage:  "maximum number of attempts to deliver reliable messages, default 5",
+		},
+		cli.IntFlag{
+			Name:   "max-inflight-requests",
+			EnvVar: "GATEWAY_MAX_INFLIGHT_REQUESTS",
+			Usage:  "maximum number of client requests in flight per connection, default 16",
+		},
+		cli.IntFlag{
+			Name:   "request-timeout",
+			EnvVar: "GATEWAY_REQUEST_TIMEOUT",
+			Usage:  "maximum timeout of client requests in milliseconds, default 10000",
+		},
 		cli.BoolTFlag{
 			Name:   "only-authorized-requests",
 			EnvVar: "GATEWAY_ONLY_AUTHORIZED_REQUESTS",
@@ -54,6 +171,61 @@ func main() {
 			Name:   "enable-routing",
 			EnvVar: "GATEWAY_ENABLE_ROUTING",
 		},
+		cli.StringFlag{
+			Name:   "forwarded-claims",
+			EnvVar: "GATEWAY_FORWARDED_CLAIMS",
+			Usage:  "comma separated jwt claims sent to backends in events",
+		},
+		cli.StringFlag{
+			Name:   "tenant-claim",
+			EnvVar: "GATEWAY_TENANT_CLAIM",
+			Usage:  "jwt claim with tenant, enables tenant scoped channels \"<channel>.<tenant>\"",
+		},
+		cli.IntFlag{
+			Name:   "tenant-max-connections",
+			EnvVar: "GATEWAY_TENANT_MAX_CONNECTIONS",
+			Usage:  "default maximum number of connections per tenant",
+		},
+		cli.IntFlag{
+			Name:   "tenant-rate-limit",
+			EnvVar: "GATEWAY_TENANT_RATE_LIMIT",
+			Usage:  "default maximum number of messages per second per tenant",
+		},
+		cli.StringFlag{
+			Name:   "tenant-quotas",
+			EnvVar: "GATEWAY_TENANT_QUOTAS",
+			Usage:  "path to json file with quotas of tenants",
+		},
+		cli.IntFlag{
+			Name:   "breaker-threshold",
+			EnvVar: "GATEWAY_BREAKER_THRESHOLD",
+			Usage:  "number of failed publishes to a channel which opens its circuit, default 5",
+		},
+		cli.IntFlag{
+			Name:   "breaker-timeout",
+			EnvVar: "GATEWAY_BREAKER_TIMEOUT",
+			Usage:  "milliseconds before an open circuit is tried again, default 10000",
+		},
+		cli.StringFlag{
+			Name:   "dead-letter-channel",
+			EnvVar: "GATEWAY_DEAD_LETTER_CHANNEL",
+			Usage:  "channel for messages which couldn't be published",
+		},
+		cli.IntFlag{
+			Name:   "spill-queue-size",
+			EnvVar: "GATEWAY_SPILL_QUEUE_SIZE",
+			Usage:  "maximum number of undelivered messages kept for replay, default 10000",
+		},
+		cli.BoolFlag{
+			Name:   "ordered-events",
+			EnvVar: "GATEWAY_ORDERED_EVENTS",
+			Usage:  "publish events of a connection one by one in the order of their \"seq\"",
+		},
+		cli.BoolFlag{
+			Name:   "legacy-frames",
+			EnvVar: "GATEWAY_LEGACY_FRAMES",
+			Usage:  "send errors as plain text frames instead of json frames",
+		},
 		cli.BoolFlag{
 			Name:   "dev",
 			EnvVar: "GATEWAY_DEV",
@@ -96,6 +268,16 @@ func runServer(c *cli.Context) error {
 
 	port := c.String("port")
 
+	maxInFlightRequests := ""
+	if c.Int("max-inflight-requests") > 0 {
+		maxInFlightRequests = strconv.Itoa(c.Int("max-inflight-requests"))
+	}
+
+	requestTimeout := ""
+	if c.Int("request-timeout") > 0 {
+		requestTimeout = strconv.Itoa(c.Int("request-timeout"))
+	}
+
 	onlyAuthorizedRequests := "true"
 	if c.Bool("only-authorized-requests") {
 		onlyAuthorizedRequests = "true"
@@ -110,14 +292,25 @@ func runServer(c *cli.Context) error {
 		dev = "false"
 	}
 
+	orderedEvents := "false"
+	if c.Bool("ordered-events") {
+		orderedEvents = "true"
+	}
+
+	legacyFrames := "false"
+	if c.Bool("legacy-frames") {
+		legacyFrames = "true"
+	}
+
 	enableRouting := "false"
 	endpointsMap := c.String("endpoints-map")
+	routingConfig := c.String("routing-config")
 
 	if c.Bool("enable-routing") {
 		enableRouting = "true"
 
-		if endpointsMap == "" {
-			return fmt.Errorf("endpoints map is required")
+		if endpointsMap == "" && routingConfig == "" {
+			return fmt.Errorf("endpoints map or routing config is required")
 		}
 
 	} else {
@@ -128,9 +321,35 @@ func runServer(c *cli.Context) error {
 	inputChannel := c.String("input-channel")
 	if inputChannel != "" {
 		channelsMapping[cube_executor.CubeChannel("wsinput")] = cube_executor.BusChannel(inputChannel)
+	} else {
+		inputChannel = "wsinput"
+	}
+
+	channelsMapping[cube_executor.CubeChannel("wsTenantInput")] = cube_executor.BusChannel(inputChannel + ".*")
+
+	instanceId, err := getInstanceId(c.String("instance-id"))
+	if err != nil {
+		return err
+	}
+
+	nodeChannel := inputChannel + ".node." + instanceId
+	channelsMapping[cube_executor.CubeChannel("wsNodeInput")] = cube_executor.BusChannel(nodeChannel)
+
+	nodeEventsChannel := c.String("node-events-channel")
+	if nodeEventsChannel == "" {
+		nodeEventsChannel = "wsNodes"
+	}
+
+	channelsMapping[cube_executor.CubeChannel("wsNodeEvents")] = cube_executor.BusChannel(nodeEventsChannel)
+	channelsMapping[cube_executor.CubeChannel("wsTenantNodeEvents")] = cube_executor.BusChannel(nodeEventsChannel + ".*")
+
+	cluster := "false"
+	if c.Bool("cluster") {
+		cluster = "true"
 	}
 
 	cube, err := cube_executor.NewCube(cube_executor.CubeConfig{
+		Name:            instanceId,
 		BusPort:         busPort,
 		BusHost:         busHost,
 		ChannelsMapping: channelsMapping,
@@ -138,10 +357,45 @@ func runServer(c *cli.Context) error {
 			"jwtSecret":              jwtSecret,
 			"maxConnections":         maxConnections,
 			"endpointsMap":           endpointsMap,
+			"routingConfig":          routingConfig,
 			"onlyAuthorizedRequests": onlyAuthorizedRequests,
 			"dev":                    dev,
 			"port":                   port,
 			"enableRouting":          enableRouting,
+			"maxInFlightRequests":    maxInFlightRequests,
+			"requestTimeout":         requestTimeout,
+			"legacyFrames":           legacyFrames,
+			"orderedEvents":          orderedEvents,
+			"forwardedClaims":        c.String("forwarded-claims"),
+			"inputChannel":           inputChannel,
+			"tenantClaim":            c.String("tenant-claim"),
+			"tenantMaxConnections":   strconv.Itoa(c.Int("tenant-max-connections")),
+			"tenantRateLimit":        strconv.Itoa(c.Int("tenant-rate-limit")),
+			"tenantQuotas":           c.String("tenant-quotas"),
+			"breakerThreshold":       strconv.Itoa(c.Int("breaker-threshold")),
+			"breakerTimeout":         strconv.Itoa(c.Int("breaker-timeout")),
+			"deadLetterChannel":      c.String("dead-letter-channel"),
+			"spillQueueSize":         strconv.Itoa(c.Int("spill-queue-size")),
+			"cluster":                cluster,
+			"nodeChannel":            nodeChannel,
+			"nodeEventsChannel":      nodeEventsChannel,
+			"presenceInterval":       strconv.Itoa(c.Int("presence-interval")),
+			"presenceGracePeriod":    strconv.Itoa(c.Int("presence-grace-period")),
+			"presenceChannel":        c.String("presence-channel"),
+			"maxPresenceWatches":     strconv.Itoa(c.Int("max-presence-watches")),
+			"presenceAuthChannel":    c.String("presence-auth-channel"),
+			"sessionWindow":          strconv.Itoa(c.Int("session-window")),
+			"sessionBufferSize":      strconv.Itoa(c.Int("session-buffer-size")),
+			"inboxDir":               c.String("inbox-dir"),
+			"inboxMaxMessages":       strconv.Itoa(c.Int("inbox-max-messages")),
+			"inboxTtl":               strconv.Itoa(c.Int("inbox-ttl")),
+			"retainedDir":            c.String("retained-dir"),
+			"retainedMaxKeys":        strconv.Itoa(c.Int("retained-max-keys")),
+			"dedupWindow":            strconv.Itoa(c.Int("dedup-window")),
+			"maxScheduledMessages":   strconv.Itoa(c.Int("max-scheduled-messages")),
+			"maxEndpointLeases":      strconv.Itoa(c.Int("max-endpoint-leases")),
+			"deliveryRetryInterval":  strconv.Itoa(c.Int("delivery-retry-interval")),
+			"deliveryMaxAttempts":    strconv.Itoa(c.Int("delivery-max-attempts")),
 		},
 	}, &cube_websocket_gateway.Handler{})
 
@@ -151,3 +405,23 @@ func runServer(c *cli.Context) error {
 
 	return cube.Start()
 }
+
+// getInstanceId returns the instance id which is used as a token of the node bus subject,
+// dots of the default host name are replaced.
+func getInstanceId(instanceId string) (string, error) {
+
+	if instanceId == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("instance id is required: %v", err)
+		}
+
+		instanceId = strings.Replace(hostname, ".", "-", -1)
+	}
+
+	if strings.ContainsAny(instanceId, ".*> \t") {
+		return "", fmt.Errorf("wrong instance id: %v", instanceId)
+	}
+
+	return instanceId, nil
+}
@@ -0,0 +1,175 @@
+package cube_websocket_gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+	"github.com/akaumov/cube-websocket-gateway/lib"
+)
+
+func (h *Handler) registerEndpoint(rawParams *json.RawMessage) (*js.RegisterEndpointResult, error) {
+
+	if rawParams == nil {
+		return nil, fmt.Errorf("no params")
+	}
+
+	var params js.RegisterEndpointParams
+	err := json.Unmarshal(*rawParams, &params)
+	if err != nil {
+		return nil, fmt.Errorf("wrong params")
+	}
+
+	if params.Endpoint == "" || params.Channel == "" {
+		return nil, fmt.Errorf("endpoint and channel are required")
+	}
+
+	err = lib.ValidateEndpointName(lib.Endpoint(params.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt, err := h.server.RegisterEndpoint(
+		lib.Endpoint(params.Endpoint),
+		cube.Channel(params.Channel),
+		time.Duration(params.Ttl)*time.Millisecond,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &js.RegisterEndpointResult{
+		ExpiresAt: expiresAt.UnixNano() / int64(time.Millisecond),
+	}, nil
+}
+
+func (h *Handler) unregisterEndpoint(rawParams *json.RawMessage) (bool, error) {
+
+	if rawParams == nil {
+		return false, fmt.Errorf("no params")
+	}
+
+	var params js.UnregisterEndpointParams
+	err := json.Unmarshal(*rawParams, &params)
+	if err != nil {
+		return false, fmt.Errorf("wrong params")
+	}
+
+	if params.Endpoint == "" || params.Channel == "" {
+		return false, fmt.Errorf("endpoint and channel are required")
+	}
+
+	return h.server.UnregisterEndpoint(lib.Endpoint(params.Endpoint), cube.Channel(params.Channel)), nil
+}
+
+func (h *Handler) onRegisterEndpoint(message cube.Message) {
+	_, err := h.registerEndpoint(message.Params)
+	if err != nil {
+		fmt.Println("onRegisterEndpoint:", err)
+	}
+}
+
+func (h *Handler) onUnregisterEndpoint(message cube.Message) {
+	_, err := h.unregisterEndpoint(message.Params)
+	if err != nil {
+		fmt.Println("onUnregisterEndpoint:", err)
+	}
+}
+
+func (h *Handler) onRegisterEndpointRequest(request cube.Request) cube.Response {
+
+	result, err := h.registerEndpoint(request.Params)
+	if err == lib.ErrorEndpointTaken {
+		return cube.NewErrorResponse("", "EndpointTaken", err.Error())
+	}
+
+	if err == lib.ErrorTooManyEndpoints {
+		return cube.NewErrorResponse("", "TooManyEndpoints", err.Error())
+	}
+
+	if err != nil {
+		return cube.NewErrorResponse("", "WrongParams", err.Error())
+	}
+
+	return packResult(result)
+}
+
+func (h *Handler) onUnregisterEndpointRequest(request cube.Request) cube.Response {
+
+	removed, err := h.unregisterEndpoint(request.Params)
+	if err != nil {
+		return cube.NewErrorResponse("", "WrongParams", err.Error())
+	}
+
+	return packResult(removed)
+}
+
+func (h *Handler) onGetRoutingTable() cube.Response {
+	return packResult(h.server.GetRoutingEntries())
+}
+
+func (h *Handler) setTrafficSplit(rawParams *json.RawMessage) error {
+
+	if rawParams == nil {
+		return fmt.Errorf("no params")
+	}
+
+	var params js.SetTrafficSplitParams
+	err := json.Unmarshal(*rawParams, &params)
+	if err != nil {
+		return fmt.Errorf("wrong params")
+	}
+
+	if params.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+
+	if params.Split == nil {
+		h.server.SetTrafficSplit(lib.Endpoint(params.Endpoint), nil)
+		return nil
+	}
+
+	split := &lib.TrafficSplit{
+		Targets:   []lib.WeightedTarget{},
+		Overrides: map[lib.UserId]cube.Channel{},
+	}
+
+	for _, target := range params.Split.Targets {
+		split.Targets = append(split.Targets, lib.WeightedTarget{
+			Channel: cube.Channel(target.Channel),
+			Weight:  target.Weight,
+		})
+	}
+
+	for userId, channel := range params.Split.Overrides {
+		split.Overrides[lib.UserId(userId)] = cube.Channel(channel)
+	}
+
+	err = split.Validate()
+	if err != nil {
+		return err
+	}
+
+	h.server.SetTrafficSplit(lib.Endpoint(params.Endpoint), split)
+	return nil
+}
+
+func (h *Handler) onSetTrafficSplit(message cube.Message) {
+	err := h.setTrafficSplit(message.Params)
+	if err != nil {
+		fmt.Println("onSetTrafficSplit:", err)
+	}
+}
+
+func (h *Handler) onSetTrafficSplitRequest(request cube.Request) cube.Response {
+
+	err := h.setTrafficSplit(request.Params)
+	if err != nil {
+		return cube.NewErrorResponse("", "WrongParams", err.Error())
+	}
+
+	return packResult(true)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/akaumov/cube"
 	"github.com/akaumov/cube-websocket-gateway/js"
@@ -23,8 +24,12 @@ type Handler struct {
 	port                   int
 	server                 *lib.Server
 	enableRouting          bool
+	legacyFrames           bool
 	endpointsMap           map[lib.Endpoint]cube.Channel
+	routingConfigWatcher   *lib.RoutingConfigWatcher
 	inputChannel           cube.InputChannel
+	tenantsEnabled         bool
+	nodeEventsChannel      cube.Channel
 }
 
 func parseEndpointsMap(rawMap string) (*map[lib.Endpoint]cube.Channel, error) {
@@ -51,12 +56,63 @@ func parseEndpointsMap(rawMap string) (*map[lib.Endpoint]cube.Channel, error) {
 	return &params, nil
 }
 
+func parseIntParam(cubeInstance cube.Cube, name string) (int, error) {
+
+	rawValue := cubeInstance.GetParam(name)
+	if rawValue == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.Atoi(rawValue)
+	if err != nil {
+		cubeInstance.LogError("Wrong " + name)
+		return 0, fmt.Errorf("wrong %v: %v", name, err)
+	}
+
+	return value, nil
+}
+
+func parseList(rawList string) []string {
+
+	list := []string{}
+
+	for _, item := range strings.Split(rawList, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
 func (h *Handler) OnInitInstance() []cube.InputChannel {
 	return []cube.InputChannel{
 		cube.InputChannel("wsinput"),
+		cube.InputChannel("wsTenantInput"),
+		cube.InputChannel("wsNodeInput"),
+		cube.InputChannel("wsNodeEvents"),
+		cube.InputChannel("wsTenantNodeEvents"),
 	}
 }
 
+// getChannelTenant returns the tenant of "<input channel>.<tenant>" channels and empty tenant for the shared input,
+// tenant channels are rejected if tenants are disabled.
+func (h *Handler) getChannelTenant(channel cube.Channel) (lib.TenantId, bool) {
+
+	prefix := string(h.inputChannel) + "."
+	if !strings.HasPrefix(string(channel), prefix) {
+		return "", true
+	}
+
+	if !h.tenantsEnabled {
+		return "", false
+	}
+
+	tenant := strings.TrimPrefix(string(channel), prefix)
+	return lib.TenantId(tenant), tenant != ""
+}
+
 func (h *Handler) OnStart(cubeInstance cube.Cube) error {
 	fmt.Println("Starting http gateway...")
 
@@ -66,6 +122,17 @@ func (h *Handler) OnStart(cubeInstance cube.Cube) error {
 	h.devMode = cubeInstance.GetParam("dev") == "true"
 	h.enableRouting = cubeInstance.GetParam("enableRouting") == "true"
 
+	h.inputChannel = cube.InputChannel(cubeInstance.GetParam("inputChannel"))
+	if h.inputChannel == "" {
+		h.inputChannel = cube.InputChannel("wsinput")
+	}
+	h.legacyFrames = cubeInstance.GetParam("legacyFrames") == "true"
+
+	h.nodeEventsChannel = cube.Channel(cubeInstance.GetParam("nodeEventsChannel"))
+	if h.nodeEventsChannel == "" {
+		h.nodeEventsChannel = lib.DefaultNodeEventsChannel
+	}
+
 	portString := cubeInstance.GetParam("port")
 
 	var err error
@@ -81,6 +148,26 @@ func (h *Handler) OnStart(cubeInstance cube.Cube) error {
 
 	h.port = port
 
+	maxInFlightRequests := 0
+	maxInFlightRequestsString := cubeInstance.GetParam("maxInFlightRequests")
+	if maxInFlightRequestsString != "" {
+		maxInFlightRequests, err = strconv.Atoi(maxInFlightRequestsString)
+		if err != nil {
+			cubeInstance.LogError("Wrong max in-flight requests")
+			return err
+		}
+	}
+
+	requestTimeout := 0
+	requestTimeoutString := cubeInstance.GetParam("requestTimeout")
+	if requestTimeoutString != "" {
+		requestTimeout, err = strconv.Atoi(requestTimeoutString)
+		if err != nil {
+			cubeInstance.LogError("Wrong request timeout")
+			return err
+		}
+	}
+
 	endpointsMap, err := parseEndpointsMap(cubeInstance.GetParam("endpointsMap"))
 	if err != nil {
 		return err
@@ -88,23 +175,253 @@ func (h *Handler) OnStart(cubeInstance cube.Cube) error {
 
 	h.endpointsMap = *endpointsMap
 
-	h.server = lib.NewServer(cubeInstance, h.devMode, h.enableRouting, *endpointsMap, h.onlyAuthorizedRequests, h.jwtSecret, port)
+	tenantClaim := cubeInstance.GetParam("tenantClaim")
+	h.tenantsEnabled = tenantClaim != ""
+
+	defaultTenantQuota := lib.TenantQuota{}
+	defaultTenantQuota.MaxConnections, err = parseIntParam(cubeInstance, "tenantMaxConnections")
+	if err != nil {
+		return err
+	}
+
+	tenantRateLimit, err := parseIntParam(cubeInstance, "tenantRateLimit")
+	if err != nil {
+		return err
+	}
+
+	defaultTenantQuota.RateLimit = float64(tenantRateLimit)
+	defaultTenantQuota.RateBurst = tenantRateLimit
+
+	breakerThreshold, err := parseIntParam(cubeInstance, "breakerThreshold")
+	if err != nil {
+		return err
+	}
+
+	breakerTimeout, err := parseIntParam(cubeInstance, "breakerTimeout")
+	if err != nil {
+		return err
+	}
+
+	spillQueueSize, err := parseIntParam(cubeInstance, "spillQueueSize")
+	if err != nil {
+		return err
+	}
+
+	nodeChannel := cube.Channel("")
+	if cubeInstance.GetParam("cluster") == "true" {
+		if cubeInstance.GetInstanceId() == "" {
+			return fmt.Errorf("instance id is required in cluster mode")
+		}
+
+		nodeChannel = cube.Channel(cubeInstance.GetParam("nodeChannel"))
+	}
+
+	presenceInterval, err := parseIntParam(cubeInstance, "presenceInterval")
+	if err != nil {
+		return err
+	}
+
+	presenceGracePeriod, err := parseIntParam(cubeInstance, "presenceGracePeriod")
+	if err != nil {
+		return err
+	}
+
+	maxPresenceWatches, err := parseIntParam(cubeInstance, "maxPresenceWatches")
+	if err != nil {
+		return err
+	}
+
+	sessionWindow, err := parseIntParam(cubeInstance, "sessionWindow")
+	if err != nil {
+		return err
+	}
+
+	sessionBufferSize, err := parseIntParam(cubeInstance, "sessionBufferSize")
+	if err != nil {
+		return err
+	}
+
+	var inbox *lib.Inbox
+	inboxDir := cubeInstance.GetParam("inboxDir")
+	if inboxDir != "" {
+		inboxMaxMessages, err := parseIntParam(cubeInstance, "inboxMaxMessages")
+		if err != nil {
+			return err
+		}
+
+		inboxTtl, err := parseIntParam(cubeInstance, "inboxTtl")
+		if err != nil {
+			return err
+		}
+
+		inbox, err = lib.LoadInbox(inboxDir, inboxMaxMessages, time.Duration(inboxTtl)*time.Millisecond)
+		if err != nil {
+			cubeInstance.LogError("Can't load inbox: " + err.Error())
+			return err
+		}
+	}
+
+	retainedMaxKeys, err := parseIntParam(cubeInstance, "retainedMaxKeys")
+	if err != nil {
+		return err
+	}
+
+	retained, err := lib.LoadRetainedMessages(cubeInstance.GetParam("retainedDir"), retainedMaxKeys)
+	if err != nil {
+		cubeInstance.LogError("Can't load retained messages: " + err.Error())
+		return err
+	}
+
+	dedupWindow, err := parseIntParam(cubeInstance, "dedupWindow")
+	if err != nil {
+		return err
+	}
+
+	maxScheduledMessages, err := parseIntParam(cubeInstance, "maxScheduledMessages")
+	if err != nil {
+		return err
+	}
+
+	maxEndpointLeases, err := parseIntParam(cubeInstance, "maxEndpointLeases")
+	if err != nil {
+		return err
+	}
+
+	deliveryRetryInterval, err := parseIntParam(cubeInstance, "deliveryRetryInterval")
+	if err != nil {
+		return err
+	}
+
+	deliveryMaxAttempts, err := parseIntParam(cubeInstance, "deliveryMaxAttempts")
+	if err != nil {
+		return err
+	}
+
+	tenantQuotas := map[lib.TenantId]lib.TenantQuota{}
+	tenantQuotasPath := cubeInstance.GetParam("tenantQuotas")
+	if tenantQuotasPath != "" {
+		tenantQuotas, err = lib.LoadTenantQuotas(tenantQuotasPath)
+		if err != nil {
+			cubeInstance.LogError("Wrong tenant quotas: " + err.Error())
+			return err
+		}
+	}
+
+	h.server, err = lib.NewServer(cubeInstance, lib.ServerConfig{
+		DevMode:                h.devMode,
+		EnableRouting:          h.enableRouting,
+		EndpointsMap:           *endpointsMap,
+		OnlyAuthorizedRequests: h.onlyAuthorizedRequests,
+		JwtSecret:              h.jwtSecret,
+		Port:                   port,
+		MaxInFlightRequests:    maxInFlightRequests,
+		MaxRequestTimeout:      time.Duration(requestTimeout) * time.Millisecond,
+		LegacyFrames:           h.legacyFrames,
+		ForwardedClaims:        parseList(cubeInstance.GetParam("forwardedClaims")),
+		TenantClaim:            tenantClaim,
+		DefaultTenantQuota:     defaultTenantQuota,
+		TenantQuotas:           tenantQuotas,
+		BreakerThreshold:       breakerThreshold,
+		BreakerTimeout:         time.Duration(breakerTimeout) * time.Millisecond,
+		DeadLetterChannel:      cube.Channel(cubeInstance.GetParam("deadLetterChannel")),
+		SpillQueueSize:         spillQueueSize,
+		NodeChannel:            nodeChannel,
+		NodeEventsChannel:      h.nodeEventsChannel,
+		PresenceInterval:       time.Duration(presenceInterval) * time.Millisecond,
+		PresenceGracePeriod:    time.Duration(presenceGracePeriod) * time.Millisecond,
+		PresenceChannel:        cube.Channel(cubeInstance.GetParam("presenceChannel")),
+		MaxPresenceWatches:     maxPresenceWatches,
+		PresenceAuthChannel:    cube.Channel(cubeInstance.GetParam("presenceAuthChannel")),
+		SessionWindow:          time.Duration(sessionWindow) * time.Millisecond,
+		SessionBufferSize:      sessionBufferSize,
+		Inbox:                  inbox,
+		DeliveryRetryInterval:  time.Duration(deliveryRetryInterval) * time.Millisecond,
+		DeliveryMaxAttempts:    deliveryMaxAttempts,
+		OrderedEvents:          cubeInstance.GetParam("orderedEvents") == "true",
+		Retained:               retained,
+		DedupWindow:            time.Duration(dedupWindow) * time.Millisecond,
+		MaxScheduledMessages:   maxScheduledMessages,
+		MaxEndpointLeases:      maxEndpointLeases,
+	})
+
+	if err != nil {
+		cubeInstance.LogError(err.Error())
+		return err
+	}
+
+	routingConfigPath := cubeInstance.GetParam("routingConfig")
+	if routingConfigPath != "" {
+		h.routingConfigWatcher = lib.NewRoutingConfigWatcher(cubeInstance, h.server, routingConfigPath, h.endpointsMap)
+
+		err = h.routingConfigWatcher.Load()
+		if err != nil {
+			return err
+		}
+
+		go h.routingConfigWatcher.Watch()
+	}
+
 	go h.server.Start(cubeInstance)
 	return nil
 }
 
 func (h *Handler) OnStop(c cube.Cube) {
+	if h.server != nil {
+		h.server.Stop()
+	}
+
+	if h.routingConfigWatcher != nil {
+		h.routingConfigWatcher.Stop()
+	}
 }
 
 func (h *Handler) OnReceiveMessage(instance cube.Cube, channel cube.Channel, message cube.Message) {
 
+	nodeTenantId, ok := h.getNodeEventsTenant(channel)
+	if ok {
+		h.onNodeEvent(nodeTenantId, message)
+		return
+	}
+
+	tenantId, ok := h.getChannelTenant(channel)
+	if !ok {
+		fmt.Println("OnReceiveMessage: wrong tenant channel", channel)
+		return
+	}
+
 	switch message.Method {
 	case "closeDeviceConnections":
-		h.onCloseDeviceConnetions(message)
+		h.onCloseDeviceConnetions(tenantId, message)
+		return
 	case "closeUserConnections":
-		h.onCloseUserConnetions(message)
+		h.onCloseUserConnetions(tenantId, message)
+		return
 	case "publishTextMessage":
-		h.onSendMessage(message)
+		h.onSendMessage(tenantId, message)
+		return
+	case "setRetainedMessage":
+		h.onSetRetainedMessage(tenantId, message)
+		return
+	case "clearRetainedMessages":
+		h.onClearRetainedMessages(tenantId, message)
+		return
+	case "cancelScheduledMessage":
+		h.onCancelScheduledMessage(tenantId, message)
+		return
+	}
+
+	if tenantId != "" {
+		fmt.Println("OnReceiveMessage: method is not allowed for tenants", message.Method)
+		return
+	}
+
+	switch message.Method {
+	case "registerEndpoint":
+		h.onRegisterEndpoint(message)
+	case "unregisterEndpoint":
+		h.onUnregisterEndpoint(message)
+	case "setTrafficSplit":
+		h.onSetTrafficSplit(message)
 
 	default:
 		fmt.Println("OnReceiveMessage: is not implemented")
@@ -112,7 +429,7 @@ func (h *Handler) OnReceiveMessage(instance cube.Cube, channel cube.Channel, mes
 	}
 }
 
-func (h *Handler) onCloseDeviceConnetions(message cube.Message) {
+func (h *Handler) onCloseDeviceConnetions(tenantId lib.TenantId, message cube.Message) {
 
 	if message.Params == nil {
 		fmt.Println("onCloseDeviceConnetions: no params")
@@ -121,18 +438,23 @@ func (h *Handler) onCloseDeviceConnetions(message cube.Message) {
 
 	var params js.CloseDeviceConnectionsParams
 	err := json.Unmarshal(*message.Params, &params)
-	if err == nil {
+	if err != nil {
 		fmt.Println("onCloseDeviceConnetions: wrong params")
 		return
 	}
 
+	if params.Code != 0 && !lib.IsValidCloseCode(params.Code) {
+		fmt.Println("onCloseDeviceConnetions: wrong close code", params.Code)
+		return
+	}
+
 	userId := (lib.UserId)(params.UserId)
 	deviceId := (lib.DeviceId)(params.DeviceId)
 
-	h.server.CloseDeviceConnections(userId, deviceId, params.Reason)
+	h.server.CloseDeviceConnections(tenantId, userId, deviceId, params.Code, packCloseReason(params.Reason, params.Details))
 }
 
-func (h *Handler) onCloseUserConnetions(message cube.Message) {
+func (h *Handler) onCloseUserConnetions(tenantId lib.TenantId, message cube.Message) {
 
 	if message.Params == nil {
 		fmt.Println("onCloseUserConnetions: no params")
@@ -141,17 +463,48 @@ func (h *Handler) onCloseUserConnetions(message cube.Message) {
 
 	var params js.CloseUserConnectionsParams
 	err := json.Unmarshal(*message.Params, &params)
-	if err == nil {
+	if err != nil {
 		fmt.Println("onCloseUserConnetions: wrong params")
 		return
 	}
 
+	if params.Code != 0 && !lib.IsValidCloseCode(params.Code) {
+		fmt.Println("onCloseUserConnetions: wrong close code", params.Code)
+		return
+	}
+
 	userId := (lib.UserId)(params.UserId)
 
-	h.server.CloseUserConnections(userId, params.Reason)
+	exceptDevices := []lib.DeviceId{}
+	for _, deviceId := range params.ExceptDevices {
+		exceptDevices = append(exceptDevices, lib.DeviceId(deviceId))
+	}
+
+	h.server.CloseUserConnections(tenantId, userId, exceptDevices, params.Code, packCloseReason(params.Reason, params.Details))
 }
 
-func (h *Handler) onSendMessage(message cube.Message) {
+// packCloseReason encodes details into the close frame text so clients can parse them.
+// Plain reason is used if there are no details or the encoded reason doesn't fit into the frame.
+func packCloseReason(reason string, details *js.CloseDetails) string {
+	if details == nil {
+		return reason
+	}
+
+	packedReason, err := json.Marshal(js.CloseReason{
+		Reason:         reason,
+		ReconnectAfter: details.ReconnectAfter,
+		RedirectUrl:    details.RedirectUrl,
+	})
+
+	if err != nil || len(packedReason) > lib.MaxCloseReasonLength {
+		fmt.Println("packCloseReason: details don't fit into close frame")
+		return reason
+	}
+
+	return string(packedReason)
+}
+
+func (h *Handler) onSendMessage(tenantId lib.TenantId, message cube.Message) {
 
 	if message.Params == nil {
 		fmt.Println("onSendMessage: no params")
@@ -160,23 +513,162 @@ func (h *Handler) onSendMessage(message cube.Message) {
 
 	var params js.PublishMessageParams
 	err := json.Unmarshal(*message.Params, &params)
-	if err == nil {
+	if err != nil {
 		fmt.Println("onSendMessage: wrong params")
 		return
 	}
 
-	for _, receiver := range params.To {
-		h.server.SendMessage(
-			(*lib.UserId)(receiver.UserId),
-			(*lib.DeviceId)(receiver.DeviceId),
-			params.Type,
-			params.Body,
-		)
+	exclusion := lib.Exclusion{}
+	for _, connectionId := range params.ExceptConnections {
+		exclusion.ConnectionIds = append(exclusion.ConnectionIds, lib.ConnectionId(connectionId))
+	}
+
+	for _, deviceId := range params.ExceptDevices {
+		exclusion.DeviceIds = append(exclusion.DeviceIds, lib.DeviceId(deviceId))
+	}
+
+	options := lib.SendOptions{
+		Store:    params.Store,
+		StoreTtl: time.Duration(params.StoreTtl) * time.Millisecond,
+		Reliable: params.Reliable,
+	}
+
+	if params.ExpiresAt > 0 {
+		options.ExpiresAt = millisecondsToTime(params.ExpiresAt)
+	}
+
+	deliverAt := time.Time{}
+	if params.DeliverAt > 0 {
+		deliverAt = millisecondsToTime(params.DeliverAt)
+	}
+
+	err = h.server.PublishMessage(tenantId, params.MessageId, deliverAt, func() {
+		for _, receiver := range params.To {
+			connectionId, ok := h.getReceiverConnection(receiver)
+			if !ok {
+				continue
+			}
+
+			h.server.SendMessage(
+				tenantId,
+				connectionId,
+				(*lib.UserId)(receiver.UserId),
+				(*lib.DeviceId)(receiver.DeviceId),
+				exclusion,
+				params.Type,
+				params.Body,
+				options,
+			)
+		}
+	})
+
+	if err != nil {
+		fmt.Println("onSendMessage:", err, params.MessageId)
+	}
+}
+
+// getReceiverConnection returns the connection id of the receiver or false if the receiver isn't on this instance.
+// Connection ids are numbered per instance, so in cluster mode connections are selected by "connectionUid"
+// or by "connectionId" together with "userId".
+func (h *Handler) getReceiverConnection(receiver js.Receiver) (*lib.ConnectionId, bool) {
+
+	if receiver.ConnectionUid != nil {
+		connectionId, ok := h.server.GetConnectionIdByUid(*receiver.ConnectionUid)
+		return &connectionId, ok
+	}
+
+	if receiver.ConnectionId != nil && receiver.UserId == nil && h.server.IsClusterEnabled() {
+		fmt.Println("onSendMessage: connectionId without userId is ambiguous in cluster mode")
+		return nil, false
+	}
+
+	return (*lib.ConnectionId)(receiver.ConnectionId), true
+}
+
+func millisecondsToTime(milliseconds int64) time.Time {
+	return time.Unix(0, milliseconds*int64(time.Millisecond))
+}
+
+func parseCancelScheduledMessageParams(rawParams *json.RawMessage) (*js.CancelScheduledMessageParams, error) {
+
+	if rawParams == nil {
+		return nil, fmt.Errorf("no params")
+	}
+
+	var params js.CancelScheduledMessageParams
+	err := json.Unmarshal(*rawParams, &params)
+	if err != nil {
+		return nil, fmt.Errorf("wrong params")
+	}
+
+	if params.MessageId == "" {
+		return nil, fmt.Errorf("message id is required")
+	}
+
+	return &params, nil
+}
+
+func (h *Handler) onCancelScheduledMessage(tenantId lib.TenantId, message cube.Message) {
+
+	params, err := parseCancelScheduledMessageParams(message.Params)
+	if err != nil {
+		fmt.Println("onCancelScheduledMessage:", err)
+		return
+	}
+
+	h.server.CancelScheduledMessage(tenantId, params.MessageId)
+}
+
+func (h *Handler) onCancelScheduledMessageRequest(tenantId lib.TenantId, request cube.Request) cube.Response {
+
+	params, err := parseCancelScheduledMessageParams(request.Params)
+	if err != nil {
+		return cube.NewErrorResponse("", "WrongParams", err.Error())
 	}
+
+	return packResult(js.CancelScheduledMessageResult{
+		Canceled: h.server.CancelScheduledMessage(tenantId, params.MessageId),
+	})
 }
 
 //From bus
 func (h *Handler) OnReceiveRequest(instance cube.Cube, channel cube.Channel, request cube.Request) cube.Response {
+
+	tenantId, ok := h.getChannelTenant(channel)
+	if ok {
+		switch request.Method {
+		case "getPresence":
+			return h.onGetPresence(tenantId, request)
+		case "getInbox":
+			return h.onGetInbox(tenantId, request)
+		case "purgeInbox":
+			return h.onPurgeInbox(tenantId, request)
+		case "getRetainedMessages":
+			return h.onGetRetainedMessages(tenantId, request)
+		case "clearRetainedMessages":
+			return h.onClearRetainedMessagesRequest(tenantId, request)
+		case "cancelScheduledMessage":
+			return h.onCancelScheduledMessageRequest(tenantId, request)
+		}
+	}
+
+	if !ok || tenantId != "" {
+		return cube.NewErrorResponse("", "Forbidden", "method is not allowed for tenants")
+	}
+
+	switch request.Method {
+	case "getMetrics":
+		return h.onGetMetrics()
+	case "registerEndpoint":
+		return h.onRegisterEndpointRequest(request)
+	case "unregisterEndpoint":
+		return h.onUnregisterEndpointRequest(request)
+	case "getRoutingTable":
+		return h.onGetRoutingTable()
+	case "setTrafficSplit":
+		return h.onSetTrafficSplitRequest(request)
+	}
+
 	fmt.Println("OnReceiveRequest: is not implemented")
 	instance.LogError("OnReceiveRequest: is not implemented")
 	return cube.NewErrorResponse(
@@ -186,4 +678,18 @@ func (h *Handler) OnReceiveRequest(instance cube.Cube, channel cube.Channel, req
 	)
 }
 
+func (h *Handler) onGetMetrics() cube.Response {
+	return packResult(h.server.GetMetrics().Snapshot())
+}
+
+func packResult(result interface{}) cube.Response {
+
+	packedResult, err := json.Marshal(result)
+	if err != nil {
+		return cube.NewErrorResponse("", "ServerError", err.Error())
+	}
+
+	return cube.NewResultResponse("", (*json.RawMessage)(&packedResult))
+}
+
 var _ cube.HandlerInterface = (*Handler)(nil)
@@ -0,0 +1,61 @@
+package cube_websocket_gateway
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+	"github.com/akaumov/cube-websocket-gateway/lib"
+)
+
+func (h *Handler) parseInboxParams(request cube.Request) (*js.InboxParams, *lib.Inbox, error) {
+
+	inbox := h.server.GetInbox()
+	if inbox == nil {
+		return nil, nil, fmt.Errorf("inbox is disabled")
+	}
+
+	if request.Params == nil {
+		return nil, nil, fmt.Errorf("no params")
+	}
+
+	var params js.InboxParams
+	err := json.Unmarshal(*request.Params, &params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrong params")
+	}
+
+	if params.UserId == "" {
+		return nil, nil, fmt.Errorf("user id is required")
+	}
+
+	return &params, inbox, nil
+}
+
+func (h *Handler) onGetInbox(tenantId lib.TenantId, request cube.Request) cube.Response {
+
+	params, inbox, err := h.parseInboxParams(request)
+	if err != nil {
+		return cube.NewErrorResponse("", "WrongParams", err.Error())
+	}
+
+	return packResult(js.GetInboxResult{
+		Messages: inbox.List(tenantId, lib.UserId(params.UserId), (*lib.DeviceId)(params.DeviceId)),
+	})
+}
+
+func (h *Handler) onPurgeInbox(tenantId lib.TenantId, request cube.Request) cube.Response {
+
+	params, inbox, err := h.parseInboxParams(request)
+	if err != nil {
+		return cube.NewErrorResponse("", "WrongParams", err.Error())
+	}
+
+	removed, err := inbox.Purge(tenantId, lib.UserId(params.UserId), (*lib.DeviceId)(params.DeviceId))
+	if err != nil {
+		return cube.NewErrorResponse("", "ServerError", err.Error())
+	}
+
+	return packResult(js.PurgeInboxResult{Removed: removed})
+}
@@ -0,0 +1,86 @@
+package js
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Binary routing packet layout:
+//
+//	flags: 1 byte, other bits must be zero
+//	endpoint length: 1 byte, endpoint: n bytes
+//	request id length: 1 byte, request id: n bytes, if BINARY_FLAG_REQUEST_ID is set
+//	timeout in milliseconds: 4 bytes big endian, if BINARY_FLAG_TIMEOUT is set
+//	payload: the rest of the frame
+const (
+	BINARY_FLAG_REQUEST_ID byte = 1 << 0
+	BINARY_FLAG_REQUEST    byte = 1 << 1
+	BINARY_FLAG_TIMEOUT    byte = 1 << 2
+
+	binaryFlagsMask = BINARY_FLAG_REQUEST_ID | BINARY_FLAG_REQUEST | BINARY_FLAG_TIMEOUT
+)
+
+var ErrorWrongBinaryPacket = errors.New("js: wrong binary routing packet")
+
+// BinaryRoutingPacket references parts of the frame it was parsed from, nothing is copied.
+type BinaryRoutingPacket struct {
+	Flags     byte
+	Endpoint  []byte
+	RequestId []byte
+	Timeout   uint32
+	Payload   []byte
+}
+
+func ParseBinaryRoutingPacket(data []byte) (*BinaryRoutingPacket, error) {
+
+	if len(data) < 2 || data[0]&^binaryFlagsMask != 0 {
+		return nil, ErrorWrongBinaryPacket
+	}
+
+	packet := &BinaryRoutingPacket{
+		Flags: data[0],
+	}
+
+	offset := 1
+	endpointLength := int(data[offset])
+	offset++
+
+	if endpointLength == 0 || len(data) < offset+endpointLength {
+		return nil, ErrorWrongBinaryPacket
+	}
+
+	packet.Endpoint = data[offset : offset+endpointLength]
+	offset += endpointLength
+
+	if packet.Flags&BINARY_FLAG_REQUEST_ID != 0 {
+		if len(data) < offset+1 {
+			return nil, ErrorWrongBinaryPacket
+		}
+
+		requestIdLength := int(data[offset])
+		offset++
+
+		if requestIdLength == 0 || len(data) < offset+requestIdLength {
+			return nil, ErrorWrongBinaryPacket
+		}
+
+		packet.RequestId = data[offset : offset+requestIdLength]
+		offset += requestIdLength
+	}
+
+	if packet.Flags&BINARY_FLAG_TIMEOUT != 0 {
+		if len(data) < offset+4 {
+			return nil, ErrorWrongBinaryPacket
+		}
+
+		packet.Timeout = binary.BigEndian.Uint32(data[offset : offset+4])
+		offset += 4
+	}
+
+	packet.Payload = data[offset:]
+	return packet, nil
+}
+
+func (p *BinaryRoutingPacket) IsRequest() bool {
+	return p.Flags&BINARY_FLAG_REQUEST != 0
+}
@@ -0,0 +1,60 @@
+package js
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseBinaryRoutingPacket(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		data      []byte
+		valid     bool
+		endpoint  string
+		requestId string
+		timeout   uint32
+		request   bool
+		payload   []byte
+	}{
+		{"endpoint only", []byte{0, 4, 'c', 'h', 'a', 't'}, true, "chat", "", 0, false, []byte{}},
+		{"payload", []byte{0, 1, 'a', 1, 2, 3}, true, "a", "", 0, false, []byte{1, 2, 3}},
+		{"request id", []byte{BINARY_FLAG_REQUEST_ID, 1, 'a', 2, '4', '2', 9}, true, "a", "42", 0, false, []byte{9}},
+		{"request", []byte{BINARY_FLAG_REQUEST_ID | BINARY_FLAG_REQUEST | BINARY_FLAG_TIMEOUT, 1, 'a', 1, '1', 0, 0, 0x13, 0x88, 7},
+			true, "a", "1", 5000, true, []byte{7}},
+		{"timeout without request id", []byte{BINARY_FLAG_TIMEOUT, 1, 'a', 0xff, 0xff, 0xff, 0xff}, true, "a", "", 0xffffffff, false, []byte{}},
+
+		{"empty", []byte{}, false, "", "", 0, false, nil},
+		{"flags only", []byte{0}, false, "", "", 0, false, nil},
+		{"unknown flag", []byte{1 << 3, 1, 'a'}, false, "", "", 0, false, nil},
+		{"unknown high flag", []byte{BINARY_FLAG_REQUEST | 1<<7, 1, 'a'}, false, "", "", 0, false, nil},
+		{"empty endpoint", []byte{0, 0, 1, 2}, false, "", "", 0, false, nil},
+		{"truncated endpoint", []byte{0, 5, 'c', 'h', 'a', 't'}, false, "", "", 0, false, nil},
+		{"missing request id length", []byte{BINARY_FLAG_REQUEST_ID, 1, 'a'}, false, "", "", 0, false, nil},
+		{"empty request id", []byte{BINARY_FLAG_REQUEST_ID, 1, 'a', 0, 1}, false, "", "", 0, false, nil},
+		{"truncated request id", []byte{BINARY_FLAG_REQUEST_ID, 1, 'a', 3, '1', '2'}, false, "", "", 0, false, nil},
+		{"missing timeout", []byte{BINARY_FLAG_TIMEOUT, 1, 'a'}, false, "", "", 0, false, nil},
+		{"truncated timeout", []byte{BINARY_FLAG_REQUEST_ID | BINARY_FLAG_TIMEOUT, 1, 'a', 1, '1', 0, 0, 1}, false, "", "", 0, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet, err := ParseBinaryRoutingPacket(test.data)
+			if !test.valid {
+				if err != ErrorWrongBinaryPacket {
+					t.Errorf("ParseBinaryRoutingPacket() = %+v, %v, want ErrorWrongBinaryPacket", packet, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseBinaryRoutingPacket: %v", err)
+			}
+
+			if string(packet.Endpoint) != test.endpoint || string(packet.RequestId) != test.requestId ||
+				packet.Timeout != test.timeout || packet.IsRequest() != test.request || !bytes.Equal(packet.Payload, test.payload) {
+				t.Errorf("ParseBinaryRoutingPacket() = %+v", packet)
+			}
+		})
+	}
+}
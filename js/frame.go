@@ -0,0 +1,98 @@
+package js
+
+import (
+	"encoding/json"
+)
+
+// FRAME_VERSION is increased on incompatible changes of Frame.
+const FRAME_VERSION = 1
+
+type FrameType string
+
+const (
+	ERROR_FRAME    FrameType = "error"
+	ACK_FRAME      FrameType = "ack"
+	NOTICE_FRAME   FrameType = "notice"
+	RESPONSE_FRAME FrameType = "response"
+	PRESENCE_FRAME FrameType = "presence"
+	SESSION_FRAME  FrameType = "session"
+	MESSAGE_FRAME  FrameType = "message"
+)
+
+// Error codes of frames generated by the gateway, they match the legacy plain text frames.
+const (
+	ERROR_PARSING_ROUTING_PACKET = "ErrorParsingRoutingPacket"
+	ERROR_ENDPOINT_NOT_FOUND     = "ErrorEndpointNotFound"
+	ERROR_EMPTY_PAYLOAD          = "ErrorEmptyPayload"
+	ERROR_EMPTY_REQUEST_ID       = "ErrorEmptyRequestId"
+	ERROR_UNAUTHORIZED           = "ErrorUnauthorized"
+	ERROR_FORBIDDEN              = "ErrorForbidden"
+	ERROR_WRONG_MESSAGE_TYPE     = "ErrorWrongMessageType"
+	ERROR_MESSAGE_TOO_BIG        = "ErrorMessageTooBig"
+	ERROR_RATE_LIMIT             = "ErrorRateLimit"
+	ERROR_INVALID_PAYLOAD        = "ErrorInvalidPayload"
+	ERROR_SERVICE_UNAVAILABLE    = "ErrorServiceUnavailable"
+	ERROR_UNKNOWN_CONTROL        = "ErrorUnknownControl"
+	ERROR_TOO_MANY_WATCHES       = "ErrorTooManyWatches"
+	ERROR_TOO_MANY_REQUESTS      = "ErrorTooManyRequests"
+	ERROR_TIMEOUT                = "ErrorTimeout"
+	ERROR_SERVER                 = "ErrorServer"
+)
+
+// Notice codes.
+const (
+	NOTICE_RESYNC_REQUIRED = "ResyncRequired"
+	NOTICE_QUEUED          = "Queued"
+)
+
+// Violation is a payload validation failure, Path is a json pointer to the wrong value.
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// Frame is the envelope of every server to client frame generated by the gateway.
+// Result is set only for responses, Code and Message only for errors and notices,
+// UserId and Online only for presence changes. Session frames carry SessionId and the last Seq of the session,
+// Code is NOTICE_RESYNC_REQUIRED if missed messages can't be replayed. Message frames carry text messages of sessions
+// and reliable messages with DeliveryId, binary reliable messages are sent base64 encoded in Binary.
+type Frame struct {
+	Version    int              `json:"v"`
+	Type       FrameType        `json:"type"`
+	Code       string           `json:"code,omitempty"`
+	Message    string           `json:"message,omitempty"`
+	RequestId  string           `json:"requestId,omitempty"`
+	Retryable  bool             `json:"retryable,omitempty"`
+	Violations []Violation      `json:"violations,omitempty"`
+	Result     *json.RawMessage `json:"result,omitempty"`
+	UserId     string           `json:"userId,omitempty"`
+	Online     *bool            `json:"online,omitempty"`
+	SessionId  string           `json:"sessionId,omitempty"`
+	Seq        uint64           `json:"seq,omitempty"`
+	Text       *string          `json:"text,omitempty"`
+	Binary     []byte           `json:"binary,omitempty"`
+	DeliveryId uint64           `json:"deliveryId,omitempty"`
+}
+
+type ControlType string
+
+const (
+	WATCH_PRESENCE_CONTROL   ControlType = "watchPresence"
+	UNWATCH_PRESENCE_CONTROL ControlType = "unwatchPresence"
+	ACK_CONTROL              ControlType = "ack"
+)
+
+// ControlFrame is a client to server frame handled by the gateway itself, it is a text frame with "control" field
+// and, unless routing is enabled, "v" set to FRAME_VERSION.
+type ControlFrame struct {
+	Version     int         `json:"v"`
+	Control     ControlType `json:"control"`
+	RequestId   string      `json:"requestId,omitempty"`
+	UserIds     []string    `json:"userIds,omitempty"`
+	DeliveryIds []uint64    `json:"deliveryIds,omitempty"`
+}
+
+type WatchPresenceResult struct {
+	Watched []string `json:"watched"`
+	Online  []string `json:"online"`
+}
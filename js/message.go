@@ -11,37 +11,322 @@ const (
 	BINARY MessageType = 1
 )
 
+// OnReceiveMessageParams are params of connection events. ConnectionUid is unique across gateway instances,
+// Seq is increased by one with every event of the connection starting with 1 for "onConnect".
 type OnReceiveMessageParams struct {
-	InputTime int64       `json:"inputTime"`
-	UserId    *string     `json:"userId"`
-	DeviceId  *string     `json:"deviceId"`
-	Type      MessageType `json:"type"`
-	Body      []byte      `json:"body"`
+	InputTime     int64                  `json:"inputTime"`
+	ConnectionId  int64                  `json:"connectionId"`
+	ConnectionUid string                 `json:"connectionUid"`
+	Seq           uint64                 `json:"seq"`
+	UserId        *string                `json:"userId"`
+	DeviceId      *string                `json:"deviceId"`
+	Endpoint      string                 `json:"endpoint,omitempty"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+	Type          MessageType            `json:"type"`
+	Body          []byte                 `json:"body"`
+}
+
+// CloseReason is sent to clients as the close frame text when the close operation carries details.
+type CloseReason struct {
+	Reason         string `json:"reason"`
+	ReconnectAfter int64  `json:"reconnectAfter,omitempty"`
+	RedirectUrl    string `json:"redirectUrl,omitempty"`
+}
+
+// CloseDetails is an optional hint for clients how to behave after their connections are closed.
+// ReconnectAfter is in milliseconds.
+type CloseDetails struct {
+	ReconnectAfter int64  `json:"reconnectAfter"`
+	RedirectUrl    string `json:"redirectUrl"`
 }
 
 type CloseDeviceConnectionsParams struct {
-	UserId   string `json:"userId"`
-	DeviceId string `json:"deviceId"`
-	Reason   string `json:"reason"`
+	UserId   string        `json:"userId"`
+	DeviceId string        `json:"deviceId"`
+	Code     int           `json:"code"`
+	Reason   string        `json:"reason"`
+	Details  *CloseDetails `json:"details"`
 }
 
+// CloseUserConnectionsParams closes all connections of the user except devices listed in ExceptDevices.
 type CloseUserConnectionsParams struct {
-	UserId string `json:"userId"`
-	Reason string `json:"reason"`
+	UserId        string        `json:"userId"`
+	ExceptDevices []string      `json:"exceptDevices"`
+	Code          int           `json:"code"`
+	Reason        string        `json:"reason"`
+	Details       *CloseDetails `json:"details"`
 }
 
+// Receiver selects connections by user, by user and device or by connection id.
+// ConnectionId takes precedence: if UserId is set too, it must match the owner of the connection.
+// ConnectionId is unique only on its instance, ConnectionUid is unique across instances and takes precedence over it.
 type Receiver struct {
-	UserId   *string `json:"userId"`
-	DeviceId *string `json:"deviceId"`
+	ConnectionUid *string `json:"connectionUid,omitempty"`
+	ConnectionId  *int64  `json:"connectionId"`
+	UserId        *string `json:"userId"`
+	DeviceId      *string `json:"deviceId"`
 }
 
 type PublishMessageParams struct {
-	To   []Receiver  `json:"to"`
-	Type MessageType `json:"type"`
-	Body []byte      `json:"body"`
+	To                []Receiver  `json:"to"`
+	ExceptConnections []int64     `json:"exceptConnections"`
+	ExceptDevices     []string    `json:"exceptDevices"`
+	Type              MessageType `json:"type"`
+	Body              []byte      `json:"body"`
+	Store             bool        `json:"store,omitempty"`
+	StoreTtl          int64       `json:"storeTtl,omitempty"`
+	Reliable          bool        `json:"reliable,omitempty"`
+	// MessageId deduplicates messages within the dedup window and identifies scheduled messages.
+	MessageId string `json:"messageId,omitempty"`
+	// ExpiresAt and DeliverAt are unix time in milliseconds.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	DeliverAt int64 `json:"deliverAt,omitempty"`
+}
+
+type CancelScheduledMessageParams struct {
+	MessageId string `json:"messageId"`
+}
+
+type CancelScheduledMessageResult struct {
+	Canceled bool `json:"canceled"`
 }
 
+type PacketMode string
+
+const (
+	MESSAGE_MODE PacketMode = ""
+	REQUEST_MODE PacketMode = "request"
+)
+
+// RoutingPacket is sent by clients when routing is enabled.
+// In request mode the gateway waits for the endpoint response and sends it back with the same RequestId,
+// Timeout is in milliseconds.
 type RoutingPacket struct {
-	Endpoint string          `json:"endpoint"`
-	Payload  json.RawMessage `json:"payload"`
+	Endpoint  string          `json:"endpoint"`
+	Mode      PacketMode      `json:"mode"`
+	RequestId string          `json:"requestId"`
+	Timeout   int64           `json:"timeout"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// OnReceiveRequestParams are params of "onRequest", Seq numbers requests of the connection apart from events.
+type OnReceiveRequestParams struct {
+	InputTime     int64                  `json:"inputTime"`
+	ConnectionId  int64                  `json:"connectionId"`
+	ConnectionUid string                 `json:"connectionUid"`
+	Seq           uint64                 `json:"seq"`
+	UserId        *string                `json:"userId"`
+	DeviceId      *string                `json:"deviceId"`
+	RequestId     string                 `json:"requestId"`
+	Endpoint      string                 `json:"endpoint"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+	Type          MessageType            `json:"type"`
+	Body          []byte                 `json:"body"`
+}
+
+type ResponseError struct {
+	Name    string `json:"name"`
+	Message string `json:"description"`
+}
+
+// RoutingResponse is sent to the client in reply to a request mode RoutingPacket.
+type RoutingResponse struct {
+	RequestId string           `json:"requestId"`
+	Result    *json.RawMessage `json:"result"`
+	Error     *ResponseError   `json:"error"`
+}
+
+// RegisterEndpointParams binds the endpoint to the channel for Ttl milliseconds, services renew it by registering again.
+type RegisterEndpointParams struct {
+	Endpoint string `json:"endpoint"`
+	Channel  string `json:"channel"`
+	Ttl      int64  `json:"ttl"`
+}
+
+type RegisterEndpointResult struct {
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+type UnregisterEndpointParams struct {
+	Endpoint string `json:"endpoint"`
+	Channel  string `json:"channel"`
+}
+
+const (
+	STATIC_ROUTE  = "static"
+	DYNAMIC_ROUTE = "dynamic"
+)
+
+// RoutingEntry is an entry of the effective routing table, ExpiresAt is set for dynamic routes only.
+type RoutingEntry struct {
+	Endpoint  string `json:"endpoint"`
+	Channel   string `json:"channel"`
+	Source    string `json:"source"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+type WeightedTarget struct {
+	Channel string `json:"channel"`
+	Weight  int    `json:"weight"`
+}
+
+// TrafficSplit distributes users between channels by weights, Overrides pin users to channels.
+type TrafficSplit struct {
+	Targets   []WeightedTarget  `json:"targets"`
+	Overrides map[string]string `json:"overrides"`
+}
+
+// SetTrafficSplitParams sets the split of the endpoint at runtime, null split restores the split of the routing config.
+type SetTrafficSplitParams struct {
+	Endpoint string        `json:"endpoint"`
+	Split    *TrafficSplit `json:"split"`
+}
+
+// DeadLetterParams wraps a message which couldn't be published to Channel, FailedAt is in nanoseconds.
+type DeadLetterParams struct {
+	Channel  string          `json:"channel"`
+	Error    string          `json:"error"`
+	FailedAt int64           `json:"failedAt"`
+	Message  json.RawMessage `json:"message"`
+}
+
+// NodeParams describes a gateway instance, Channel is the bus subject which reaches only this instance.
+type NodeParams struct {
+	InstanceId string `json:"instanceId"`
+	Channel    string `json:"channel"`
+}
+
+// NodeUserParams is sent when the first connection of a user appears on a node or the last one closes.
+type NodeUserParams struct {
+	InstanceId string `json:"instanceId"`
+	Channel    string `json:"channel"`
+	UserId     string `json:"userId"`
+}
+
+type NodeUser struct {
+	TenantId string `json:"tenantId,omitempty"`
+	UserId   string `json:"userId"`
+}
+
+// NodeSnapshotParams lists users of a node, it is published periodically and serves as the node heartbeat.
+// Big snapshots are split into Chunks messages with the same SnapshotId, users are replaced when all chunks arrive.
+type NodeSnapshotParams struct {
+	InstanceId string     `json:"instanceId"`
+	Channel    string     `json:"channel"`
+	SnapshotId uint64     `json:"snapshotId,omitempty"`
+	Chunk      int        `json:"chunk,omitempty"`
+	Chunks     int        `json:"chunks,omitempty"`
+	Users      []NodeUser `json:"users"`
+}
+
+type GetPresenceParams struct {
+	UserIds []string `json:"userIds"`
+}
+
+type UserPresence struct {
+	UserId string       `json:"userId"`
+	Online bool         `json:"online"`
+	Nodes  []NodeParams `json:"nodes"`
+}
+
+type GetPresenceResult struct {
+	Users []UserPresence `json:"users"`
+}
+
+// PresenceEventParams are params of "onUserOnline", "onUserOffline", "onDeviceOnline" and "onDeviceOffline",
+// Time is when the first connection was opened or the last one was closed.
+type PresenceEventParams struct {
+	UserId   string `json:"userId"`
+	DeviceId string `json:"deviceId,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+// AuthorizePresenceWatchParams are params of "authorizePresenceWatch" request,
+// the result is AuthorizePresenceWatchResult with user ids the connection may watch.
+type AuthorizePresenceWatchParams struct {
+	ConnectionId int64                  `json:"connectionId"`
+	UserId       string                 `json:"userId"`
+	DeviceId     string                 `json:"deviceId"`
+	Claims       map[string]interface{} `json:"claims,omitempty"`
+	UserIds      []string               `json:"userIds"`
+}
+
+type AuthorizePresenceWatchResult struct {
+	UserIds []string `json:"userIds"`
+}
+
+// InboxMessage is a message stored for a user without connections, DeviceId is set for messages to a device.
+// Messages to the user are kept until they expire, DeliveredTo lists devices which have got them.
+// StoredAt and ExpiresAt are in milliseconds.
+type InboxMessage struct {
+	Id          uint64      `json:"id"`
+	DeviceId    string      `json:"deviceId,omitempty"`
+	DeliveredTo []string    `json:"deliveredTo,omitempty"`
+	Type        MessageType `json:"type"`
+	Body        []byte      `json:"body"`
+	Reliable    bool        `json:"reliable,omitempty"`
+	StoredAt    int64       `json:"storedAt"`
+	ExpiresAt   int64       `json:"expiresAt"`
+}
+
+// InboxParams are params of "getInbox" and "purgeInbox", without DeviceId all messages of the user are used.
+type InboxParams struct {
+	UserId   string  `json:"userId"`
+	DeviceId *string `json:"deviceId,omitempty"`
+}
+
+type GetInboxResult struct {
+	Messages []InboxMessage `json:"messages"`
+}
+
+type PurgeInboxResult struct {
+	Removed int `json:"removed"`
+}
+
+// RetainedMessage is the latest message with the key of a user or of a device if DeviceId is set,
+// Version increases with every change of retained messages, UpdatedAt is in milliseconds.
+type RetainedMessage struct {
+	DeviceId  string      `json:"deviceId,omitempty"`
+	Key       string      `json:"key"`
+	Version   uint64      `json:"version"`
+	Type      MessageType `json:"type"`
+	Body      []byte      `json:"body"`
+	UpdatedAt int64       `json:"updatedAt"`
+}
+
+type SetRetainedMessageParams struct {
+	UserId   string      `json:"userId"`
+	DeviceId *string     `json:"deviceId,omitempty"`
+	Key      string      `json:"key"`
+	Type     MessageType `json:"type"`
+	Body     []byte      `json:"body"`
+}
+
+// RetainedMessagesParams are params of "getRetainedMessages" and "clearRetainedMessages",
+// without DeviceId or Key messages of all devices or with all keys are used.
+type RetainedMessagesParams struct {
+	UserId   string  `json:"userId"`
+	DeviceId *string `json:"deviceId,omitempty"`
+	Key      *string `json:"key,omitempty"`
+}
+
+type GetRetainedMessagesResult struct {
+	Messages []RetainedMessage `json:"messages"`
+}
+
+type ClearRetainedMessagesResult struct {
+	Removed int `json:"removed"`
+}
+
+// DeliveryFailedParams are params of "deliveryFailed" event sent when a reliable message wasn't acknowledged,
+// Reason is "noAck", "connectionClosed" or "expired".
+type DeliveryFailedParams struct {
+	DeliveryId   uint64      `json:"deliveryId"`
+	ConnectionId int64       `json:"connectionId"`
+	UserId       string      `json:"userId"`
+	DeviceId     string      `json:"deviceId"`
+	Type         MessageType `json:"type"`
+	Body         []byte      `json:"body"`
+	Attempts     int         `json:"attempts"`
+	Reason       string      `json:"reason"`
 }
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akaumov/cube"
+)
+
+// methodHandler answers calls of a channel, it gets the timeout of the call.
+type methodHandler func(request cube.Request, timeout time.Duration) (*cube.Response, error)
+
+// memoryBus is an in-memory stand-in of the bus, messages are delivered synchronously to subscribers
+// of the channel and kept for assertions.
+type memoryBus struct {
+	mutex       sync.Mutex
+	subscribers map[cube.Channel][]func(message cube.Message)
+	methods     map[cube.Channel]methodHandler
+	published   map[cube.Channel][]cube.Message
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{
+		mutex:       sync.Mutex{},
+		subscribers: map[cube.Channel][]func(message cube.Message){},
+		methods:     map[cube.Channel]methodHandler{},
+		published:   map[cube.Channel][]cube.Message{},
+	}
+}
+
+func (b *memoryBus) Subscribe(channel cube.Channel, subscriber func(message cube.Message)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.subscribers[channel] = append(b.subscribers[channel], subscriber)
+}
+
+func (b *memoryBus) HandleMethod(channel cube.Channel, method methodHandler) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.methods[channel] = method
+}
+
+func (b *memoryBus) Publish(channel cube.Channel, message cube.Message) {
+	b.mutex.Lock()
+	b.published[channel] = append(b.published[channel], message)
+	subscribers := append([]func(message cube.Message){}, b.subscribers[channel]...)
+	b.mutex.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(message)
+	}
+}
+
+// Messages returns messages published to the channel.
+func (b *memoryBus) Messages(channel cube.Channel) []cube.Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]cube.Message{}, b.published[channel]...)
+}
+
+// busCube is a cube instance connected to the memory bus. If publishHook is set, it is called
+// before every publish and its error is returned instead of publishing.
+type busCube struct {
+	bus         *memoryBus
+	instanceId  string
+	params      map[string]string
+	hookMutex   sync.Mutex
+	publishHook func(channel cube.Channel) error
+}
+
+func newBusCube(bus *memoryBus, instanceId string) *busCube {
+	return &busCube{bus: bus, instanceId: instanceId, params: map[string]string{}}
+}
+
+func (c *busCube) GetParam(param string) string {
+	return c.params[param]
+}
+
+func (c *busCube) GetClass() string {
+	return "websocket-gateway"
+}
+
+func (c *busCube) GetInstanceId() string {
+	return c.instanceId
+}
+
+func (c *busCube) SetPublishHook(hook func(channel cube.Channel) error) {
+	c.hookMutex.Lock()
+	defer c.hookMutex.Unlock()
+
+	c.publishHook = hook
+}
+
+func (c *busCube) PublishMessage(channel cube.Channel, message cube.Message) error {
+	c.hookMutex.Lock()
+	hook := c.publishHook
+	c.hookMutex.Unlock()
+
+	if hook != nil {
+		err := hook(channel)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.bus.Publish(channel, message)
+	return nil
+}
+
+func (c *busCube) CallMethod(channel cube.Channel, request cube.Request, timeout time.Duration) (*cube.Response, error) {
+	c.bus.mutex.Lock()
+	method := c.bus.methods[channel]
+	c.bus.mutex.Unlock()
+
+	if method == nil {
+		return nil, cube.ErrorTimeout
+	}
+
+	return method(request, timeout)
+}
+
+func (c *busCube) Stop() {}
+
+func (c *busCube) LogDebug(text string) error   { return nil }
+func (c *busCube) LogError(text string) error   { return nil }
+func (c *busCube) LogFatal(text string) error   { return nil }
+func (c *busCube) LogInfo(text string) error    { return nil }
+func (c *busCube) LogWarning(text string) error { return nil }
+func (c *busCube) LogTrace(text string) error   { return nil }
+
+// waitFor polls the condition, so asynchronous announcements have time to reach the bus.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", description)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
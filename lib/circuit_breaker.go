@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/akaumov/cube"
+)
+
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerTimeout   = 10 * time.Second
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker opens after threshold consecutive failures. After timeout one trial call is allowed,
+// its success closes the breaker and its failure opens it again.
+type CircuitBreaker struct {
+	mutex     sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	threshold int
+	timeout   time.Duration
+	inTrial   bool
+}
+
+func NewCircuitBreaker(threshold int, timeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		mutex:     sync.Mutex{},
+		state:     breakerClosed,
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.timeout {
+			return false
+		}
+
+		b.state = breakerHalfOpen
+		b.inTrial = true
+		return true
+
+	case breakerHalfOpen:
+		if b.inTrial {
+			return false
+		}
+
+		b.inTrial = true
+		return true
+	}
+
+	return true
+}
+
+// IsOpen returns true if calls are rejected now, unlike Allow it doesn't start a trial.
+func (b *CircuitBreaker) IsOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) < b.timeout
+	case breakerHalfOpen:
+		return b.inTrial
+	}
+
+	return false
+}
+
+// OnSuccess returns true if the success has closed the breaker.
+func (b *CircuitBreaker) OnSuccess() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	wasOpen := b.state != breakerClosed
+	b.state = breakerClosed
+	b.failures = 0
+	b.inTrial = false
+	return wasOpen
+}
+
+// OnFailure returns true if the failure has opened the breaker.
+func (b *CircuitBreaker) OnFailure() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.inTrial = false
+
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		return true
+	}
+
+	return false
+}
+
+// CircuitBreakers keeps a breaker per output channel.
+type CircuitBreakers struct {
+	mutex     sync.Mutex
+	breakers  map[cube.Channel]*CircuitBreaker
+	threshold int
+	timeout   time.Duration
+}
+
+func NewCircuitBreakers(threshold int, timeout time.Duration) *CircuitBreakers {
+	if threshold <= 0 {
+		threshold = DefaultBreakerThreshold
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultBreakerTimeout
+	}
+
+	return &CircuitBreakers{
+		mutex:     sync.Mutex{},
+		breakers:  map[cube.Channel]*CircuitBreaker{},
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+func (b *CircuitBreakers) Get(channel cube.Channel) *CircuitBreaker {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	breaker := b.breakers[channel]
+	if breaker == nil {
+		breaker = NewCircuitBreaker(b.threshold, b.timeout)
+		b.breakers[channel] = breaker
+	}
+
+	return breaker
+}
@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+
+	breaker := NewCircuitBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if breaker.OnFailure() {
+			t.Fatalf("breaker is opened before the threshold")
+		}
+	}
+
+	if breaker.OnSuccess() {
+		t.Errorf("success of a closed breaker closed it")
+	}
+
+	for i := 0; i < 2; i++ {
+		breaker.OnFailure()
+	}
+
+	if !breaker.Allow() {
+		t.Errorf("failures aren't reset by a success")
+	}
+
+	if !breaker.OnFailure() {
+		t.Fatalf("breaker isn't opened after threshold consecutive failures")
+	}
+
+	if breaker.Allow() || !breaker.IsOpen() {
+		t.Errorf("open breaker allows calls")
+	}
+
+	// The timeout has passed, one trial call is allowed.
+	breaker.openedAt = time.Now().Add(-2 * time.Minute)
+
+	if breaker.IsOpen() {
+		t.Errorf("breaker is open after the timeout")
+	}
+
+	if !breaker.Allow() {
+		t.Fatalf("trial call isn't allowed after the timeout")
+	}
+
+	if breaker.Allow() || !breaker.IsOpen() {
+		t.Errorf("second call is allowed during the trial")
+	}
+
+	if !breaker.OnFailure() {
+		t.Errorf("failed trial didn't open the breaker")
+	}
+
+	if breaker.Allow() {
+		t.Errorf("breaker allows calls after the failed trial")
+	}
+
+	breaker.openedAt = time.Now().Add(-2 * time.Minute)
+	breaker.Allow()
+
+	if !breaker.OnSuccess() {
+		t.Errorf("successful trial didn't close the breaker")
+	}
+
+	if !breaker.Allow() || !breaker.Allow() || breaker.IsOpen() {
+		t.Errorf("closed breaker rejects calls")
+	}
+}
+
+func TestCircuitBreakers(t *testing.T) {
+
+	breakers := NewCircuitBreakers(0, 0)
+	if breakers.threshold != DefaultBreakerThreshold || breakers.timeout != DefaultBreakerTimeout {
+		t.Errorf("defaults aren't set: %v, %v", breakers.threshold, breakers.timeout)
+	}
+
+	if breakers.Get("a") != breakers.Get("a") || breakers.Get("a") == breakers.Get("b") {
+		t.Errorf("breakers aren't kept per channel")
+	}
+}
@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+const DefaultNodeEventsChannel = cube.Channel("wsNodes")
+
+// Snapshots are split into chunks of this number of users, so messages stay far below the bus payload limit.
+const presenceSnapshotChunkSize = 1000
+
+// announceNode publishes "onNodeStarted" or "onNodeStopped" to the node events channel.
+func (s *Server) announceNode(method string) {
+	if !s.clusterEnabled {
+		return
+	}
+
+	packedParams, _ := json.Marshal(js.NodeParams{
+		InstanceId: s.cubeInstance.GetInstanceId(),
+		Channel:    string(s.nodeChannel),
+	})
+
+	s.publish(s.nodeEventsChannel, cube.Message{
+		Method: method,
+		Params: (*json.RawMessage)(&packedParams),
+	})
+}
+
+// announceUser announces users held by this node, so backends can publish to the node channels
+// of the user instead of the shared input channel.
+func (s *Server) announceUser(change UserChange) {
+
+	if !s.clusterEnabled || change.DeviceId != "" {
+		return
+	}
+
+	method := "onUserDetached"
+	if change.Online {
+		method = "onUserAttached"
+	}
+
+	packedParams, _ := json.Marshal(js.NodeUserParams{
+		InstanceId: s.cubeInstance.GetInstanceId(),
+		Channel:    string(s.nodeChannel),
+		UserId:     string(change.UserId),
+	})
+
+	err := s.publish(TenantChannel(s.nodeEventsChannel, change.TenantId), cube.Message{
+		Method: method,
+		Params: (*json.RawMessage)(&packedParams),
+	})
+
+	if err != nil {
+		fmt.Println("Can't announce user:", change.UserId, err)
+	}
+}
+
+// publishPresenceSnapshots periodically publishes all users of the node and removes nodes which stopped doing it.
+func (s *Server) publishPresenceSnapshots() {
+
+	ticker := time.NewTicker(s.presenceInterval)
+	defer ticker.Stop()
+
+	var snapshotId uint64
+
+	for range ticker.C {
+		snapshotId++
+		s.publishPresenceSnapshot(snapshotId)
+
+		expired := s.presence.RemoveExpired()
+		if expired > 0 {
+			s.metrics.Add("cluster.expiredNodes", int64(expired))
+		}
+
+		s.metrics.Set("cluster.nodes", int64(s.presence.Size()))
+	}
+}
+
+// publishPresenceSnapshot publishes users of the node in chunks of presenceSnapshotChunkSize users.
+func (s *Server) publishPresenceSnapshot(snapshotId uint64) {
+
+	users := []js.NodeUser{}
+	for _, key := range s.connections.getUsers() {
+		users = append(users, js.NodeUser{TenantId: string(key.tenantId), UserId: string(key.userId)})
+	}
+
+	chunks := (len(users) + presenceSnapshotChunkSize - 1) / presenceSnapshotChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	for chunk := 0; chunk < chunks; chunk++ {
+		end := (chunk + 1) * presenceSnapshotChunkSize
+		if end > len(users) {
+			end = len(users)
+		}
+
+		packedParams, _ := json.Marshal(js.NodeSnapshotParams{
+			InstanceId: s.cubeInstance.GetInstanceId(),
+			Channel:    string(s.nodeChannel),
+			SnapshotId: snapshotId,
+			Chunk:      chunk,
+			Chunks:     chunks,
+			Users:      users[chunk*presenceSnapshotChunkSize : end],
+		})
+
+		s.publish(s.nodeEventsChannel, cube.Message{
+			Method: "onNodeSnapshot",
+			Params: (*json.RawMessage)(&packedParams),
+		})
+	}
+}
+
+func (s *Server) isOwnNode(instanceId string) bool {
+	return !s.clusterEnabled || instanceId == s.cubeInstance.GetInstanceId()
+}
+
+// OnNodeChanged handles "onNodeStarted" and "onNodeStopped" of other nodes, users of the node are forgotten.
+func (s *Server) OnNodeChanged(params js.NodeParams) {
+	if s.isOwnNode(params.InstanceId) {
+		return
+	}
+
+	s.presence.RemoveNode(params.InstanceId)
+}
+
+func (s *Server) OnNodeUserChanged(tenantId TenantId, params js.NodeUserParams, online bool) {
+	if s.isOwnNode(params.InstanceId) {
+		return
+	}
+
+	s.presence.SetUser(params.InstanceId, params.Channel, tenantId, UserId(params.UserId), online)
+}
+
+func (s *Server) OnNodeSnapshot(params js.NodeSnapshotParams) {
+	if s.isOwnNode(params.InstanceId) {
+		return
+	}
+
+	users := make([]presenceKey, 0, len(params.Users))
+	for _, user := range params.Users {
+		users = append(users, presenceKey{tenantId: TenantId(user.TenantId), userId: UserId(user.UserId)})
+	}
+
+	s.presence.SetSnapshotChunk(params.InstanceId, params.Channel, params.SnapshotId, params.Chunk, params.Chunks, users)
+}
+
+// GetPresence returns nodes of the users in the whole cluster, this node included. Users of any tenant
+// are returned if tenant is empty.
+func (s *Server) GetPresence(tenantId TenantId, userIds []UserId) []js.UserPresence {
+
+	result := []js.UserPresence{}
+
+	for _, userId := range userIds {
+		presence := js.UserPresence{UserId: string(userId), Nodes: []js.NodeParams{}}
+
+		if s.connections.HasUser(tenantId, userId) {
+			presence.Nodes = append(presence.Nodes, js.NodeParams{
+				InstanceId: s.cubeInstance.GetInstanceId(),
+				Channel:    string(s.nodeChannel),
+			})
+		}
+
+		for _, node := range s.presence.GetUserNodes(tenantId, userId) {
+			presence.Nodes = append(presence.Nodes, js.NodeParams{InstanceId: node.InstanceId, Channel: node.Channel})
+		}
+
+		presence.Online = len(presence.Nodes) > 0
+		result = append(result, presence)
+	}
+
+	return result
+}
@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+// newClusterNode starts a gateway node on the memory bus, node events are replicated the same way
+// the handler does it for the node events channel and for the node events channels of the tenants.
+func newClusterNode(t *testing.T, bus *memoryBus, instanceId string, tenants ...TenantId) *Server {
+
+	server, err := NewServer(newBusCube(bus, instanceId), ServerConfig{NodeChannel: cube.Channel("wsNode." + instanceId)})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	go server.announceQueue.Run()
+
+	for _, tenantId := range append([]TenantId{""}, tenants...) {
+		subscribeNodeEvents(bus, server, tenantId)
+	}
+
+	return server
+}
+
+func subscribeNodeEvents(bus *memoryBus, server *Server, tenantId TenantId) {
+
+	bus.Subscribe(TenantChannel(DefaultNodeEventsChannel, tenantId), func(message cube.Message) {
+		switch message.Method {
+		case "onNodeStarted", "onNodeStopped":
+			var params js.NodeParams
+			json.Unmarshal(*message.Params, &params)
+			server.OnNodeChanged(params)
+		case "onUserAttached", "onUserDetached":
+			var params js.NodeUserParams
+			json.Unmarshal(*message.Params, &params)
+			server.OnNodeUserChanged(tenantId, params, message.Method == "onUserAttached")
+		case "onNodeSnapshot":
+			var params js.NodeSnapshotParams
+			json.Unmarshal(*message.Params, &params)
+			server.OnNodeSnapshot(params)
+		}
+	})
+}
+
+func presenceNodes(server *Server, userId UserId) []string {
+
+	channels := []string{}
+	for _, node := range server.GetPresence("", []UserId{userId})[0].Nodes {
+		channels = append(channels, node.Channel)
+	}
+
+	return channels
+}
+
+func TestClusterUserAnnouncements(t *testing.T) {
+
+	bus := newMemoryBus()
+	nodeA := newClusterNode(t, bus, "A")
+	nodeB := newClusterNode(t, bus, "B")
+
+	connection := newLoggedConnection(1, "user", "phone")
+	nodeA.connections.AddNewConnection(connection)
+
+	waitFor(t, "user attached to node A", func() bool {
+		return reflect.DeepEqual(presenceNodes(nodeB, "user"), []string{"wsNode.A"})
+	})
+
+	// The second connection of the user isn't announced.
+	nodeA.connections.AddNewConnection(newLoggedConnection(2, "user", "tablet"))
+
+	other := newLoggedConnection(3, "user", "laptop")
+	nodeB.connections.AddNewConnection(other)
+
+	waitFor(t, "user attached to both nodes", func() bool {
+		return reflect.DeepEqual(presenceNodes(nodeA, "user"), []string{"wsNode.A", "wsNode.B"}) &&
+			reflect.DeepEqual(presenceNodes(nodeB, "user"), []string{"wsNode.B", "wsNode.A"})
+	})
+
+	nodeA.connections.RemoveConnection(connection)
+	if !reflect.DeepEqual(presenceNodes(nodeB, "user"), []string{"wsNode.B", "wsNode.A"}) {
+		t.Errorf("user is detached while node A has its connection")
+	}
+
+	nodeA.connections.RemoveConnection(nodeA.connections.GetConnectionById(2))
+
+	waitFor(t, "user detached from node A", func() bool {
+		return reflect.DeepEqual(presenceNodes(nodeB, "user"), []string{"wsNode.B"})
+	})
+
+	attached := 0
+	for _, message := range bus.Messages(DefaultNodeEventsChannel) {
+		var params js.NodeUserParams
+		json.Unmarshal(*message.Params, &params)
+
+		if message.Method == "onUserAttached" && params.InstanceId == "A" {
+			attached++
+		}
+	}
+
+	if attached != 1 {
+		t.Errorf("user is attached to node A %v times, want 1", attached)
+	}
+}
+
+func TestClusterNodeStopped(t *testing.T) {
+
+	bus := newMemoryBus()
+	nodeA := newClusterNode(t, bus, "A")
+	nodeB := newClusterNode(t, bus, "B")
+
+	nodeA.connections.AddNewConnection(newLoggedConnection(1, "user", "phone"))
+
+	waitFor(t, "user attached to node A", func() bool {
+		return len(presenceNodes(nodeB, "user")) == 1
+	})
+
+	nodeA.announceNode("onNodeStopped")
+
+	if nodes := presenceNodes(nodeB, "user"); len(nodes) != 0 {
+		t.Errorf("users of the stopped node are kept: %v", nodes)
+	}
+
+	if nodes := presenceNodes(nodeA, "user"); !reflect.DeepEqual(nodes, []string{"wsNode.A"}) {
+		t.Errorf("node forgot its own users: %v", nodes)
+	}
+}
+
+func TestClusterDisabled(t *testing.T) {
+
+	bus := newMemoryBus()
+	server, err := NewServer(newBusCube(bus, "A"), ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	server.announceNode("onNodeStarted")
+	server.announceUser(UserChange{UserId: "user", Online: true})
+
+	if messages := bus.Messages(DefaultNodeEventsChannel); len(messages) != 0 {
+		t.Errorf("node without node channel announced %v", messages)
+	}
+}
+
+func TestClusterPresenceOfAnyTenant(t *testing.T) {
+
+	bus := newMemoryBus()
+	nodeA := newClusterNode(t, bus, "A", "acme")
+	nodeB := newClusterNode(t, bus, "B", "acme")
+
+	connection := newLoggedConnection(1, "user", "phone")
+	connection.tenantId = "acme"
+	nodeA.connections.AddNewConnection(connection)
+
+	waitFor(t, "user attached to node A", func() bool {
+		return nodeA.announceQueue.Len() == 0 && len(nodeB.GetPresence("acme", []UserId{"user"})[0].Nodes) == 1
+	})
+
+	for _, node := range []*Server{nodeA, nodeB} {
+		if nodes := presenceNodes(node, "user"); !reflect.DeepEqual(nodes, []string{"wsNode.A"}) {
+			t.Errorf("user of a tenant isn't found on the shared channel: %v", nodes)
+		}
+
+		if presence := node.GetPresence("other", []UserId{"user"})[0]; presence.Online {
+			t.Errorf("user is found in another tenant: %+v", presence)
+		}
+	}
+
+	nodeA.connections.RemoveConnection(connection)
+
+	waitFor(t, "user detached from node A", func() bool {
+		return len(presenceNodes(nodeB, "user")) == 0
+	})
+
+	if nodes := presenceNodes(nodeA, "user"); len(nodes) != 0 {
+		t.Errorf("disconnected user is found: %v", nodes)
+	}
+}
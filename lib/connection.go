@@ -1,32 +1,59 @@
 package lib
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// writeTimeout limits writes to slow clients, so they don't block senders.
+const writeTimeout = 10 * time.Second
+
 type ConnectionId int64
 type UserId string
 type DeviceId string
+type TenantId string
 
 // Connection wraps user connection.
 type Connection struct {
 	ws            *websocket.Conn
 	id            ConnectionId
+	uid           string
 	userId        UserId
 	deviceId      DeviceId
+	tenantId      TenantId
+	claims        Claims
 	startTime     time.Time
 	lastMessageAt time.Time
+	inFlight      int32
+	rateLimiters  map[Endpoint]*RateLimiter
+	eventSeq      uint64
+	requestSeq    uint64
 	dataMutex     sync.RWMutex
 	writeMutex    sync.Mutex
+	eventMutex    sync.Mutex
+	// retainedVersions keeps versions of retained messages sent to the connection.
+	retainedVersions map[string]uint64
+	retainedMutex    sync.Mutex
+	presenceOutbox   presenceOutbox
+	sessionOutbox    sessionOutbox
+}
+
+func newRandomId() string {
+	data := make([]byte, 16)
+	rand.Read(data)
+	return hex.EncodeToString(data)
 }
 
 func NewConnection(id ConnectionId, ws *websocket.Conn) *Connection {
 	c := &Connection{
 		ws:         ws,
 		id:         id,
+		uid:        newRandomId(),
 		userId:     "",
 		deviceId:   "",
 		startTime:  time.Now(),
@@ -40,32 +67,36 @@ func (c *Connection) ReadMessage() (messageType int, p []byte, err error) {
 	return c.ws.ReadMessage()
 }
 
-func (c *Connection) SendText(message []byte) {
+func (c *Connection) SendText(message []byte) error {
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
 
-	c.ws.WriteMessage(websocket.TextMessage, message)
+	c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.ws.WriteMessage(websocket.TextMessage, message)
 }
 
-func (c *Connection) SendBinary(message []byte) {
+func (c *Connection) SendBinary(message []byte) error {
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
 
-	c.ws.WriteMessage(websocket.BinaryMessage, message)
+	c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.ws.WriteMessage(websocket.BinaryMessage, message)
 }
 
 func (c *Connection) Close(code int, reason string) {
-	c.dataMutex.Lock()
-	c.dataMutex.Unlock()
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
 
-	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
 	c.ws.Close()
 
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
 	c.id = -1
 	c.userId = ""
 	c.deviceId = ""
+	c.claims = nil
 }
 
 func (c *Connection) IsLoggedIn() bool {
@@ -79,7 +110,7 @@ func (c *Connection) IsClosed() bool {
 	c.dataMutex.RLock()
 	defer c.dataMutex.RUnlock()
 
-	return c.IsClosed()
+	return c.id == -1
 }
 
 func (c *Connection) GetInfo() (ConnectionId, UserId, DeviceId) {
@@ -89,6 +120,37 @@ func (c *Connection) GetInfo() (ConnectionId, UserId, DeviceId) {
 	return c.id, c.userId, c.deviceId
 }
 
+// GetUid returns id of the connection which is unique across gateway instances and restarts.
+func (c *Connection) GetUid() string {
+	return c.uid
+}
+
+// nextEventSeq returns the next number of events of the connection, the first event is 1.
+func (c *Connection) nextEventSeq() uint64 {
+	return atomic.AddUint64(&c.eventSeq, 1)
+}
+
+// nextRequestSeq returns the next number of requests of the connection, requests are numbered apart from events
+// because they are sent concurrently.
+func (c *Connection) nextRequestSeq() uint64 {
+	return atomic.AddUint64(&c.requestSeq, 1)
+}
+
+func (c *Connection) GetTenant() TenantId {
+	c.dataMutex.RLock()
+	defer c.dataMutex.RUnlock()
+
+	return c.tenantId
+}
+
+// GetClaims returns claims of the token the connection was authenticated with, they must not be modified.
+func (c *Connection) GetClaims() Claims {
+	c.dataMutex.RLock()
+	defer c.dataMutex.RUnlock()
+
+	return c.claims
+}
+
 func (c *Connection) GetStartTime() time.Time {
 	c.dataMutex.RLock()
 	defer c.dataMutex.RUnlock()
@@ -96,12 +158,14 @@ func (c *Connection) GetStartTime() time.Time {
 	return c.startTime
 }
 
-func (c *Connection) Login(userId UserId, deviceId DeviceId) {
+func (c *Connection) Login(userId UserId, deviceId DeviceId, tenantId TenantId, claims Claims) {
 	c.dataMutex.Lock()
 	defer c.dataMutex.Unlock()
 
 	c.userId = userId
 	c.deviceId = deviceId
+	c.tenantId = tenantId
+	c.claims = claims
 	c.ws.SetReadLimit(0)
 }
 
@@ -111,3 +175,34 @@ func (c *Connection) UpdateLastPingTime() {
 
 	c.lastMessageAt = time.Now()
 }
+
+// AcquireRequestSlot reserves a slot for a proxied request, it fails if max requests are already in flight.
+func (c *Connection) AcquireRequestSlot(max int32) bool {
+	if atomic.AddInt32(&c.inFlight, 1) > max {
+		atomic.AddInt32(&c.inFlight, -1)
+		return false
+	}
+
+	return true
+}
+
+func (c *Connection) ReleaseRequestSlot() {
+	atomic.AddInt32(&c.inFlight, -1)
+}
+
+// AllowEndpointMessage applies rate limit of the endpoint, limiter is recreated when the limits are changed.
+func (c *Connection) AllowEndpointMessage(endpoint Endpoint, rate float64, burst int) bool {
+	c.dataMutex.Lock()
+	if c.rateLimiters == nil {
+		c.rateLimiters = map[Endpoint]*RateLimiter{}
+	}
+
+	limiter := c.rateLimiters[endpoint]
+	if limiter == nil || !limiter.hasLimits(rate, burst) {
+		limiter = NewRateLimiter(rate, burst)
+		c.rateLimiters[endpoint] = limiter
+	}
+	c.dataMutex.Unlock()
+
+	return limiter.Allow()
+}
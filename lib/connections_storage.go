@@ -12,59 +12,271 @@ type ConnectionsStats struct {
 	NumberOfNotLoggedConnections int
 }
 
+// presenceKey is a user or, if deviceId is set, a device of the user.
+type presenceKey struct {
+	tenantId TenantId
+	userId   UserId
+	deviceId DeviceId
+}
+
+// UserChange is reported when the first connection of a user is added or the last one is removed.
+// Changes of devices have DeviceId set. NumberOfUsers and NumberOfDevices are counted when the change
+// was made, so listeners don't need to ask the storage for them.
+type UserChange struct {
+	TenantId        TenantId
+	UserId          UserId
+	DeviceId        DeviceId
+	Online          bool
+	NumberOfUsers   int
+	NumberOfDevices int
+}
+
+// ConnectionsStorage keeps connections by id, connections of tenants are indexed by tenant too.
+// Connections are logged in before they are added, so the index doesn't change while they are stored.
 type ConnectionsStorage struct {
 	mutex                        sync.RWMutex
 	connectionsById              map[ConnectionId]*Connection
+	connectionsByUid             map[string]*Connection
+	connectionsByTenant          map[TenantId]map[ConnectionId]*Connection
+	reservedByTenant             map[TenantId]int
+	userConnections              map[presenceKey]int
+	deviceConnections            map[presenceKey]int
+	userTenants                  map[UserId]int
 	numberOfNotLoggedConnections int
+	changes                      []UserChange
+	removed                      []ConnectionId
+	listenerMutex                sync.Mutex
+	listener                     func(change UserChange)
+	removeListener               func(connectionId ConnectionId)
 }
 
 func NewConnectionsStorage() *ConnectionsStorage {
 	return &ConnectionsStorage{
 		mutex:                        sync.RWMutex{},
 		connectionsById:              make(map[ConnectionId]*Connection),
+		connectionsByUid:             make(map[string]*Connection),
+		connectionsByTenant:          make(map[TenantId]map[ConnectionId]*Connection),
+		reservedByTenant:             make(map[TenantId]int),
+		userConnections:              make(map[presenceKey]int),
+		deviceConnections:            make(map[presenceKey]int),
+		userTenants:                  make(map[UserId]int),
 		numberOfNotLoggedConnections: 0,
 	}
 }
 
-func (s *ConnectionsStorage) AddNewConnection(connection *Connection) {
+// SetUserListener sets the listener of user changes. Changes are reported in order after the storage is unlocked,
+// but while concurrent changes wait for them, so the listener must not call the storage.
+func (s *ConnectionsStorage) SetUserListener(listener func(change UserChange)) {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+
+	s.listener = listener
+}
+
+// SetRemoveListener sets the listener of removed connections, it is called the same way as the user listener.
+func (s *ConnectionsStorage) SetRemoveListener(listener func(connectionId ConnectionId)) {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+
+	s.removeListener = listener
+}
+
+// unlock releases the storage and reports changes collected under the lock. The listener mutex is taken
+// before the storage is released, so changes of concurrent calls are reported in the order they were made.
+func (s *ConnectionsStorage) unlock() {
+	changes := s.changes
+	s.changes = nil
+
+	for i := range changes {
+		changes[i].NumberOfUsers = len(s.userConnections)
+		changes[i].NumberOfDevices = len(s.deviceConnections)
+	}
+
+	removed := s.removed
+	s.removed = nil
+
+	s.listenerMutex.Lock()
+	s.mutex.Unlock()
+	defer s.listenerMutex.Unlock()
+
+	if s.removeListener != nil {
+		for _, connectionId := range removed {
+			s.removeListener(connectionId)
+		}
+	}
+
+	if s.listener != nil {
+		for _, change := range changes {
+			s.listener(change)
+		}
+	}
+}
+
+// ReserveTenantConnection reserves a connection of the tenant if the tenant has less than max connections
+// and reservations, max <= 0 means no limit. The reservation is taken by AddNewConnection of a connection
+// of the tenant or returned by ReleaseTenantConnection.
+func (s *ConnectionsStorage) ReserveTenantConnection(tenantId TenantId, max int) bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.numberOfNotLoggedConnections++
-	s.connectionsById[connection.id] = connection
+	if max > 0 && len(s.connectionsByTenant[tenantId])+s.reservedByTenant[tenantId] >= max {
+		return false
+	}
+
+	s.reservedByTenant[tenantId]++
+	return true
 }
 
-func (s *ConnectionsStorage) RemoveConnection(connection *Connection) {
+func (s *ConnectionsStorage) ReleaseTenantConnection(tenantId TenantId) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.removeConnection(connection)
+	s.releaseTenantConnection(tenantId)
 }
 
-func (s *ConnectionsStorage) removeConnection(connection *Connection) {
+func (s *ConnectionsStorage) releaseTenantConnection(tenantId TenantId) {
 
-	connectionId, userId, _ := connection.GetInfo()
+	if s.reservedByTenant[tenantId] <= 1 {
+		delete(s.reservedByTenant, tenantId)
+		return
+	}
+
+	s.reservedByTenant[tenantId]--
+}
+
+// AddNewConnection stores the connection, a connection of a tenant takes a reservation of the tenant if there is one.
+func (s *ConnectionsStorage) AddNewConnection(connection *Connection) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if connection.userId == "" {
+		s.numberOfNotLoggedConnections++
+	} else {
+		s.countUserConnection(connection.tenantId, connection.userId, 1)
+
+		deviceKey := presenceKey{tenantId: connection.tenantId, userId: connection.userId, deviceId: connection.deviceId}
+		s.countConnection(s.deviceConnections, deviceKey, 1)
+	}
+
+	s.connectionsById[connection.id] = connection
+	s.connectionsByUid[connection.uid] = connection
+
+	if connection.tenantId != "" {
+		s.releaseTenantConnection(connection.tenantId)
+
+		tenantConnections := s.connectionsByTenant[connection.tenantId]
+		if tenantConnections == nil {
+			tenantConnections = make(map[ConnectionId]*Connection)
+			s.connectionsByTenant[connection.tenantId] = tenantConnections
+		}
+
+		tenantConnections[connection.id] = connection
+	}
+}
+
+// RemoveConnection returns false if the connection has been already removed.
+func (s *ConnectionsStorage) RemoveConnection(connection *Connection) bool {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.removeConnection(connection)
+}
+
+func (s *ConnectionsStorage) removeConnection(connection *Connection) bool {
+
+	connectionId, _, _ := connection.GetInfo()
 
 	connectionBefore := s.connectionsById[connectionId]
 	if connectionBefore == nil {
-		return
+		return false
 	}
 
+	s.deleteConnection(connectionId, connectionBefore)
+	return true
+}
+
+func (s *ConnectionsStorage) deleteConnection(connectionId ConnectionId, connection *Connection) {
+
 	delete(s.connectionsById, connectionId)
+	delete(s.connectionsByUid, connection.uid)
+	s.removed = append(s.removed, connectionId)
+
+	if connection.tenantId != "" {
+		tenantConnections := s.connectionsByTenant[connection.tenantId]
+		delete(tenantConnections, connectionId)
+
+		if len(tenantConnections) == 0 {
+			delete(s.connectionsByTenant, connection.tenantId)
+		}
+	}
 
-	if userId == "" {
+	if connection.userId == "" {
 		s.numberOfNotLoggedConnections--
 		return
 	}
+
+	deviceKey := presenceKey{tenantId: connection.tenantId, userId: connection.userId, deviceId: connection.deviceId}
+	s.countConnection(s.deviceConnections, deviceKey, -1)
+
+	s.countUserConnection(connection.tenantId, connection.userId, -1)
+}
+
+// countUserConnection counts the connection of the user and the number of tenants the user is connected in.
+func (s *ConnectionsStorage) countUserConnection(tenantId TenantId, userId UserId, delta int) {
+
+	key := presenceKey{tenantId: tenantId, userId: userId}
+	before := s.userConnections[key]
+
+	s.countConnection(s.userConnections, key, delta)
+
+	switch after := s.userConnections[key]; {
+	case before == 0 && after > 0:
+		s.userTenants[userId]++
+	case before > 0 && after == 0:
+		s.userTenants[userId]--
+		if s.userTenants[userId] <= 0 {
+			delete(s.userTenants, userId)
+		}
+	}
 }
 
-func (s *ConnectionsStorage) GetUserConnections(userId UserId) []*Connection {
+// countConnection updates the number of connections of the user or the device and collects the change
+// if it is the first or the last connection.
+func (s *ConnectionsStorage) countConnection(counters map[presenceKey]int, key presenceKey, delta int) {
+
+	counters[key] += delta
+	count := counters[key]
+
+	if count <= 0 {
+		delete(counters, key)
+	}
+
+	if (delta > 0 && count == 1) || (delta < 0 && count <= 0) {
+		s.changes = append(s.changes, UserChange{
+			TenantId: key.tenantId,
+			UserId:   key.userId,
+			DeviceId: key.deviceId,
+			Online:   delta > 0,
+		})
+	}
+}
+
+// scope returns connections of the tenant or all connections if tenant is empty.
+func (s *ConnectionsStorage) scope(tenantId TenantId) map[ConnectionId]*Connection {
+	if tenantId == "" {
+		return s.connectionsById
+	}
+
+	return s.connectionsByTenant[tenantId]
+}
+
+func (s *ConnectionsStorage) GetUserConnections(tenantId TenantId, userId UserId) []*Connection {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	connections := []*Connection{}
 
-	for _, connection := range s.connectionsById {
+	for _, connection := range s.scope(tenantId) {
 		if connection.userId == userId {
 			connections = append(connections, connection)
 		}
@@ -73,13 +285,13 @@ func (s *ConnectionsStorage) GetUserConnections(userId UserId) []*Connection {
 	return connections
 }
 
-func (s *ConnectionsStorage) GetDeviceConnections(userId UserId, deviceId DeviceId) []*Connection {
+func (s *ConnectionsStorage) GetDeviceConnections(tenantId TenantId, userId UserId, deviceId DeviceId) []*Connection {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	connections := []*Connection{}
 
-	for _, connection := range s.connectionsById {
+	for _, connection := range s.scope(tenantId) {
 		if connection.deviceId == deviceId && connection.userId == userId {
 			connections = append(connections, connection)
 		}
@@ -95,13 +307,20 @@ func (s *ConnectionsStorage) GetConnectionById(connectionId ConnectionId) *Conne
 	return s.connectionsById[connectionId]
 }
 
+func (s *ConnectionsStorage) GetConnectionByUid(uid string) *Connection {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.connectionsByUid[uid]
+}
+
 func (s *ConnectionsStorage) GetStats() ConnectionsStats {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	stats := ConnectionsStats{
-		// NumberOfDevices:              len(s.connectionsByDeviceId),
-		// NumberOfUsers:                len(s.connectionsByUserId),
+		NumberOfDevices:              len(s.deviceConnections),
+		NumberOfUsers:                len(s.userConnections),
 		NumberOfNotLoggedConnections: s.numberOfNotLoggedConnections,
 	}
 
@@ -110,13 +329,13 @@ func (s *ConnectionsStorage) GetStats() ConnectionsStats {
 
 func (s *ConnectionsStorage) RemoveIf(condition func(con *Connection) bool, afterRemove func(connections []*Connection)) {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	defer s.unlock()
 
 	connections := []*Connection{}
 
 	for id, connection := range s.connectionsById {
 		if condition(connection) {
-			delete(s.connectionsById, id)
+			s.deleteConnection(id, connection)
 			connections = append(connections, connection)
 		}
 	}
@@ -124,14 +343,49 @@ func (s *ConnectionsStorage) RemoveIf(condition func(con *Connection) bool, afte
 	afterRemove(connections)
 }
 
-func (s *ConnectionsStorage) RemoveDeviceConnections(userId UserId, deviceId DeviceId, afterRemove func(connections []*Connection)) {
+func (s *ConnectionsStorage) RemoveDeviceConnections(tenantId TenantId, userId UserId, deviceId DeviceId, afterRemove func(connections []*Connection)) {
 	s.RemoveIf(func(con *Connection) bool {
-		return con.deviceId == deviceId && con.userId == userId
+		return (tenantId == "" || con.tenantId == tenantId) && con.deviceId == deviceId && con.userId == userId
 	}, afterRemove)
 }
 
-func (s *ConnectionsStorage) RemoveUserConnections(userId UserId, afterRemove func(connections []*Connection)) {
+func (s *ConnectionsStorage) RemoveUserConnectionsExcept(tenantId TenantId, userId UserId, exceptDevices []DeviceId, afterRemove func(connections []*Connection)) {
 	s.RemoveIf(func(con *Connection) bool {
-		return con.userId == userId
+		if (tenantId != "" && con.tenantId != tenantId) || con.userId != userId {
+			return false
+		}
+
+		for _, deviceId := range exceptDevices {
+			if con.deviceId == deviceId {
+				return false
+			}
+		}
+
+		return true
 	}, afterRemove)
 }
+
+// getUsers returns logged in users of all tenants.
+func (s *ConnectionsStorage) getUsers() []presenceKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	users := make([]presenceKey, 0, len(s.userConnections))
+	for key := range s.userConnections {
+		users = append(users, key)
+	}
+
+	return users
+}
+
+// HasUser checks connections of the user in the tenant or in any tenant if tenant is empty.
+func (s *ConnectionsStorage) HasUser(tenantId TenantId, userId UserId) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if tenantId == "" {
+		return s.userTenants[userId] > 0
+	}
+
+	return s.userConnections[presenceKey{tenantId: tenantId, userId: userId}] > 0
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnectionsStorageConcurrentChanges(t *testing.T) {
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		wait := sync.WaitGroup{}
+		for worker := 0; worker < 8; worker++ {
+			wait.Add(1)
+			go func(worker int) {
+				defer wait.Done()
+
+				for i := 0; i < 500; i++ {
+					id := ConnectionId(worker*1000 + i + 1)
+					connection := newLoggedConnection(id, UserId(fmt.Sprintf("user%v", i%10)), DeviceId(fmt.Sprintf("device%v", worker)))
+					server.connections.AddNewConnection(connection)
+					server.connections.RemoveConnection(connection)
+				}
+			}(worker)
+		}
+
+		wait.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("concurrent adds and removes are deadlocked")
+	}
+
+	if users, devices := server.metrics.Get("cluster.users"), server.metrics.Get("presence.devices"); users != 0 || devices != 0 {
+		t.Errorf("users = %v, devices = %v after all connections are removed", users, devices)
+	}
+}
+
+func TestConnectionsStorageUserChanges(t *testing.T) {
+
+	storage := NewConnectionsStorage()
+
+	changes := []UserChange{}
+	storage.SetUserListener(func(change UserChange) {
+		changes = append(changes, change)
+	})
+
+	phone := newLoggedConnection(1, "user", "phone")
+	storage.AddNewConnection(phone)
+	storage.AddNewConnection(newLoggedConnection(2, "user", "tablet"))
+	storage.RemoveConnection(phone)
+
+	expected := []UserChange{
+		{UserId: "user", Online: true, NumberOfUsers: 1, NumberOfDevices: 1},
+		{UserId: "user", DeviceId: "phone", Online: true, NumberOfUsers: 1, NumberOfDevices: 1},
+		{UserId: "user", DeviceId: "tablet", Online: true, NumberOfUsers: 1, NumberOfDevices: 2},
+		{UserId: "user", DeviceId: "phone", Online: false, NumberOfUsers: 1, NumberOfDevices: 1},
+	}
+
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Errorf("changes = %v, want %v", changes, expected)
+	}
+}
+
+func TestConnectionsStorageTenantReservations(t *testing.T) {
+
+	storage := NewConnectionsStorage()
+
+	reserved := make(chan bool, 20)
+	wait := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			reserved <- storage.ReserveTenantConnection("acme", 5)
+		}()
+	}
+
+	wait.Wait()
+	close(reserved)
+
+	count := 0
+	for ok := range reserved {
+		if ok {
+			count++
+		}
+	}
+
+	if count != 5 {
+		t.Fatalf("%v connections are reserved, want 5", count)
+	}
+
+	connection := newLoggedConnection(1, "user", "phone")
+	connection.tenantId = "acme"
+	storage.AddNewConnection(connection)
+
+	if storage.ReserveTenantConnection("acme", 5) {
+		t.Errorf("stored connection doesn't keep its slot")
+	}
+
+	storage.ReleaseTenantConnection("acme")
+	if !storage.ReserveTenantConnection("acme", 5) {
+		t.Errorf("released slot isn't free")
+	}
+
+	storage.RemoveConnection(connection)
+	if !storage.ReserveTenantConnection("acme", 5) || !storage.ReserveTenantConnection("other", 0) {
+		t.Errorf("slot of the removed connection isn't free")
+	}
+}
@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/akaumov/cube"
+)
+
+const (
+	EQUALS_OPERATOR = "equals"
+	IN_OPERATOR     = "in"
+	PREFIX_OPERATOR = "prefix"
+	EXISTS_OPERATOR = "exists"
+)
+
+// ContentRule routes payloads with a matching value to Channel. Path is dot separated,
+// optionally starting with "$.", array items are addressed by index: "$.items.0.type".
+// Value of "exists" operator is optional, false matches payloads without the path.
+type ContentRule struct {
+	Path     string       `json:"path"`
+	Operator string       `json:"op"`
+	Value    interface{}  `json:"value"`
+	Channel  cube.Channel `json:"channel"`
+
+	segments []string
+}
+
+func (r *ContentRule) compile() error {
+
+	if r.Channel == "" {
+		return fmt.Errorf("rule %v: channel is required", r.Path)
+	}
+
+	path := strings.TrimPrefix(strings.TrimPrefix(r.Path, "$"), ".")
+	if path == "" {
+		return fmt.Errorf("rule: path is required")
+	}
+
+	r.segments = strings.Split(path, ".")
+	for _, segment := range r.segments {
+		if segment == "" {
+			return fmt.Errorf("rule %v: empty path segment", r.Path)
+		}
+	}
+
+	switch r.Operator {
+	case EQUALS_OPERATOR:
+	case IN_OPERATOR:
+		if _, ok := r.Value.([]interface{}); !ok {
+			return fmt.Errorf("rule %v: value of in must be an array", r.Path)
+		}
+	case PREFIX_OPERATOR:
+		if _, ok := r.Value.(string); !ok {
+			return fmt.Errorf("rule %v: value of prefix must be a string", r.Path)
+		}
+	case EXISTS_OPERATOR:
+		if _, ok := r.Value.(bool); !ok && r.Value != nil {
+			return fmt.Errorf("rule %v: value of exists must be a boolean", r.Path)
+		}
+	default:
+		return fmt.Errorf("rule %v: unknown operator %v", r.Path, r.Operator)
+	}
+
+	return nil
+}
+
+func (r *ContentRule) Matches(document interface{}) bool {
+
+	value, found := lookupPath(document, r.segments)
+
+	switch r.Operator {
+	case EQUALS_OPERATOR:
+		return found && jsonEquals(value, r.Value)
+
+	case IN_OPERATOR:
+		if !found {
+			return false
+		}
+
+		for _, item := range r.Value.([]interface{}) {
+			if jsonEquals(value, item) {
+				return true
+			}
+		}
+
+	case PREFIX_OPERATOR:
+		text, ok := value.(string)
+		return found && ok && strings.HasPrefix(text, r.Value.(string))
+
+	case EXISTS_OPERATOR:
+		shouldExist, ok := r.Value.(bool)
+		if !ok {
+			shouldExist = true
+		}
+
+		return found == shouldExist
+	}
+
+	return false
+}
+
+// SelectChannel returns the channel of the first matching rule or the default channel.
+func SelectChannel(rules []ContentRule, document interface{}, defaultChannel cube.Channel) cube.Channel {
+
+	for i := range rules {
+		if rules[i].Matches(document) {
+			return rules[i].Channel
+		}
+	}
+
+	return defaultChannel
+}
+
+func lookupPath(document interface{}, segments []string) (interface{}, bool) {
+
+	value := document
+
+	for _, segment := range segments {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			child, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+
+			value = child
+
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+
+			value = node[index]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// jsonEquals compares decoded json values, numbers are float64 on both sides.
+func jsonEquals(a interface{}, b interface{}) bool {
+
+	switch aValue := a.(type) {
+	case string, float64, bool, nil:
+		return a == b
+	default:
+		aData, _ := json.Marshal(aValue)
+		bData, _ := json.Marshal(b)
+		return string(aData) == string(bData)
+	}
+}
+
+// payloadDocument decodes the payload once for all checks which need it.
+type payloadDocument struct {
+	data    []byte
+	decoded bool
+	value   interface{}
+	err     error
+}
+
+func newPayloadDocument(data []byte) *payloadDocument {
+	return &payloadDocument{
+		data: data,
+	}
+}
+
+func (d *payloadDocument) get() (interface{}, error) {
+
+	if !d.decoded {
+		d.decoded = true
+		d.err = json.Unmarshal(d.data, &d.value)
+	}
+
+	return d.value, d.err
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/akaumov/cube"
+)
+
+func decodeDocument(t testing.TB, data string) interface{} {
+
+	var document interface{}
+	err := json.Unmarshal([]byte(data), &document)
+	if err != nil {
+		t.Fatalf("wrong document %v: %v", data, err)
+	}
+
+	return document
+}
+
+func TestContentRuleMatches(t *testing.T) {
+
+	document := `{"type": "order", "amount": 10, "vip": true, "region": "eu-west", "items": [{"sku": "a1"}], "meta": null}`
+
+	tests := []struct {
+		name     string
+		path     string
+		operator string
+		value    interface{}
+		matches  bool
+	}{
+		{"equals string", "type", EQUALS_OPERATOR, "order", true},
+		{"equals string with root", "$.type", EQUALS_OPERATOR, "order", true},
+		{"equals other string", "type", EQUALS_OPERATOR, "refund", false},
+		{"equals number", "amount", EQUALS_OPERATOR, float64(10), true},
+		{"equals bool", "vip", EQUALS_OPERATOR, true, true},
+		{"equals null", "meta", EQUALS_OPERATOR, nil, true},
+		{"equals missing path", "missing", EQUALS_OPERATOR, nil, false},
+		{"equals array item", "$.items.0.sku", EQUALS_OPERATOR, "a1", true},
+		{"equals object", "items.0", EQUALS_OPERATOR, map[string]interface{}{"sku": "a1"}, true},
+		{"equals wrong index", "items.1.sku", EQUALS_OPERATOR, "a1", false},
+		{"in", "type", IN_OPERATOR, []interface{}{"refund", "order"}, true},
+		{"in numbers", "amount", IN_OPERATOR, []interface{}{float64(5), float64(10)}, true},
+		{"not in", "type", IN_OPERATOR, []interface{}{"refund"}, false},
+		{"in missing path", "missing", IN_OPERATOR, []interface{}{nil}, false},
+		{"prefix", "region", PREFIX_OPERATOR, "eu-", true},
+		{"other prefix", "region", PREFIX_OPERATOR, "us-", false},
+		{"prefix of number", "amount", PREFIX_OPERATOR, "1", false},
+		{"exists", "vip", EXISTS_OPERATOR, nil, true},
+		{"exists true", "meta", EXISTS_OPERATOR, true, true},
+		{"exists missing path", "missing", EXISTS_OPERATOR, true, false},
+		{"exists false", "missing", EXISTS_OPERATOR, false, true},
+		{"exists false present path", "vip", EXISTS_OPERATOR, false, false},
+		{"path through scalar", "type.name", EXISTS_OPERATOR, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			rule := ContentRule{Path: test.path, Operator: test.operator, Value: test.value, Channel: "channel"}
+			err := rule.compile()
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+
+			matches := rule.Matches(decodeDocument(t, document))
+			if matches != test.matches {
+				t.Errorf("Matches() = %v, want %v", matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestContentRuleCompile(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		rule  ContentRule
+		valid bool
+	}{
+		{"valid", ContentRule{Path: "type", Operator: EQUALS_OPERATOR, Value: "a", Channel: "c"}, true},
+		{"no channel", ContentRule{Path: "type", Operator: EQUALS_OPERATOR, Value: "a"}, false},
+		{"no path", ContentRule{Path: "$.", Operator: EQUALS_OPERATOR, Channel: "c"}, false},
+		{"empty segment", ContentRule{Path: "a..b", Operator: EQUALS_OPERATOR, Channel: "c"}, false},
+		{"in without array", ContentRule{Path: "type", Operator: IN_OPERATOR, Value: "a", Channel: "c"}, false},
+		{"prefix without string", ContentRule{Path: "type", Operator: PREFIX_OPERATOR, Value: 1.0, Channel: "c"}, false},
+		{"exists with string", ContentRule{Path: "type", Operator: EXISTS_OPERATOR, Value: "yes", Channel: "c"}, false},
+		{"unknown operator", ContentRule{Path: "type", Operator: "regexp", Value: "a", Channel: "c"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rule.compile()
+			if (err == nil) != test.valid {
+				t.Errorf("compile() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestSelectChannel(t *testing.T) {
+
+	rules := []ContentRule{
+		{Path: "type", Operator: EQUALS_OPERATOR, Value: "order", Channel: "orders"},
+		{Path: "priority", Operator: EXISTS_OPERATOR, Channel: "priority"},
+		{Path: "type", Operator: PREFIX_OPERATOR, Value: "ord", Channel: "unreachable"},
+	}
+
+	for i := range rules {
+		err := rules[i].compile()
+		if err != nil {
+			t.Fatalf("compile: %v", err)
+		}
+	}
+
+	tests := []struct {
+		document string
+		channel  cube.Channel
+	}{
+		{`{"type": "order", "priority": 1}`, "orders"},
+		{`{"type": "refund", "priority": 1}`, "priority"},
+		{`{"type": "ordinal"}`, "unreachable"},
+		{`{"type": "refund"}`, "default"},
+		{`[1, 2]`, "default"},
+	}
+
+	for _, test := range tests {
+		channel := SelectChannel(rules, decodeDocument(t, test.document), "default")
+		if channel != test.channel {
+			t.Errorf("SelectChannel(%v) = %v, want %v", test.document, channel, test.channel)
+		}
+	}
+}
+
+func TestPayloadDocument(t *testing.T) {
+
+	payload := newPayloadDocument([]byte(`{"type": "order"}`))
+
+	first, err := payload.get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	first.(map[string]interface{})["decoded"] = true
+
+	second, _ := payload.get()
+	if second.(map[string]interface{})["decoded"] != true {
+		t.Errorf("payload is decoded again")
+	}
+
+	_, err = newPayloadDocument([]byte(`{"type": `)).get()
+	if err == nil {
+		t.Errorf("get of wrong json returned no error")
+	}
+
+	_, err = newPayloadDocument(nil).get()
+	if err == nil {
+		t.Errorf("get of empty payload returned no error")
+	}
+}
+
+func BenchmarkSelectChannel(b *testing.B) {
+
+	rules := []ContentRule{}
+	for i := 0; i < 20; i++ {
+		rules = append(rules, ContentRule{
+			Path:     "$.items.0.type",
+			Operator: EQUALS_OPERATOR,
+			Value:    fmt.Sprintf("type%v", i),
+			Channel:  cube.Channel(fmt.Sprintf("channel%v", i)),
+		})
+	}
+
+	rules = append(rules, ContentRule{Path: "region", Operator: PREFIX_OPERATOR, Value: "eu-", Channel: "eu"})
+
+	for i := range rules {
+		err := rules[i].compile()
+		if err != nil {
+			b.Fatalf("compile: %v", err)
+		}
+	}
+
+	data := []byte(`{"region": "eu-west", "items": [{"type": "other", "amount": 10}], "text": "hello"}`)
+
+	b.Run("document", func(b *testing.B) {
+		document := decodeDocument(b, string(data))
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			SelectChannel(rules, document, "default")
+		}
+	})
+
+	b.Run("payload", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			document, _ := newPayloadDocument(data).get()
+			SelectChannel(rules, document, "default")
+		}
+	})
+}
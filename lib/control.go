@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+var controlFieldMarker = []byte(`"control"`)
+
+// parseControlFrame returns the control frame or nil if the text frame must be handled as a usual message.
+// Without requireVersion any frame with "control" field is a control frame, it is used only when client
+// messages are wrapped in routing packets, so their payloads can't be taken for control frames.
+func parseControlFrame(data []byte, requireVersion bool) *js.ControlFrame {
+
+	if !bytes.Contains(data, controlFieldMarker) {
+		return nil
+	}
+
+	var frame js.ControlFrame
+	err := json.Unmarshal(data, &frame)
+	if err != nil || frame.Control == "" {
+		return nil
+	}
+
+	if requireVersion && frame.Version != js.FRAME_VERSION {
+		return nil
+	}
+
+	return &frame
+}
+
+// handleControlFrame handles frames addressed to the gateway, it returns false for other frames.
+func (s *Server) handleControlFrame(connection *Connection, data []byte) bool {
+
+	frame := parseControlFrame(data, !s.enableRouting)
+	if frame == nil {
+		return false
+	}
+
+	s.metrics.Add(fmt.Sprintf("control.%v", frame.Control), 1)
+
+	switch frame.Control {
+	case js.WATCH_PRESENCE_CONTROL:
+		s.watchPresence(connection, frame)
+	case js.UNWATCH_PRESENCE_CONTROL:
+		s.unwatchPresence(connection, frame)
+	case js.ACK_CONTROL:
+		s.ackDeliveries(connection, frame)
+	default:
+		s.sendError(connection, js.ERROR_UNKNOWN_CONTROL, frame.RequestId, false)
+	}
+
+	return true
+}
+
+func toUserIds(rawUserIds []string) []UserId {
+
+	userIds := make([]UserId, 0, len(rawUserIds))
+	for _, userId := range rawUserIds {
+		if userId != "" {
+			userIds = append(userIds, UserId(userId))
+		}
+	}
+
+	return userIds
+}
+
+// watchPresence subscribes the connection to presence changes of users, the watch list is approved
+// by the presence auth channel if it is set.
+func (s *Server) watchPresence(connection *Connection, frame *js.ControlFrame) {
+
+	if !connection.IsLoggedIn() {
+		s.sendError(connection, js.ERROR_UNAUTHORIZED, frame.RequestId, false)
+		return
+	}
+
+	userIds := toUserIds(frame.UserIds)
+	if len(userIds) > s.maxPresenceWatches {
+		s.sendError(connection, js.ERROR_TOO_MANY_WATCHES, frame.RequestId, false)
+		return
+	}
+
+	if s.presenceAuthChannel == "" {
+		s.addPresenceWatches(connection, frame.RequestId, userIds)
+		return
+	}
+
+	go func() {
+		allowedUserIds, err := s.authorizePresenceWatch(connection, userIds)
+		if err == ErrorCircuitOpen {
+			s.sendError(connection, js.ERROR_SERVICE_UNAVAILABLE, frame.RequestId, true)
+			return
+		}
+
+		if err == cube.ErrorTimeout {
+			s.sendError(connection, js.ERROR_TIMEOUT, frame.RequestId, true)
+			return
+		}
+
+		if err != nil {
+			s.sendError(connection, js.ERROR_FORBIDDEN, frame.RequestId, false)
+			return
+		}
+
+		s.addPresenceWatches(connection, frame.RequestId, allowedUserIds)
+	}()
+}
+
+// authorizePresenceWatch calls "authorizePresenceWatch" and returns the approved part of the watch list.
+func (s *Server) authorizePresenceWatch(connection *Connection, userIds []UserId) ([]UserId, error) {
+
+	connectionId, userId, deviceId := connection.GetInfo()
+
+	rawUserIds := make([]string, 0, len(userIds))
+	for _, watchedUserId := range userIds {
+		rawUserIds = append(rawUserIds, string(watchedUserId))
+	}
+
+	packedParams, _ := json.Marshal(js.AuthorizePresenceWatchParams{
+		ConnectionId: int64(connectionId),
+		UserId:       string(userId),
+		DeviceId:     string(deviceId),
+		Claims:       s.forwardClaims(connection.GetClaims()),
+		UserIds:      rawUserIds,
+	})
+
+	tenantId := connection.GetTenant()
+	request := cube.Request{
+		Method: "authorizePresenceWatch",
+		Params: (*json.RawMessage)(&packedParams),
+	}
+
+	response, err := s.callMethod(TenantChannel(s.presenceAuthChannel, tenantId), request, s.maxRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Error != nil || response.Result == nil {
+		return nil, fmt.Errorf("watch is not authorized")
+	}
+
+	var result js.AuthorizePresenceWatchResult
+	err = json.Unmarshal(*response.Result, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	requested := map[UserId]bool{}
+	for _, watchedUserId := range userIds {
+		requested[watchedUserId] = true
+	}
+
+	allowedUserIds := []UserId{}
+	for _, watchedUserId := range toUserIds(result.UserIds) {
+		if requested[watchedUserId] {
+			allowedUserIds = append(allowedUserIds, watchedUserId)
+		}
+	}
+
+	return allowedUserIds, nil
+}
+
+func (s *Server) addPresenceWatches(connection *Connection, requestId string, userIds []UserId) {
+
+	connectionId, _, _ := connection.GetInfo()
+	if connectionId == -1 {
+		return
+	}
+
+	tenantId := connection.GetTenant()
+
+	err := s.presenceWatches.Watch(connectionId, tenantId, userIds, s.maxPresenceWatches)
+	if err != nil {
+		s.sendError(connection, js.ERROR_TOO_MANY_WATCHES, requestId, false)
+		return
+	}
+
+	// The connection could be removed while the watch list was authorized.
+	if s.connections.GetConnectionById(connectionId) == nil {
+		s.presenceWatches.RemoveConnection(connectionId)
+		return
+	}
+
+	result := js.WatchPresenceResult{Watched: []string{}, Online: []string{}}
+	for _, userId := range userIds {
+		result.Watched = append(result.Watched, string(userId))
+
+		if s.connections.HasUser(tenantId, userId) {
+			result.Online = append(result.Online, string(userId))
+		}
+	}
+
+	packedResult, _ := json.Marshal(result)
+	s.sendFrame(connection, js.Frame{
+		Type:      js.RESPONSE_FRAME,
+		RequestId: requestId,
+		Result:    (*json.RawMessage)(&packedResult),
+	})
+}
+
+func (s *Server) unwatchPresence(connection *Connection, frame *js.ControlFrame) {
+
+	connectionId, _, _ := connection.GetInfo()
+	s.presenceWatches.Unwatch(connectionId, connection.GetTenant(), toUserIds(frame.UserIds))
+
+	if frame.RequestId != "" {
+		s.sendAck(connection, frame.RequestId)
+	}
+}
+
+// notifyPresenceWatchers queues presence frames to connections watching the user, frames are written
+// by a goroutine of every connection, so slow clients don't delay other watchers and presence events.
+func (s *Server) notifyPresenceWatchers(change UserChange) {
+
+	for _, connectionId := range s.presenceWatches.GetWatchers(change.TenantId, change.UserId) {
+		connection := s.connections.GetConnectionById(connectionId)
+		if connection == nil {
+			continue
+		}
+
+		if connection.presenceOutbox.push(change.UserId, change.Online) {
+			go s.sendPresenceFrames(connection)
+		}
+	}
+}
+
+// sendPresenceFrames writes pending presence frames of the connection until there are none left.
+func (s *Server) sendPresenceFrames(connection *Connection) {
+
+	for {
+		userId, online, ok := connection.presenceOutbox.next()
+		if !ok {
+			return
+		}
+
+		s.sendFrame(connection, js.Frame{
+			Type:   js.PRESENCE_FRAME,
+			UserId: string(userId),
+			Online: &online,
+		})
+	}
+}
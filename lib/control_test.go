@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func TestParseControlFrame(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		data           string
+		requireVersion bool
+		control        js.ControlType
+	}{
+		{"versioned", `{"v": 1, "control": "ack", "deliveryIds": [1]}`, true, js.ACK_CONTROL},
+		{"application payload", `{"control": "ack", "text": "hi"}`, true, ""},
+		{"other version", `{"v": 2, "control": "ack"}`, true, ""},
+		{"application payload with routing", `{"control": "ack"}`, false, js.ACK_CONTROL},
+		{"not a string", `{"v": 1, "control": {"volume": 3}}`, true, ""},
+		{"empty control", `{"v": 1, "control": ""}`, true, ""},
+		{"no control", `{"v": 1, "text": "control"}`, true, ""},
+		{"not json", `control`, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := parseControlFrame([]byte(test.data), test.requireVersion)
+
+			control := js.ControlType("")
+			if frame != nil {
+				control = frame.Control
+			}
+
+			if control != test.control {
+				t.Errorf("control = %q, want %q", control, test.control)
+			}
+		})
+	}
+}
+
+func TestHandleControlFrame(t *testing.T) {
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	connection, client := newSocketLoggedConnection(t, 1, "user", "phone")
+
+	if !server.handleControlFrame(connection, []byte(`{"v": 1, "control": "volume", "requestId": "1"}`)) {
+		t.Fatalf("versioned control frame isn't handled")
+	}
+
+	frame := readFrame(t, client)
+	if frame.Type != js.ERROR_FRAME || frame.Code != js.ERROR_UNKNOWN_CONTROL || frame.RequestId != "1" {
+		t.Errorf("unknown control is answered with %+v", frame)
+	}
+
+	// Messages of existing clients which happen to have "control" field are delivered to backends.
+	if server.handleControlFrame(connection, []byte(`{"control": "volume", "level": 3}`)) {
+		t.Errorf("application payload is handled as a control frame")
+	}
+
+	expectNoFrame(t, client)
+}
+
+func TestHandleControlFrameWithRouting(t *testing.T) {
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{EnableRouting: true})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	connection, client := newSocketLoggedConnection(t, 1, "user", "phone")
+
+	if !server.handleControlFrame(connection, []byte(`{"control": "unwatchPresence", "requestId": "1"}`)) {
+		t.Fatalf("control frame isn't handled with routing")
+	}
+
+	frame := readFrame(t, client)
+	if frame.Type != js.ACK_FRAME || frame.RequestId != "1" {
+		t.Errorf("unwatchPresence is answered with %+v", frame)
+	}
+
+	if server.handleControlFrame(connection, []byte(`{"endpoint": "chat", "body": "{\"control\": \"x\"}"}`)) {
+		t.Errorf("routing packet is handled as a control frame")
+	}
+}
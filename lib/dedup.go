@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultDedupWindow = time.Minute
+
+type dedupKey struct {
+	tenantId  TenantId
+	messageId string
+}
+
+// Deduplicator remembers ids of published messages for the window, so messages redelivered by the bus
+// are sent only once.
+type Deduplicator struct {
+	mutex     sync.Mutex
+	window    time.Duration
+	seen      map[dedupKey]time.Time
+	lastSweep time.Time
+}
+
+func NewDeduplicator(window time.Duration) *Deduplicator {
+
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+
+	return &Deduplicator{
+		mutex:     sync.Mutex{},
+		window:    window,
+		seen:      map[dedupKey]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Check remembers the message id and returns false if it has been seen within the window.
+// Expired ids are removed once per window.
+func (d *Deduplicator) Check(tenantId TenantId, messageId string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	windowStart := now.Add(-d.window)
+
+	if d.lastSweep.Before(windowStart) {
+		for key, seenAt := range d.seen {
+			if seenAt.Before(windowStart) {
+				delete(d.seen, key)
+			}
+		}
+
+		d.lastSweep = now
+	}
+
+	key := dedupKey{tenantId: tenantId, messageId: messageId}
+	if seenAt, ok := d.seen[key]; ok && !seenAt.Before(windowStart) {
+		return false
+	}
+
+	d.seen[key] = now
+	return true
+}
+
+// Forget removes the message id, so the message can be published again.
+func (d *Deduplicator) Forget(tenantId TenantId, messageId string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.seen, dedupKey{tenantId: tenantId, messageId: messageId})
+}
+
+func (d *Deduplicator) Size() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.seen)
+}
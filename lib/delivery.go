@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+const spillReplayInterval = time.Second
+
+var (
+	ErrorCircuitOpen        = errors.New("gateway: circuit is open")
+	ErrorMessageQueued      = errors.New("gateway: message is queued")
+	ErrorChannelSpilled     = errors.New("gateway: channel has spilled messages")
+	ErrorServiceUnavailable = errors.New("gateway: service is unavailable")
+)
+
+// publish sends the message through the circuit breaker of the channel,
+// messages which can't be delivered go to the dead letter channel or to the spill queue and ErrorMessageQueued
+// is returned, so callers don't publish them again. While the channel has spilled messages new messages
+// are queued after them to keep the order.
+func (s *Server) publish(channel cube.Channel, message cube.Message) error {
+
+	queued, dropped := s.spillQueue.PushIfQueued(channel, message)
+	if queued {
+		s.onSpilled(dropped)
+		return ErrorMessageQueued
+	}
+
+	err := s.tryPublish(channel, message)
+	if err != nil {
+		s.deadLetter(channel, message, err)
+		return ErrorMessageQueued
+	}
+
+	return nil
+}
+
+// publishClientMessage publishes a message the client is answered about. It isn't spilled, because the spill
+// queue drops messages when it is full, so it is either published to the dead letter channel and ErrorMessageQueued
+// is returned or ErrorServiceUnavailable is returned and the client has to send it again.
+// While the channel has spilled messages the message isn't published to it, so it doesn't overtake them.
+func (s *Server) publishClientMessage(channel cube.Channel, message cube.Message) error {
+
+	err := ErrorChannelSpilled
+	if !s.spillQueue.HasMessages(channel) {
+		err = s.tryPublish(channel, message)
+		if err == nil {
+			return nil
+		}
+	}
+
+	if s.publishDeadLetter(channel, message, err) {
+		return ErrorMessageQueued
+	}
+
+	s.metrics.Add(fmt.Sprintf("publish.unavailable.%v", channel), 1)
+	return ErrorServiceUnavailable
+}
+
+func (s *Server) tryPublish(channel cube.Channel, message cube.Message) error {
+
+	breaker := s.breakers.Get(channel)
+	if !breaker.Allow() {
+		s.metrics.Add(fmt.Sprintf("publish.rejected.%v", channel), 1)
+		return ErrorCircuitOpen
+	}
+
+	err := s.invokePublish(channel, message)
+	s.onCallResult(channel, breaker, err)
+	return err
+}
+
+// invokePublish turns panics of the executor into errors the same way as invokeMethod. The executor puts
+// a nil connection back to its pool when it can't dial the bus, so following publishes panic on it.
+func (s *Server) invokePublish(channel cube.Channel, message cube.Message) (err error) {
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("publish to %v failed: %v", channel, recovered)
+		}
+	}()
+
+	return s.cubeInstance.PublishMessage(channel, message)
+}
+
+// callMethod calls the channel through its circuit breaker.
+func (s *Server) callMethod(channel cube.Channel, request cube.Request, timeout time.Duration) (*cube.Response, error) {
+
+	breaker := s.breakers.Get(channel)
+	if !breaker.Allow() {
+		s.metrics.Add(fmt.Sprintf("publish.rejected.%v", channel), 1)
+		return nil, ErrorCircuitOpen
+	}
+
+	response, err := s.invokeMethod(channel, request, timeout)
+	s.onCallResult(channel, breaker, err)
+	return response, err
+}
+
+// invokeMethod turns panics of the executor into errors, so they count as failures of the channel
+// instead of crashing the gateway.
+func (s *Server) invokeMethod(channel cube.Channel, request cube.Request, timeout time.Duration) (response *cube.Response, err error) {
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			response = nil
+			err = fmt.Errorf("call of %v failed: %v", channel, recovered)
+		}
+	}()
+
+	return s.cubeInstance.CallMethod(channel, request, timeout)
+}
+
+func (s *Server) onCallResult(channel cube.Channel, breaker *CircuitBreaker, err error) {
+
+	if err == nil {
+		if breaker.OnSuccess() {
+			s.metrics.Set(fmt.Sprintf("breaker.open.%v", channel), 0)
+			s.cubeInstance.LogInfo(fmt.Sprintf("Circuit is closed: %v", channel))
+		}
+
+		return
+	}
+
+	s.metrics.Add(fmt.Sprintf("publish.errors.%v", channel), 1)
+
+	if breaker.OnFailure() {
+		s.metrics.Set(fmt.Sprintf("breaker.open.%v", channel), 1)
+		s.cubeInstance.LogError(fmt.Sprintf("Circuit is open: %v %v", channel, err))
+	}
+}
+
+func (s *Server) deadLetter(channel cube.Channel, message cube.Message, reason error) {
+
+	if s.publishDeadLetter(channel, message, reason) {
+		return
+	}
+
+	s.onSpilled(!s.spillQueue.Push(channel, message))
+}
+
+// publishDeadLetter returns false if there is no dead letter channel or the message can't be published to it.
+func (s *Server) publishDeadLetter(channel cube.Channel, message cube.Message, reason error) bool {
+
+	if s.deadLetterChannel != "" && channel != s.deadLetterChannel {
+		packedMessage, _ := json.Marshal(message)
+		packedParams, _ := json.Marshal(js.DeadLetterParams{
+			Channel:  string(channel),
+			Error:    reason.Error(),
+			FailedAt: time.Now().UnixNano(),
+			Message:  packedMessage,
+		})
+
+		err := s.tryPublish(s.deadLetterChannel, cube.Message{
+			Method: "onDeadLetter",
+			Params: (*json.RawMessage)(&packedParams),
+		})
+
+		if err == nil {
+			s.metrics.Add("deadLetters.published", 1)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) onSpilled(dropped bool) {
+
+	if dropped {
+		s.metrics.Add("deadLetters.dropped", 1)
+	}
+
+	s.metrics.Add("deadLetters.spilled", 1)
+	s.metrics.Set("deadLetters.queued", int64(s.spillQueue.Len()))
+}
+
+// replaySpilledMessages republishes spilled messages of every channel in order when the channel recovers,
+// channels with open circuits are skipped.
+func (s *Server) replaySpilledMessages() {
+
+	ticker := time.NewTicker(spillReplayInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.spillQueue.Len() == 0 {
+			continue
+		}
+
+		replayed := s.spillQueue.Replay(func(channel cube.Channel) bool {
+			return s.breakers.Get(channel).IsOpen()
+		}, s.tryPublish)
+		if replayed > 0 {
+			s.metrics.Add("deadLetters.replayed", int64(replayed))
+		}
+
+		s.metrics.Set("deadLetters.queued", int64(s.spillQueue.Len()))
+	}
+}
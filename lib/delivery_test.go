@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func TestPublishRecoversExecutorPanics(t *testing.T) {
+
+	cubeInstance := newBusCube(newMemoryBus(), "A")
+	server, err := NewServer(cubeInstance, ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	// The executor panics on a nil connection of its pool.
+	cubeInstance.SetPublishHook(func(channel cube.Channel) error {
+		panic("invalid memory address or nil pointer dereference")
+	})
+
+	err = server.tryPublish("chat", cube.Message{Method: "onTextMessage"})
+	if err == nil {
+		t.Fatalf("panic of the executor isn't returned as an error")
+	}
+
+	if server.metrics.Get("publish.errors.chat") != 1 {
+		t.Errorf("panic isn't counted as a failure of the channel")
+	}
+}
+
+func TestClientMessagesAreNotSpilled(t *testing.T) {
+
+	cubeInstance := newBusCube(newMemoryBus(), "A")
+	server, err := NewServer(cubeInstance, ServerConfig{BreakerThreshold: 1})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	cubeInstance.SetPublishHook(func(channel cube.Channel) error {
+		return errors.New("bus is down")
+	})
+
+	connection, client := newSocketLoggedConnection(t, 1, "user", "phone")
+	body := []byte("hello")
+
+	for i := 0; i < 2; i++ {
+		server.onReceiveMessage(connection, true, &body)
+
+		frame := readFrame(t, client)
+		if frame.Type != js.ERROR_FRAME || frame.Code != js.ERROR_SERVICE_UNAVAILABLE || !frame.Retryable {
+			t.Errorf("undelivered message is answered with %+v", frame)
+		}
+	}
+
+	if server.spillQueue.Len() != 0 {
+		t.Errorf("client messages are spilled")
+	}
+
+	// Events of the gateway are still spilled and client messages don't overtake them.
+	server.publish("wsOutput", cube.Message{Method: "onClose"})
+	if server.spillQueue.Len() != 1 {
+		t.Fatalf("event isn't spilled")
+	}
+
+	cubeInstance.SetPublishHook(nil)
+	server.breakers.Get("wsOutput").openedAt = time.Now().Add(-time.Hour)
+
+	server.onReceiveMessage(connection, true, &body)
+	if frame := readFrame(t, client); frame.Code != js.ERROR_SERVICE_UNAVAILABLE {
+		t.Errorf("message to a channel with spilled messages is answered with %+v", frame)
+	}
+
+	if messages := cubeInstance.bus.Messages("wsOutput"); len(messages) != 0 {
+		t.Errorf("message overtook spilled messages: %v", messages)
+	}
+}
+
+func TestClientMessagesAreDeadLettered(t *testing.T) {
+
+	cubeInstance := newBusCube(newMemoryBus(), "A")
+	server, err := NewServer(cubeInstance, ServerConfig{DeadLetterChannel: "deadLetters"})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	cubeInstance.SetPublishHook(func(channel cube.Channel) error {
+		if channel == "deadLetters" {
+			return nil
+		}
+
+		return errors.New("bus is down")
+	})
+
+	connection, client := newSocketLoggedConnection(t, 1, "user", "phone")
+	body := []byte("hello")
+	server.onReceiveMessage(connection, true, &body)
+
+	frame := readFrame(t, client)
+	if frame.Type != js.NOTICE_FRAME || frame.Code != js.NOTICE_QUEUED {
+		t.Errorf("dead lettered message is answered with %+v", frame)
+	}
+
+	if messages := cubeInstance.bus.Messages("deadLetters"); len(messages) != 1 || messages[0].Method != "onDeadLetter" {
+		t.Errorf("message isn't published to the dead letter channel: %v", messages)
+	}
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Endpoint names are dot separated tokens. In patterns "*" matches exactly one token
+// and ">" at the end matches one or more tokens, e.g. "chat.*" or "billing.>".
+const (
+	endpointTokenSeparator = "."
+	singleTokenWildcard    = "*"
+	tailWildcard           = ">"
+)
+
+func isEndpointPattern(endpoint Endpoint) bool {
+	for _, token := range strings.Split(string(endpoint), endpointTokenSeparator) {
+		if token == singleTokenWildcard || token == tailWildcard {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateEndpointName checks that wildcards are whole tokens and the tail wildcard is the last one.
+func ValidateEndpointName(endpoint Endpoint) error {
+	tokens := strings.Split(string(endpoint), endpointTokenSeparator)
+
+	for i, token := range tokens {
+		if token == "" {
+			return fmt.Errorf("endpoint %v: empty token", endpoint)
+		}
+
+		if token == tailWildcard && i != len(tokens)-1 {
+			return fmt.Errorf("endpoint %v: \"%v\" must be the last token", endpoint, tailWildcard)
+		}
+
+		if token != singleTokenWildcard && token != tailWildcard &&
+			(strings.Contains(token, singleTokenWildcard) || strings.Contains(token, tailWildcard)) {
+			return fmt.Errorf("endpoint %v: wildcard must be a whole token", endpoint)
+		}
+	}
+
+	return nil
+}
+
+func matchEndpoint(pattern Endpoint, endpoint Endpoint) bool {
+	patternTokens := strings.Split(string(pattern), endpointTokenSeparator)
+	tokens := strings.Split(string(endpoint), endpointTokenSeparator)
+
+	for i, patternToken := range patternTokens {
+		if patternToken == tailWildcard {
+			return len(tokens) > i
+		}
+
+		if i >= len(tokens) {
+			return false
+		}
+
+		if patternToken != singleTokenWildcard && patternToken != tokens[i] {
+			return false
+		}
+	}
+
+	return len(tokens) == len(patternTokens)
+}
+
+// isMoreSpecific orders patterns for the longest match: more literal tokens win,
+// then more tokens, then patterns without the tail wildcard.
+func isMoreSpecific(a Endpoint, b Endpoint) bool {
+	aLiterals, aTokens, aTail := patternWeight(a)
+	bLiterals, bTokens, bTail := patternWeight(b)
+
+	if aLiterals != bLiterals {
+		return aLiterals > bLiterals
+	}
+
+	if aTokens != bTokens {
+		return aTokens > bTokens
+	}
+
+	if aTail != bTail {
+		return !aTail
+	}
+
+	return a < b
+}
+
+func patternWeight(pattern Endpoint) (literals int, tokens int, tail bool) {
+	for _, token := range strings.Split(string(pattern), endpointTokenSeparator) {
+		tokens++
+
+		switch token {
+		case tailWildcard:
+			tail = true
+		case singleTokenWildcard:
+		default:
+			literals++
+		}
+	}
+
+	return literals, tokens, tail
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/akaumov/cube"
+)
+
+func TestValidateEndpointName(t *testing.T) {
+
+	tests := []struct {
+		endpoint Endpoint
+		valid    bool
+	}{
+		{"chat", true},
+		{"chat.send", true},
+		{"chat.*", true},
+		{"*.send", true},
+		{"billing.>", true},
+		{">", true},
+		{"", false},
+		{"chat.", false},
+		{"chat..send", false},
+		{"billing.>.send", false},
+		{"chat.se*", false},
+		{"chat.>x", false},
+	}
+
+	for _, test := range tests {
+		err := ValidateEndpointName(test.endpoint)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateEndpointName(%v) = %v, want valid %v", test.endpoint, err, test.valid)
+		}
+	}
+}
+
+func TestMatchEndpoint(t *testing.T) {
+
+	tests := []struct {
+		pattern  Endpoint
+		endpoint Endpoint
+		matches  bool
+	}{
+		{"chat", "chat", true},
+		{"chat", "chat.send", false},
+		{"chat.*", "chat.send", true},
+		{"chat.*", "chat", false},
+		{"chat.*", "chat.send.now", false},
+		{"*.send", "chat.send", true},
+		{"*.send", "chat.read", false},
+		{"billing.>", "billing.invoice", true},
+		{"billing.>", "billing.invoice.paid", true},
+		{"billing.>", "billing", false},
+		{"billing.*.paid", "billing.invoice.paid", true},
+		{">", "anything.at.all", true},
+	}
+
+	for _, test := range tests {
+		matches := matchEndpoint(test.pattern, test.endpoint)
+		if matches != test.matches {
+			t.Errorf("matchEndpoint(%v, %v) = %v, want %v", test.pattern, test.endpoint, matches, test.matches)
+		}
+	}
+}
+
+func TestIsMoreSpecific(t *testing.T) {
+
+	tests := []struct {
+		a            Endpoint
+		b            Endpoint
+		moreSpecific bool
+	}{
+		{"billing.invoice.*", "billing.*.*", true},
+		{"billing.*.*", "billing.>", true},
+		{"billing.*", "billing.>", true},
+		{"billing.>", "billing.*", false},
+		{"a.*", "b.*", true},
+		{"b.*", "a.*", false},
+	}
+
+	for _, test := range tests {
+		moreSpecific := isMoreSpecific(test.a, test.b)
+		if moreSpecific != test.moreSpecific {
+			t.Errorf("isMoreSpecific(%v, %v) = %v, want %v", test.a, test.b, moreSpecific, test.moreSpecific)
+		}
+	}
+}
+
+func TestRoutingTableMatch(t *testing.T) {
+
+	table, err := NewRoutingTable(map[Endpoint]cube.Channel{
+		"chat.send":   "chatSend",
+		"chat.*":      "chat",
+		"billing.>":   "billing",
+		"billing.*.*": "billingEvents",
+		"*.*":         "any",
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("NewRoutingTable: %v", err)
+	}
+
+	tests := []struct {
+		endpoint Endpoint
+		channel  cube.Channel
+	}{
+		{"chat.send", "chatSend"},
+		{"chat.read", "chat"},
+		{"billing.invoice", "billing"},
+		{"billing.invoice.paid", "billingEvents"},
+		{"billing.invoice.paid.now", "billing"},
+		{"users.read", "any"},
+		{"users", ""},
+	}
+
+	for _, test := range tests {
+		channel := cube.Channel("")
+		if endpoint := table.Match(test.endpoint); endpoint != nil {
+			channel = endpoint.Channel
+		}
+
+		if channel != test.channel {
+			t.Errorf("Match(%v) = %v, want %v", test.endpoint, channel, test.channel)
+		}
+	}
+
+	_, err = NewRoutingTable(map[Endpoint]cube.Channel{"chat.>.send": "chat"}, nil)
+	if err == nil {
+		t.Errorf("NewRoutingTable accepted a wrong pattern")
+	}
+}
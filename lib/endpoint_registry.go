@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/akaumov/cube"
+)
+
+const (
+	DefaultEndpointLeaseTtl  = 30 * time.Second
+	MaxEndpointLeaseTtl      = 10 * time.Minute
+	DefaultMaxEndpointLeases = 1000
+)
+
+var (
+	ErrorEndpointTaken    = fmt.Errorf("endpoint is registered by another channel")
+	ErrorTooManyEndpoints = fmt.Errorf("too many registered endpoints")
+)
+
+type endpointLease struct {
+	channel   cube.Channel
+	expiresAt time.Time
+}
+
+// EndpointRegistry keeps endpoints registered by services at runtime,
+// registrations expire unless they are renewed before the lease ends.
+type EndpointRegistry struct {
+	mutex     sync.RWMutex
+	leases    map[Endpoint]endpointLease
+	maxLeases int
+}
+
+func NewEndpointRegistry(maxLeases int) *EndpointRegistry {
+
+	if maxLeases <= 0 {
+		maxLeases = DefaultMaxEndpointLeases
+	}
+
+	return &EndpointRegistry{
+		mutex:     sync.RWMutex{},
+		leases:    map[Endpoint]endpointLease{},
+		maxLeases: maxLeases,
+	}
+}
+
+// Register adds or renews the lease, ttl is limited by MaxEndpointLeaseTtl. Endpoints registered by another channel
+// can't be taken over until their lease ends or they are unregistered, new endpoints aren't added
+// when the registry has maxLeases endpoints.
+func (r *EndpointRegistry) Register(endpoint Endpoint, channel cube.Channel, ttl time.Duration) (time.Time, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.removeExpired()
+
+	lease, ok := r.leases[endpoint]
+	if ok && lease.channel != channel {
+		return time.Time{}, ErrorEndpointTaken
+	}
+
+	if !ok && len(r.leases) >= r.maxLeases {
+		return time.Time{}, ErrorTooManyEndpoints
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultEndpointLeaseTtl
+	}
+
+	if ttl > MaxEndpointLeaseTtl {
+		ttl = MaxEndpointLeaseTtl
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	r.leases[endpoint] = endpointLease{
+		channel:   channel,
+		expiresAt: expiresAt,
+	}
+
+	return expiresAt, nil
+}
+
+// Unregister removes the endpoint only if it is registered by the channel.
+func (r *EndpointRegistry) Unregister(endpoint Endpoint, channel cube.Channel) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	lease, ok := r.leases[endpoint]
+	if !ok || lease.channel != channel {
+		return false
+	}
+
+	delete(r.leases, endpoint)
+	return true
+}
+
+// Match returns the exact endpoint or the most specific registered pattern matching the endpoint.
+func (r *EndpointRegistry) Match(endpoint Endpoint) *EndpointConfig {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	now := time.Now()
+
+	lease, ok := r.leases[endpoint]
+	if ok && !now.After(lease.expiresAt) {
+		return &EndpointConfig{
+			Name:    endpoint,
+			Channel: lease.channel,
+		}
+	}
+
+	var matched *EndpointConfig
+
+	for pattern, lease := range r.leases {
+		if now.After(lease.expiresAt) || !isEndpointPattern(pattern) || !matchEndpoint(pattern, endpoint) {
+			continue
+		}
+
+		if matched == nil || isMoreSpecific(pattern, matched.Name) {
+			matched = &EndpointConfig{
+				Name:    pattern,
+				Channel: lease.channel,
+			}
+		}
+	}
+
+	return matched
+}
+
+func (r *EndpointRegistry) removeExpired() {
+	now := time.Now()
+
+	for endpoint, lease := range r.leases {
+		if now.After(lease.expiresAt) {
+			delete(r.leases, endpoint)
+		}
+	}
+}
+
+// forEach calls fn for every not expired registration.
+func (r *EndpointRegistry) forEach(fn func(endpoint Endpoint, channel cube.Channel, expiresAt time.Time)) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	now := time.Now()
+
+	for endpoint, lease := range r.leases {
+		if now.After(lease.expiresAt) {
+			continue
+		}
+
+		fn(endpoint, lease.channel, lease.expiresAt)
+	}
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndpointRegistryRegister(t *testing.T) {
+
+	registry := NewEndpointRegistry(0)
+
+	_, err := registry.Register("chat", "chatA", time.Minute)
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	_, err = registry.Register("chat", "chatA", time.Minute)
+	if err != nil {
+		t.Errorf("renewal by the owner failed: %v", err)
+	}
+
+	_, err = registry.Register("chat", "chatB", time.Minute)
+	if err != ErrorEndpointTaken {
+		t.Errorf("Register by another channel = %v, want %v", err, ErrorEndpointTaken)
+	}
+
+	if endpoint := registry.Match("chat"); endpoint == nil || endpoint.Channel != "chatA" {
+		t.Errorf("endpoint is taken over: %v", endpoint)
+	}
+
+	if registry.Unregister("chat", "chatB") || registry.Unregister("chat", "") {
+		t.Errorf("endpoint is unregistered by another channel")
+	}
+
+	if !registry.Unregister("chat", "chatA") {
+		t.Errorf("endpoint isn't unregistered by the owner")
+	}
+
+	_, err = registry.Register("chat", "chatB", time.Minute)
+	if err != nil {
+		t.Errorf("Register after unregister: %v", err)
+	}
+}
+
+func TestEndpointRegistryMaxLeases(t *testing.T) {
+
+	registry := NewEndpointRegistry(2)
+	registry.Register("chat", "chat", time.Minute)
+	registry.Register("billing", "billing", time.Minute)
+
+	_, err := registry.Register("news", "news", time.Minute)
+	if err != ErrorTooManyEndpoints {
+		t.Errorf("Register beyond the limit = %v, want %v", err, ErrorTooManyEndpoints)
+	}
+
+	_, err = registry.Register("chat", "chat", time.Minute)
+	if err != nil {
+		t.Errorf("renewal at the limit failed: %v", err)
+	}
+
+	registry.leases["billing"] = endpointLease{channel: "billing", expiresAt: time.Now().Add(-time.Second)}
+
+	_, err = registry.Register("news", "news", time.Minute)
+	if err != nil {
+		t.Errorf("expired leases are counted: %v", err)
+	}
+}
+
+func TestEndpointRegistryExpiredLease(t *testing.T) {
+
+	registry := NewEndpointRegistry(0)
+	registry.leases["chat"] = endpointLease{channel: "chatA", expiresAt: time.Now().Add(-time.Second)}
+
+	if endpoint := registry.Match("chat"); endpoint != nil {
+		t.Errorf("expired endpoint is matched: %v", endpoint)
+	}
+
+	_, err := registry.Register("chat", "chatB", time.Minute)
+	if err != nil {
+		t.Errorf("expired endpoint can't be taken: %v", err)
+	}
+}
+
+func TestEndpointRegistryMatchPattern(t *testing.T) {
+
+	registry := NewEndpointRegistry(0)
+	registry.Register("chat.>", "chat", time.Minute)
+	registry.Register("chat.*", "chatSingle", time.Minute)
+	registry.Register("chat.send", "chatSend", time.Minute)
+
+	tests := []struct {
+		endpoint Endpoint
+		channel  string
+	}{
+		{"chat.send", "chatSend"},
+		{"chat.read", "chatSingle"},
+		{"chat.read.all", "chat"},
+		{"billing", ""},
+	}
+
+	for _, test := range tests {
+		channel := ""
+		if endpoint := registry.Match(test.endpoint); endpoint != nil {
+			channel = string(endpoint.Channel)
+		}
+
+		if channel != test.channel {
+			t.Errorf("Match(%v) = %v, want %v", test.endpoint, channel, test.channel)
+		}
+	}
+}
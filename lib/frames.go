@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"encoding/json"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func (s *Server) sendFrame(connection *Connection, frame js.Frame) error {
+	frame.Version = js.FRAME_VERSION
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	return connection.SendText(data)
+}
+
+// errorMessages describe error codes for people, clients must rely on codes.
+var errorMessages = map[string]string{
+	js.ERROR_PARSING_ROUTING_PACKET: "routing packet can't be parsed",
+	js.ERROR_ENDPOINT_NOT_FOUND:     "endpoint not found",
+	js.ERROR_EMPTY_PAYLOAD:          "payload is empty",
+	js.ERROR_EMPTY_REQUEST_ID:       "request id is required",
+	js.ERROR_UNAUTHORIZED:           "authentication is required",
+	js.ERROR_FORBIDDEN:              "not allowed",
+	js.ERROR_WRONG_MESSAGE_TYPE:     "message type is not allowed by the endpoint",
+	js.ERROR_MESSAGE_TOO_BIG:        "message is too big",
+	js.ERROR_RATE_LIMIT:             "rate limit exceeded",
+	js.ERROR_INVALID_PAYLOAD:        "payload doesn't match the schema",
+	js.ERROR_SERVICE_UNAVAILABLE:    "service is unavailable",
+	js.ERROR_UNKNOWN_CONTROL:        "unknown control",
+	js.ERROR_TOO_MANY_WATCHES:       "too many presence watches",
+	js.ERROR_TOO_MANY_REQUESTS:      "too many requests in flight",
+	js.ERROR_TIMEOUT:                "request timed out",
+	js.ERROR_SERVER:                 "server error",
+}
+
+// sendError sends an error generated by the gateway, in legacy mode only the code is sent as plain text.
+func (s *Server) sendError(connection *Connection, code string, requestId string, retryable bool) {
+
+	if s.legacyFrames {
+		connection.SendText([]byte(code))
+		return
+	}
+
+	s.sendFrame(connection, js.Frame{
+		Type:      js.ERROR_FRAME,
+		Code:      code,
+		Message:   errorMessages[code],
+		RequestId: requestId,
+		Retryable: retryable,
+	})
+}
+
+func (s *Server) sendViolations(connection *Connection, requestId string, violations []js.Violation) {
+
+	if s.legacyFrames {
+		connection.SendText([]byte(js.ERROR_INVALID_PAYLOAD))
+		return
+	}
+
+	s.sendFrame(connection, js.Frame{
+		Type:       js.ERROR_FRAME,
+		Code:       js.ERROR_INVALID_PAYLOAD,
+		Message:    errorMessages[js.ERROR_INVALID_PAYLOAD],
+		RequestId:  requestId,
+		Violations: violations,
+	})
+}
+
+// sendNotice informs the client about the state of its message, notices aren't sent in legacy mode.
+func (s *Server) sendNotice(connection *Connection, code string, requestId string) {
+
+	if s.legacyFrames {
+		return
+	}
+
+	s.sendFrame(connection, js.Frame{
+		Type:      js.NOTICE_FRAME,
+		Code:      code,
+		RequestId: requestId,
+	})
+}
+
+func (s *Server) sendAck(connection *Connection, requestId string) {
+
+	if s.legacyFrames {
+		return
+	}
+
+	s.sendFrame(connection, js.Frame{
+		Type:      js.ACK_FRAME,
+		RequestId: requestId,
+	})
+}
+
+func (s *Server) sendResponse(connection *Connection, response cube.Response) {
+
+	if s.legacyFrames {
+		packedResponse := js.RoutingResponse{
+			RequestId: response.Id,
+			Result:    response.Result,
+		}
+
+		if response.Error != nil {
+			packedResponse.Error = &js.ResponseError{
+				Name:    response.Error.Name,
+				Message: response.Error.Message,
+			}
+		}
+
+		data, err := json.Marshal(packedResponse)
+		if err != nil {
+			return
+		}
+
+		connection.SendText(data)
+		return
+	}
+
+	if response.Error != nil {
+		s.sendFrame(connection, js.Frame{
+			Type:      js.ERROR_FRAME,
+			Code:      response.Error.Name,
+			Message:   response.Error.Message,
+			RequestId: response.Id,
+		})
+		return
+	}
+
+	s.sendFrame(connection, js.Frame{
+		Type:      js.RESPONSE_FRAME,
+		RequestId: response.Id,
+		Result:    response.Result,
+	})
+}
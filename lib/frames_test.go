@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func TestErrorMessages(t *testing.T) {
+
+	codes := []string{
+		js.ERROR_PARSING_ROUTING_PACKET, js.ERROR_ENDPOINT_NOT_FOUND, js.ERROR_EMPTY_PAYLOAD, js.ERROR_EMPTY_REQUEST_ID,
+		js.ERROR_UNAUTHORIZED, js.ERROR_FORBIDDEN, js.ERROR_WRONG_MESSAGE_TYPE, js.ERROR_MESSAGE_TOO_BIG, js.ERROR_RATE_LIMIT,
+		js.ERROR_INVALID_PAYLOAD, js.ERROR_SERVICE_UNAVAILABLE, js.ERROR_UNKNOWN_CONTROL, js.ERROR_TOO_MANY_WATCHES,
+		js.ERROR_TOO_MANY_REQUESTS, js.ERROR_TIMEOUT, js.ERROR_SERVER,
+	}
+
+	for _, code := range codes {
+		if errorMessages[code] == "" {
+			t.Errorf("%v has no message", code)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	connection, client := newSocketConnection(t, 1)
+	result := json.RawMessage(`{"id":1}`)
+
+	tests := []struct {
+		name  string
+		send  func()
+		frame string
+	}{
+		{"error", func() { server.sendError(connection, js.ERROR_RATE_LIMIT, "1", true) },
+			`{"v":1,"type":"error","code":"ErrorRateLimit","message":"rate limit exceeded","requestId":"1","retryable":true}`},
+		{"error without request", func() { server.sendError(connection, js.ERROR_PARSING_ROUTING_PACKET, "", false) },
+			`{"v":1,"type":"error","code":"ErrorParsingRoutingPacket","message":"routing packet can't be parsed"}`},
+		{"violations", func() { server.sendViolations(connection, "2", []js.Violation{{Path: "/text", Message: "is required"}}) },
+			`{"v":1,"type":"error","code":"ErrorInvalidPayload","message":"payload doesn't match the schema","requestId":"2",` +
+				`"violations":[{"path":"/text","message":"is required"}]}`},
+		{"ack", func() { server.sendAck(connection, "3") }, `{"v":1,"type":"ack","requestId":"3"}`},
+		{"notice", func() { server.sendNotice(connection, js.NOTICE_QUEUED, "4") }, `{"v":1,"type":"notice","code":"Queued","requestId":"4"}`},
+		{"response", func() { server.sendResponse(connection, cube.Response{Id: "5", Result: &result}) },
+			`{"v":1,"type":"response","requestId":"5","result":{"id":1}}`},
+		{"response error", func() {
+			server.sendResponse(connection, cube.Response{Id: "6", Error: &cube.Error{Name: "NotFound", Message: "no such chat"}})
+		}, `{"v":1,"type":"error","code":"NotFound","message":"no such chat","requestId":"6"}`},
+	}
+
+	for _, test := range tests {
+		test.send()
+		if frame := readText(t, client); frame != test.frame {
+			t.Errorf("%v frame = %v, want %v", test.name, frame, test.frame)
+		}
+	}
+}
+
+func TestLegacyFrames(t *testing.T) {
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{LegacyFrames: true})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	connection, client := newSocketConnection(t, 1)
+
+	server.sendError(connection, js.ERROR_ENDPOINT_NOT_FOUND, "1", false)
+	if text := readText(t, client); text != js.ERROR_ENDPOINT_NOT_FOUND {
+		t.Errorf("legacy error = %v", text)
+	}
+
+	server.sendViolations(connection, "2", []js.Violation{{Path: "/text", Message: "is required"}})
+	if text := readText(t, client); text != js.ERROR_INVALID_PAYLOAD {
+		t.Errorf("legacy violations = %v", text)
+	}
+
+	server.sendResponse(connection, cube.Response{Id: "3", Error: &cube.Error{Name: "NotFound", Message: "no such chat"}})
+	if text := readText(t, client); text != `{"requestId":"3","result":null,"error":{"name":"NotFound","description":"no such chat"}}` {
+		t.Errorf("legacy response = %v", text)
+	}
+
+	// Acks and notices didn't exist before the frames, so legacy clients don't get them.
+	server.sendAck(connection, "4")
+	server.sendNotice(connection, js.NOTICE_QUEUED, "5")
+	expectNoFrame(t, client)
+}
@@ -0,0 +1,418 @@
+package lib
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+const (
+	DefaultInboxMaxMessages = 100
+	DefaultInboxTtl         = 7 * 24 * time.Hour
+)
+
+type inboxFile struct {
+	TenantId TenantId          `json:"tenantId,omitempty"`
+	UserId   UserId            `json:"userId"`
+	Messages []js.InboxMessage `json:"messages"`
+}
+
+// Inbox keeps messages for users without connections, every user has a json file in the inbox directory
+// which is replaced on every change. Messages to a device are removed when they are delivered,
+// messages to the user are delivered to every device of the user until they expire.
+type Inbox struct {
+	mutex       sync.Mutex
+	dir         string
+	maxMessages int
+	ttl         time.Duration
+	boxes       map[presenceKey]*inboxFile
+	lastId      uint64
+}
+
+// LoadInbox reads the inbox directory, it is created if it doesn't exist.
+func LoadInbox(dir string, maxMessages int, ttl time.Duration) (*Inbox, error) {
+
+	if maxMessages <= 0 {
+		maxMessages = DefaultInboxMaxMessages
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultInboxTtl
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	inbox := &Inbox{
+		mutex:       sync.Mutex{},
+		dir:         dir,
+		maxMessages: maxMessages,
+		ttl:         ttl,
+		boxes:       map[presenceKey]*inboxFile{},
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var box inboxFile
+		err = json.Unmarshal(data, &box)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse inbox %v: %v", file.Name(), err)
+		}
+
+		for i := range box.Messages {
+			if box.Messages[i].Id > inbox.lastId {
+				inbox.lastId = box.Messages[i].Id
+			}
+		}
+
+		inbox.boxes[presenceKey{tenantId: box.TenantId, userId: box.UserId}] = &box
+	}
+
+	// Messages stored without ids get them after the ids of the others.
+	for _, box := range inbox.boxes {
+		for i := range box.Messages {
+			if box.Messages[i].Id == 0 {
+				inbox.lastId++
+				box.Messages[i].Id = inbox.lastId
+			}
+		}
+	}
+
+	return inbox, nil
+}
+
+func (i *Inbox) path(key presenceKey) string {
+	hash := sha1.Sum([]byte(string(key.tenantId) + "\x00" + string(key.userId)))
+	return filepath.Join(i.dir, hex.EncodeToString(hash[:])+".json")
+}
+
+// save replaces the file of the user, the file is removed when there are no messages.
+func (i *Inbox) save(key presenceKey, box *inboxFile) error {
+
+	path := i.path(key)
+
+	if len(box.Messages) == 0 {
+		delete(i.boxes, key)
+
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	data, err := json.Marshal(box)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func removeExpiredMessages(messages []js.InboxMessage, now int64) []js.InboxMessage {
+
+	result := []js.InboxMessage{}
+	for _, message := range messages {
+		if message.ExpiresAt > now {
+			result = append(result, message)
+		}
+	}
+
+	return result
+}
+
+func nowMilliseconds() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Store adds the message to the inbox of the user, the oldest messages are dropped if the inbox is full.
+// It returns the number of dropped messages.
+func (i *Inbox) Store(tenantId TenantId, userId UserId, deviceId *DeviceId, messageType js.MessageType, body []byte,
+	ttl time.Duration, reliable bool) (int, error) {
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if ttl <= 0 || ttl > i.ttl {
+		ttl = i.ttl
+	}
+
+	key := presenceKey{tenantId: tenantId, userId: userId}
+	box := i.boxes[key]
+	if box == nil {
+		box = &inboxFile{TenantId: tenantId, UserId: userId}
+		i.boxes[key] = box
+	}
+
+	now := nowMilliseconds()
+	i.lastId++
+	message := js.InboxMessage{
+		Id:        i.lastId,
+		Type:      messageType,
+		Body:      body,
+		Reliable:  reliable,
+		StoredAt:  now,
+		ExpiresAt: now + int64(ttl/time.Millisecond),
+	}
+
+	if deviceId != nil {
+		message.DeviceId = string(*deviceId)
+	}
+
+	messages := append(removeExpiredMessages(box.Messages, now), message)
+
+	dropped := 0
+	if len(messages) > i.maxMessages {
+		dropped = len(messages) - i.maxMessages
+		messages = messages[dropped:]
+	}
+
+	box.Messages = messages
+	return dropped, i.save(key, box)
+}
+
+// take removes and returns messages of the user which match the filter.
+func (i *Inbox) take(tenantId TenantId, userId UserId, matches func(message js.InboxMessage) bool) ([]js.InboxMessage, error) {
+
+	key := presenceKey{tenantId: tenantId, userId: userId}
+	box := i.boxes[key]
+	if box == nil {
+		return []js.InboxMessage{}, nil
+	}
+
+	taken := []js.InboxMessage{}
+	rest := []js.InboxMessage{}
+
+	for _, message := range removeExpiredMessages(box.Messages, nowMilliseconds()) {
+		if matches(message) {
+			taken = append(taken, message)
+		} else {
+			rest = append(rest, message)
+		}
+	}
+
+	box.Messages = rest
+	return taken, i.save(key, box)
+}
+
+func isDeliveredTo(message js.InboxMessage, deviceId DeviceId) bool {
+	for _, delivered := range message.DeliveredTo {
+		if delivered == string(deviceId) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetDeviceMessages returns messages to the device and messages to the user which the device hasn't got yet,
+// they are ordered by time. Messages stay in the inbox until MarkDelivered.
+func (i *Inbox) GetDeviceMessages(tenantId TenantId, userId UserId, deviceId DeviceId) []js.InboxMessage {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	messages := []js.InboxMessage{}
+
+	box := i.boxes[presenceKey{tenantId: tenantId, userId: userId}]
+	if box == nil {
+		return messages
+	}
+
+	for _, message := range removeExpiredMessages(box.Messages, nowMilliseconds()) {
+		if message.DeviceId == string(deviceId) || (message.DeviceId == "" && !isDeliveredTo(message, deviceId)) {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+// MarkDelivered removes delivered messages to the device and remembers the device in delivered messages to the user.
+func (i *Inbox) MarkDelivered(tenantId TenantId, userId UserId, deviceId DeviceId, messageIds []uint64) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	key := presenceKey{tenantId: tenantId, userId: userId}
+	box := i.boxes[key]
+	if box == nil || len(messageIds) == 0 {
+		return nil
+	}
+
+	delivered := map[uint64]bool{}
+	for _, id := range messageIds {
+		delivered[id] = true
+	}
+
+	rest := []js.InboxMessage{}
+	for _, message := range removeExpiredMessages(box.Messages, nowMilliseconds()) {
+		if delivered[message.Id] {
+			if message.DeviceId != "" {
+				continue
+			}
+
+			if !isDeliveredTo(message, deviceId) {
+				message.DeliveredTo = append(append([]string{}, message.DeliveredTo...), string(deviceId))
+			}
+		}
+
+		rest = append(rest, message)
+	}
+
+	box.Messages = rest
+	return i.save(key, box)
+}
+
+// Purge removes messages of the user or of the device if deviceId is set and returns their number.
+func (i *Inbox) Purge(tenantId TenantId, userId UserId, deviceId *DeviceId) (int, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	removed, err := i.take(tenantId, userId, func(message js.InboxMessage) bool {
+		return deviceId == nil || message.DeviceId == string(*deviceId)
+	})
+
+	return len(removed), err
+}
+
+// List returns messages of the user or of the device if deviceId is set.
+func (i *Inbox) List(tenantId TenantId, userId UserId, deviceId *DeviceId) []js.InboxMessage {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	messages := []js.InboxMessage{}
+
+	box := i.boxes[presenceKey{tenantId: tenantId, userId: userId}]
+	if box == nil {
+		return messages
+	}
+
+	for _, message := range removeExpiredMessages(box.Messages, nowMilliseconds()) {
+		if deviceId == nil || message.DeviceId == string(*deviceId) {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+func (s *Server) storeMessage(tenantId TenantId, userId UserId, deviceId *DeviceId, messageType js.MessageType, message []byte,
+	options SendOptions) {
+
+	if s.inbox == nil {
+		s.metrics.Add("inbox.disabled", 1)
+		return
+	}
+
+	ttl := options.StoreTtl
+	if !options.ExpiresAt.IsZero() {
+		untilExpiry := time.Until(options.ExpiresAt)
+		if ttl <= 0 || untilExpiry < ttl {
+			ttl = untilExpiry
+		}
+	}
+
+	dropped, err := s.inbox.Store(tenantId, userId, deviceId, messageType, message, ttl, options.Reliable)
+	if err != nil {
+		s.metrics.Add("inbox.errors", 1)
+		s.cubeInstance.LogError(fmt.Sprintf("Can't store message: %v", err))
+		return
+	}
+
+	s.metrics.Add("inbox.stored", 1)
+	if dropped > 0 {
+		s.metrics.Add("inbox.dropped", int64(dropped))
+	}
+}
+
+type tenantInboxMessage struct {
+	tenantId TenantId
+	message  js.InboxMessage
+}
+
+// flushInbox sends stored messages to the logged in connection, messages to any tenant are sent too.
+// Messages are marked as delivered after they have been written, so a failed write keeps them for the next login.
+func (s *Server) flushInbox(connection *Connection) {
+
+	if s.inbox == nil {
+		return
+	}
+
+	_, userId, deviceId := connection.GetInfo()
+	tenantIds := []TenantId{""}
+	if tenantId := connection.GetTenant(); tenantId != "" {
+		tenantIds = append(tenantIds, tenantId)
+	}
+
+	messages := []tenantInboxMessage{}
+	for _, tenantId := range tenantIds {
+		for _, message := range s.inbox.GetDeviceMessages(tenantId, userId, deviceId) {
+			messages = append(messages, tenantInboxMessage{tenantId: tenantId, message: message})
+		}
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].message.StoredAt < messages[j].message.StoredAt
+	})
+
+	delivered := map[TenantId][]uint64{}
+	for _, item := range messages {
+		message := item.message
+		err := s.sendToConnection(connection, message.Type, message.Body, SendOptions{
+			Reliable:  message.Reliable,
+			ExpiresAt: time.Unix(0, message.ExpiresAt*int64(time.Millisecond)),
+		})
+
+		if err != nil {
+			break
+		}
+
+		delivered[item.tenantId] = append(delivered[item.tenantId], message.Id)
+	}
+
+	flushed := 0
+	for tenantId, messageIds := range delivered {
+		flushed += len(messageIds)
+
+		err := s.inbox.MarkDelivered(tenantId, userId, deviceId, messageIds)
+		if err != nil {
+			s.metrics.Add("inbox.errors", 1)
+			s.cubeInstance.LogError(fmt.Sprintf("Can't flush inbox: %v", err))
+		}
+	}
+
+	if flushed > 0 {
+		s.metrics.Add("inbox.flushed", int64(flushed))
+	}
+}
@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func newTestInboxDir(t *testing.T) string {
+
+	dir, err := ioutil.TempDir("", "inbox")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func inboxBodies(messages []js.InboxMessage) []string {
+
+	bodies := []string{}
+	for _, message := range messages {
+		bodies = append(bodies, string(message.Body))
+	}
+
+	return bodies
+}
+
+func expectInboxBodies(t *testing.T, description string, messages []js.InboxMessage, expected ...string) {
+	t.Helper()
+
+	bodies := inboxBodies(messages)
+	if len(bodies) != len(expected) {
+		t.Fatalf("%v: messages = %q, want %q", description, bodies, expected)
+	}
+
+	for i := range bodies {
+		if bodies[i] != expected[i] {
+			t.Fatalf("%v: messages = %q, want %q", description, bodies, expected)
+		}
+	}
+}
+
+func TestInboxPersistence(t *testing.T) {
+
+	dir := newTestInboxDir(t)
+	phone := DeviceId("phone")
+
+	inbox, err := LoadInbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("LoadInbox: %v", err)
+	}
+
+	inbox.Store("", "user", nil, js.TEXT, []byte("1"), 0, false)
+	inbox.Store("", "user", &phone, js.TEXT, []byte("2"), 0, true)
+	inbox.Store("acme", "user", nil, js.TEXT, []byte("3"), 0, false)
+
+	err = inbox.MarkDelivered("", "user", "tablet", []uint64{1})
+	if err != nil {
+		t.Fatalf("MarkDelivered: %v", err)
+	}
+
+	restarted, err := LoadInbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("LoadInbox after restart: %v", err)
+	}
+
+	messages := restarted.List("", "user", nil)
+	expectInboxBodies(t, "restored inbox", messages, "1", "2")
+
+	if !messages[1].Reliable || messages[1].DeviceId != "phone" || len(messages[0].DeliveredTo) != 1 {
+		t.Errorf("restored messages = %+v", messages)
+	}
+
+	expectInboxBodies(t, "restored tenant inbox", restarted.List("acme", "user", nil), "3")
+	expectInboxBodies(t, "device inbox after restart", restarted.GetDeviceMessages("", "user", "tablet"))
+
+	_, err = restarted.Store("", "user", nil, js.TEXT, []byte("4"), 0, false)
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	ids := map[uint64]bool{}
+	for _, tenantId := range []TenantId{"", "acme"} {
+		for _, message := range restarted.List(tenantId, "user", nil) {
+			if ids[message.Id] {
+				t.Errorf("id %v is reused after restart", message.Id)
+			}
+			ids[message.Id] = true
+		}
+	}
+
+	restarted.Purge("", "user", nil)
+	restarted.Purge("acme", "user", nil)
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("%v files are left after all messages are purged", len(files))
+	}
+}
+
+func TestInboxTtl(t *testing.T) {
+
+	dir := newTestInboxDir(t)
+
+	inbox, err := LoadInbox(dir, 0, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("LoadInbox: %v", err)
+	}
+
+	inbox.Store("", "user", nil, js.TEXT, []byte("short"), 200*time.Millisecond, false)
+	inbox.Store("", "user", nil, js.TEXT, []byte("capped"), time.Hour, false)
+
+	messages := inbox.List("", "user", nil)
+	expectInboxBodies(t, "stored messages", messages, "short", "capped")
+
+	if ttl := messages[1].ExpiresAt - messages[1].StoredAt; ttl != 500 {
+		t.Errorf("ttl = %v ms, inbox-ttl isn't the limit", ttl)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	expectInboxBodies(t, "messages after the short ttl", inbox.GetDeviceMessages("", "user", "phone"), "capped")
+
+	time.Sleep(300 * time.Millisecond)
+	expectInboxBodies(t, "messages after inbox-ttl", inbox.List("", "user", nil))
+
+	restarted, err := LoadInbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("LoadInbox: %v", err)
+	}
+
+	expectInboxBodies(t, "expired messages after restart", restarted.List("", "user", nil))
+}
+
+func TestInboxMaxMessages(t *testing.T) {
+
+	inbox, err := LoadInbox(newTestInboxDir(t), 3, 0)
+	if err != nil {
+		t.Fatalf("LoadInbox: %v", err)
+	}
+
+	phone := DeviceId("phone")
+	for _, body := range []string{"1", "2", "3"} {
+		dropped, _ := inbox.Store("", "user", &phone, js.TEXT, []byte(body), 0, false)
+		if dropped != 0 {
+			t.Errorf("%v messages are dropped before the inbox is full", dropped)
+		}
+	}
+
+	dropped, err := inbox.Store("", "user", nil, js.TEXT, []byte("4"), 0, false)
+	if err != nil || dropped != 1 {
+		t.Errorf("Store() = %v, %v, want 1 dropped message", dropped, err)
+	}
+
+	expectInboxBodies(t, "full inbox", inbox.List("", "user", nil), "2", "3", "4")
+	expectInboxBodies(t, "other user", inbox.List("", "other", nil))
+
+	inbox.Store("", "other", nil, js.TEXT, []byte("a"), 0, false)
+	expectInboxBodies(t, "inboxes are limited per user", inbox.List("", "user", nil), "2", "3", "4")
+}
+
+func TestInboxDeliveredTo(t *testing.T) {
+
+	inbox, err := LoadInbox(newTestInboxDir(t), 0, 0)
+	if err != nil {
+		t.Fatalf("LoadInbox: %v", err)
+	}
+
+	phone := DeviceId("phone")
+	inbox.Store("", "user", nil, js.TEXT, []byte("user"), 0, false)
+	inbox.Store("", "user", &phone, js.TEXT, []byte("phone"), 0, false)
+
+	messages := inbox.GetDeviceMessages("", "user", "phone")
+	expectInboxBodies(t, "phone messages", messages, "user", "phone")
+	expectInboxBodies(t, "tablet messages", inbox.GetDeviceMessages("", "user", "tablet"), "user")
+
+	err = inbox.MarkDelivered("", "user", "phone", []uint64{messages[0].Id, messages[1].Id})
+	if err != nil {
+		t.Fatalf("MarkDelivered: %v", err)
+	}
+
+	expectInboxBodies(t, "phone messages after delivery", inbox.GetDeviceMessages("", "user", "phone"))
+	expectInboxBodies(t, "tablet messages after phone delivery", inbox.GetDeviceMessages("", "user", "tablet"), "user")
+
+	inbox.MarkDelivered("", "user", "phone", []uint64{messages[0].Id})
+	inbox.MarkDelivered("", "user", "tablet", []uint64{messages[0].Id})
+
+	stored := inbox.List("", "user", nil)
+	expectInboxBodies(t, "user messages are kept", stored, "user")
+
+	if deliveredTo := stored[0].DeliveredTo; len(deliveredTo) != 2 || deliveredTo[0] != "phone" || deliveredTo[1] != "tablet" {
+		t.Errorf("deliveredTo = %q", deliveredTo)
+	}
+
+	expectInboxBodies(t, "tablet messages after delivery", inbox.GetDeviceMessages("", "user", "tablet"))
+	expectInboxBodies(t, "new device messages", inbox.GetDeviceMessages("", "user", "laptop"), "user")
+}
+
+func TestServerFlushInbox(t *testing.T) {
+
+	inbox, err := LoadInbox(newTestInboxDir(t), 0, 0)
+	if err != nil {
+		t.Fatalf("LoadInbox: %v", err)
+	}
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{Inbox: inbox})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	phone := DeviceId("phone")
+	inbox.Store("", "user", nil, js.TEXT, []byte("first"), 0, false)
+	inbox.Store("", "user", &phone, js.TEXT, []byte("second"), 0, false)
+
+	for _, deviceId := range []DeviceId{"phone", "tablet"} {
+		connection, client := newSocketLoggedConnection(t, 1, "user", deviceId)
+		server.flushInbox(connection)
+
+		expected := []string{"first"}
+		if deviceId == phone {
+			expected = append(expected, "second")
+		}
+
+		for _, body := range expected {
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, data, err := client.ReadMessage()
+			if err != nil || string(data) != body {
+				t.Fatalf("%v got %q, %v, want %q", deviceId, data, err, body)
+			}
+		}
+
+		server.flushInbox(connection)
+		expectNoFrame(t, client)
+	}
+
+	if flushed := server.metrics.Get("inbox.flushed"); flushed != 3 {
+		t.Errorf("inbox.flushed = %v", flushed)
+	}
+}
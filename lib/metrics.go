@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"strings"
+	"sync"
+)
+
+// Metrics is a set of named counters and gauges exposed through the bus.
+type Metrics struct {
+	mutex  sync.RWMutex
+	values map[string]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		mutex:  sync.RWMutex{},
+		values: make(map[string]int64),
+	}
+}
+
+func (m *Metrics) Add(name string, delta int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.values[name] += delta
+}
+
+func (m *Metrics) Set(name string, value int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.values[name] = value
+}
+
+func (m *Metrics) DeletePrefix(prefix string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for name := range m.values {
+		if strings.HasPrefix(name, prefix) {
+			delete(m.values, name)
+		}
+	}
+}
+
+func (m *Metrics) Get(name string) int64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.values[name]
+}
+
+func (m *Metrics) Snapshot() map[string]int64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	snapshot := make(map[string]int64, len(m.values))
+	for name, value := range m.values {
+		snapshot[name] = value
+	}
+
+	return snapshot
+}
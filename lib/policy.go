@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"fmt"
+)
+
+// Claims are JWT claims of the connection captured on authentication.
+type Claims map[string]interface{}
+
+// ClaimRule checks one claim: Equals compares the claim value, Contains looks for the value in a list claim,
+// In checks that the claim value is one of the listed values.
+type ClaimRule struct {
+	Claim    string   `json:"claim"`
+	Equals   *string  `json:"equals"`
+	Contains *string  `json:"contains"`
+	In       []string `json:"in"`
+}
+
+// AuthPolicy allows access if all rules of AllOf and at least one rule of AnyOf (if any) are satisfied.
+type AuthPolicy struct {
+	AllOf []ClaimRule `json:"allOf"`
+	AnyOf []ClaimRule `json:"anyOf"`
+}
+
+func (r *ClaimRule) Validate() error {
+
+	if r.Claim == "" {
+		return fmt.Errorf("claim is required")
+	}
+
+	conditions := 0
+	if r.Equals != nil {
+		conditions++
+	}
+
+	if r.Contains != nil {
+		conditions++
+	}
+
+	if r.In != nil {
+		conditions++
+	}
+
+	if conditions != 1 {
+		return fmt.Errorf("claim %v: exactly one of equals, contains, in is required", r.Claim)
+	}
+
+	return nil
+}
+
+func (r *ClaimRule) IsSatisfied(claims Claims) bool {
+
+	value, ok := claims[r.Claim]
+	if !ok || value == nil {
+		return false
+	}
+
+	switch {
+	case r.Equals != nil:
+		return claimToString(value) == *r.Equals
+
+	case r.Contains != nil:
+		values, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+
+		for _, item := range values {
+			if claimToString(item) == *r.Contains {
+				return true
+			}
+		}
+
+	case r.In != nil:
+		for _, item := range r.In {
+			if claimToString(value) == item {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p *AuthPolicy) Validate() error {
+
+	for i := range p.AllOf {
+		err := p.AllOf[i].Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range p.AnyOf {
+		err := p.AnyOf[i].Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *AuthPolicy) IsAllowed(claims Claims) bool {
+
+	for i := range p.AllOf {
+		if !p.AllOf[i].IsSatisfied(claims) {
+			return false
+		}
+	}
+
+	if len(p.AnyOf) == 0 {
+		return true
+	}
+
+	for i := range p.AnyOf {
+		if p.AnyOf[i].IsSatisfied(claims) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func claimToString(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func TestAuthPolicyIsAllowed(t *testing.T) {
+
+	var claims Claims
+	err := json.Unmarshal([]byte(`{"tenant": "acme", "roles": ["user", "admin"], "level": 3, "plan": "pro", "empty": null}`), &claims)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		policy  string
+		allowed bool
+	}{
+		{"no rules", `{}`, true},
+		{"equals", `{"allOf": [{"claim": "tenant", "equals": "acme"}]}`, true},
+		{"not equals", `{"allOf": [{"claim": "tenant", "equals": "other"}]}`, false},
+		{"number equals", `{"allOf": [{"claim": "level", "equals": "3"}]}`, true},
+		{"contains", `{"allOf": [{"claim": "roles", "contains": "admin"}]}`, true},
+		{"not contains", `{"allOf": [{"claim": "roles", "contains": "owner"}]}`, false},
+		{"contains of not a list", `{"allOf": [{"claim": "tenant", "contains": "acme"}]}`, false},
+		{"in", `{"allOf": [{"claim": "plan", "in": ["pro", "team"]}]}`, true},
+		{"not in", `{"allOf": [{"claim": "plan", "in": ["team"]}]}`, false},
+		{"missing claim", `{"allOf": [{"claim": "locale", "equals": "en"}]}`, false},
+		{"null claim", `{"allOf": [{"claim": "empty", "equals": "<nil>"}]}`, false},
+		{"any of", `{"anyOf": [{"claim": "roles", "contains": "owner"}, {"claim": "plan", "equals": "pro"}]}`, true},
+		{"none of any of", `{"anyOf": [{"claim": "roles", "contains": "owner"}, {"claim": "plan", "equals": "team"}]}`, false},
+		{"all of and any of", `{"allOf": [{"claim": "tenant", "equals": "acme"}], "anyOf": [{"claim": "roles", "contains": "admin"}]}`, true},
+		{"failed all of", `{"allOf": [{"claim": "tenant", "equals": "other"}], "anyOf": [{"claim": "roles", "contains": "admin"}]}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var policy AuthPolicy
+			err := json.Unmarshal([]byte(test.policy), &policy)
+			if err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+
+			if allowed := policy.IsAllowed(claims); allowed != test.allowed {
+				t.Errorf("IsAllowed() = %v, want %v", allowed, test.allowed)
+			}
+
+			if policy.IsAllowed(nil) && (len(policy.AllOf) > 0 || len(policy.AnyOf) > 0) {
+				t.Errorf("connection without claims is allowed")
+			}
+		})
+	}
+}
+
+func TestAuthPolicyValidate(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		policy string
+		valid  bool
+	}{
+		{"valid", `{"allOf": [{"claim": "tenant", "equals": "acme"}], "anyOf": [{"claim": "plan", "in": []}]}`, true},
+		{"no claim", `{"allOf": [{"equals": "acme"}]}`, false},
+		{"no condition", `{"anyOf": [{"claim": "tenant"}]}`, false},
+		{"two conditions", `{"anyOf": [{"claim": "roles", "equals": "admin", "contains": "admin"}]}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var policy AuthPolicy
+			err := json.Unmarshal([]byte(test.policy), &policy)
+			if err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+
+			err = policy.Validate()
+			if (err == nil) != test.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestServerEndpointPolicy(t *testing.T) {
+
+	admin := "admin"
+	server, cubeInstance := newRoutedServer(t, ServerConfig{}, EndpointConfig{
+		Name:    "admin",
+		Channel: "adminChannel",
+		Policy:  &AuthPolicy{AnyOf: []ClaimRule{{Claim: "roles", Contains: &admin}}},
+	})
+
+	body := []byte(`{"endpoint": "admin", "requestId": "1", "payload": {"text": "hi"}}`)
+
+	anonymous, anonymousClient := newSocketConnection(t, 1)
+	server.onReceiveMessage(anonymous, true, &body)
+
+	if frame := readFrame(t, anonymousClient); frame.Code != js.ERROR_UNAUTHORIZED || frame.RequestId != "1" {
+		t.Errorf("anonymous connection is answered with %+v", frame)
+	}
+
+	user, userClient := newSocketConnection(t, 2)
+	user.Login("user", "phone", "", Claims{"roles": []interface{}{"user"}})
+	server.onReceiveMessage(user, true, &body)
+
+	if frame := readFrame(t, userClient); frame.Code != js.ERROR_FORBIDDEN || frame.RequestId != "1" {
+		t.Errorf("connection without the role is answered with %+v", frame)
+	}
+
+	if messages := cubeInstance.bus.Messages("adminChannel"); len(messages) != 0 {
+		t.Errorf("denied messages are published: %v", len(messages))
+	}
+
+	if unauthorized, forbidden := server.metrics.Get("messages.unauthorized"), server.metrics.Get("messages.forbidden"); unauthorized != 1 || forbidden != 1 {
+		t.Errorf("messages.unauthorized = %v, messages.forbidden = %v", unauthorized, forbidden)
+	}
+
+	owner, ownerClient := newSocketConnection(t, 3)
+	owner.Login("owner", "laptop", "", Claims{"roles": []interface{}{"user", "admin"}})
+	server.onReceiveMessage(owner, true, &body)
+
+	if frame := readFrame(t, ownerClient); frame.Type != js.ACK_FRAME || frame.RequestId != "1" {
+		t.Errorf("allowed message is answered with %+v", frame)
+	}
+
+	if messages := cubeInstance.bus.Messages("adminChannel"); len(messages) != 1 || messages[0].Method != "onTextMessage" {
+		t.Errorf("allowed message isn't published: %v", messages)
+	}
+}
@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+// taskQueue runs tasks one by one in the order they were pushed, so callers holding locks
+// don't wait for the bus or for client sockets.
+type taskQueue struct {
+	mutex  sync.Mutex
+	tasks  []func()
+	signal chan struct{}
+}
+
+func newTaskQueue() *taskQueue {
+	return &taskQueue{
+		mutex:  sync.Mutex{},
+		tasks:  []func(){},
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func (q *taskQueue) Push(task func()) {
+	q.mutex.Lock()
+	q.tasks = append(q.tasks, task)
+	q.mutex.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (q *taskQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.tasks)
+}
+
+func (q *taskQueue) Run() {
+	for range q.signal {
+		for {
+			q.mutex.Lock()
+			if len(q.tasks) == 0 {
+				q.mutex.Unlock()
+				break
+			}
+
+			task := q.tasks[0]
+			q.tasks[0] = nil
+			q.tasks = q.tasks[1:]
+			q.mutex.Unlock()
+
+			task()
+		}
+	}
+}
+
+// presenceEvents turns the first and the last connections of users and devices into online/offline events.
+// Offline events are delayed by the grace period and dropped if the user comes back in time.
+// emit is called under the lock, so it must not block.
+type presenceEvents struct {
+	mutex       sync.Mutex
+	gracePeriod time.Duration
+	pending     map[presenceKey]*time.Timer
+	emit        func(change UserChange, changedAt time.Time)
+}
+
+func newPresenceEvents(gracePeriod time.Duration, emit func(change UserChange, changedAt time.Time)) *presenceEvents {
+	return &presenceEvents{
+		mutex:       sync.Mutex{},
+		gracePeriod: gracePeriod,
+		pending:     map[presenceKey]*time.Timer{},
+		emit:        emit,
+	}
+}
+
+func (p *presenceEvents) onChange(change UserChange) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	key := presenceKey{tenantId: change.TenantId, userId: change.UserId, deviceId: change.DeviceId}
+
+	if change.Online {
+		timer, ok := p.pending[key]
+		if ok {
+			timer.Stop()
+			delete(p.pending, key)
+			return
+		}
+
+		p.emit(change, now)
+		return
+	}
+
+	if p.gracePeriod <= 0 {
+		p.emit(change, now)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(p.gracePeriod, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		if p.pending[key] != timer {
+			return
+		}
+
+		delete(p.pending, key)
+		p.emit(change, now)
+	})
+
+	p.pending[key] = timer
+}
+
+// onUserChange is called while the connections storage reports changes, announcements are published
+// by the announce queue and events by the presence queue, so logins and logouts don't wait for the bus or watchers.
+func (s *Server) onUserChange(change UserChange) {
+
+	s.metrics.Set("cluster.users", int64(change.NumberOfUsers))
+	s.metrics.Set("presence.devices", int64(change.NumberOfDevices))
+
+	s.announceQueue.Push(func() {
+		s.announceUser(change)
+	})
+
+	s.metrics.Set("cluster.queued", int64(s.announceQueue.Len()))
+
+	s.presenceEvents.onChange(change)
+}
+
+func (s *Server) queuePresenceEvent(change UserChange, changedAt time.Time) {
+	s.presenceQueue.Push(func() {
+		s.onPresenceEvent(change, changedAt)
+	})
+
+	s.metrics.Set("presence.queued", int64(s.presenceQueue.Len()))
+}
+
+func (s *Server) onPresenceEvent(change UserChange, changedAt time.Time) {
+
+	s.publishPresenceEvent(change, changedAt)
+
+	if change.DeviceId == "" {
+		s.notifyPresenceWatchers(change)
+	}
+}
+
+// publishPresenceEvent publishes "onUserOnline", "onUserOffline", "onDeviceOnline" or "onDeviceOffline",
+// device events are published only to a separate presence channel.
+func (s *Server) publishPresenceEvent(change UserChange, changedAt time.Time) {
+
+	if change.DeviceId != "" && s.presenceChannel == "" {
+		return
+	}
+
+	channel := s.presenceChannel
+	if channel == "" {
+		channel = cube.Channel("wsOutput")
+	}
+
+	method := ""
+	switch {
+	case change.DeviceId == "" && change.Online:
+		method = "onUserOnline"
+	case change.DeviceId == "":
+		method = "onUserOffline"
+	case change.Online:
+		method = "onDeviceOnline"
+	default:
+		method = "onDeviceOffline"
+	}
+
+	packedParams, _ := json.Marshal(js.PresenceEventParams{
+		UserId:   string(change.UserId),
+		DeviceId: string(change.DeviceId),
+		Time:     changedAt.UnixNano(),
+	})
+
+	s.publish(TenantChannel(channel, change.TenantId), cube.Message{
+		Method: method,
+		Params: (*json.RawMessage)(&packedParams),
+	})
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akaumov/cube"
+)
+
+// presenceRecorder keeps emitted presence events as "user/device online" strings.
+type presenceRecorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *presenceRecorder) emit(change UserChange, changedAt time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state := "offline"
+	if change.Online {
+		state = "online"
+	}
+
+	r.events = append(r.events, fmt.Sprintf("%v/%v %v", change.UserId, change.DeviceId, state))
+}
+
+func (r *presenceRecorder) Events() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return fmt.Sprint(r.events)
+}
+
+func TestPresenceEventsWithoutGracePeriod(t *testing.T) {
+
+	recorder := &presenceRecorder{}
+	events := newPresenceEvents(0, recorder.emit)
+
+	events.onChange(UserChange{UserId: "user", Online: true})
+	events.onChange(UserChange{UserId: "user", Online: false})
+	events.onChange(UserChange{UserId: "user", Online: true})
+
+	if emitted := recorder.Events(); emitted != "[user/ online user/ offline user/ online]" {
+		t.Errorf("events = %v", emitted)
+	}
+}
+
+func TestPresenceEventsGracePeriod(t *testing.T) {
+
+	recorder := &presenceRecorder{}
+	events := newPresenceEvents(50*time.Millisecond, recorder.emit)
+
+	events.onChange(UserChange{UserId: "user", Online: true})
+	events.onChange(UserChange{UserId: "user", DeviceId: "phone", Online: true})
+
+	// The user reconnects in time, so neither the offline nor the second online event is published.
+	events.onChange(UserChange{UserId: "user", Online: false})
+	events.onChange(UserChange{UserId: "user", DeviceId: "phone", Online: false})
+	events.onChange(UserChange{UserId: "user", Online: true})
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The device doesn't come back, its offline event is published after the grace period.
+	if emitted := recorder.Events(); emitted != "[user/ online user/phone online user/phone offline]" {
+		t.Fatalf("events after reconnect = %v", emitted)
+	}
+
+	events.onChange(UserChange{UserId: "user", Online: false})
+	if emitted := recorder.Events(); emitted != "[user/ online user/phone online user/phone offline]" {
+		t.Errorf("offline event isn't delayed: %v", emitted)
+	}
+
+	waitFor(t, "offline event", func() bool {
+		return recorder.Events() == "[user/ online user/phone online user/phone offline user/ offline]"
+	})
+
+	events.mutex.Lock()
+	pending := len(events.pending)
+	events.mutex.Unlock()
+
+	if pending != 0 {
+		t.Errorf("%v timers are left", pending)
+	}
+}
+
+func TestServerPresenceEvents(t *testing.T) {
+
+	cubeInstance := newBusCube(newMemoryBus(), "A")
+	server, err := NewServer(cubeInstance, ServerConfig{PresenceGracePeriod: 50 * time.Millisecond, PresenceChannel: "presence"})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	go server.presenceQueue.Run()
+
+	methods := func() string {
+		result := []string{}
+		for _, message := range cubeInstance.bus.Messages("presence") {
+			result = append(result, message.Method)
+		}
+
+		return fmt.Sprint(result)
+	}
+
+	phone := newLoggedConnection(1, "user", "phone")
+	server.connections.AddNewConnection(phone)
+	server.connections.RemoveConnection(phone)
+
+	reconnected := newLoggedConnection(2, "user", "phone")
+	server.connections.AddNewConnection(reconnected)
+
+	waitFor(t, "online events", func() bool {
+		return methods() == "[onUserOnline onDeviceOnline]"
+	})
+
+	server.connections.RemoveConnection(reconnected)
+
+	waitFor(t, "offline events", func() bool {
+		return methods() == "[onUserOnline onDeviceOnline onUserOffline onDeviceOffline]" ||
+			methods() == "[onUserOnline onDeviceOnline onDeviceOffline onUserOffline]"
+	})
+
+	if messages := cubeInstance.bus.Messages(cube.Channel("wsOutput")); len(messages) != 0 {
+		t.Errorf("presence events are published to wsOutput with presence channel")
+	}
+}
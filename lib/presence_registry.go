@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultPresenceInterval = 10 * time.Second
+
+// Nodes which missed this number of snapshots are considered dead.
+const presenceMissedSnapshots = 3
+
+type presenceNode struct {
+	channel  string
+	lastSeen time.Time
+	users    map[presenceKey]bool
+	// tenants counts tenants of every user of the node.
+	tenants map[UserId]int
+
+	snapshotId     uint64
+	snapshotChunks map[int]bool
+	snapshotUsers  map[presenceKey]bool
+}
+
+// NodeInfo is a gateway instance holding a user.
+type NodeInfo struct {
+	InstanceId string
+	Channel    string
+}
+
+// PresenceRegistry keeps users of other gateway nodes. It is updated by deltas and replaced by snapshots
+// of the nodes, only snapshots keep nodes alive, so nodes which stop sending them expire with all their users.
+type PresenceRegistry struct {
+	mutex sync.RWMutex
+	nodes map[string]*presenceNode
+	ttl   time.Duration
+}
+
+func NewPresenceRegistry(ttl time.Duration) *PresenceRegistry {
+	return &PresenceRegistry{
+		mutex: sync.RWMutex{},
+		nodes: map[string]*presenceNode{},
+		ttl:   ttl,
+	}
+}
+
+func (r *PresenceRegistry) getNode(instanceId string, channel string) *presenceNode {
+
+	node := r.nodes[instanceId]
+	if node == nil {
+		node = &presenceNode{lastSeen: time.Now(), users: map[presenceKey]bool{}, tenants: map[UserId]int{}}
+		r.nodes[instanceId] = node
+	}
+
+	node.channel = channel
+	return node
+}
+
+func (r *PresenceRegistry) SetUser(instanceId string, channel string, tenantId TenantId, userId UserId, online bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	node := r.getNode(instanceId, channel)
+	key := presenceKey{tenantId: tenantId, userId: userId}
+
+	if online && !node.users[key] {
+		node.users[key] = true
+		node.tenants[userId]++
+	}
+
+	if !online && node.users[key] {
+		delete(node.users, key)
+
+		node.tenants[userId]--
+		if node.tenants[userId] <= 0 {
+			delete(node.tenants, userId)
+		}
+	}
+}
+
+func (n *presenceNode) setUsers(users map[presenceKey]bool) {
+
+	n.users = users
+	n.tenants = make(map[UserId]int, len(users))
+
+	for key := range users {
+		n.tenants[key.userId]++
+	}
+}
+
+// hasUser checks the user in the tenant or in any tenant if tenant is empty.
+func (n *presenceNode) hasUser(tenantId TenantId, userId UserId) bool {
+
+	if tenantId == "" {
+		return n.tenants[userId] > 0
+	}
+
+	return n.users[presenceKey{tenantId: tenantId, userId: userId}]
+}
+
+// SetSnapshotChunk keeps the chunk of the snapshot and replaces users of the node when all chunks of the snapshot
+// have arrived, chunks of an older snapshot are dropped. Every chunk refreshes the node.
+func (r *PresenceRegistry) SetSnapshotChunk(instanceId string, channel string, snapshotId uint64, chunk int, chunks int,
+	users []presenceKey) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	node := r.getNode(instanceId, channel)
+	node.lastSeen = time.Now()
+
+	if chunks <= 1 {
+		snapshotUsers := make(map[presenceKey]bool, len(users))
+		for _, key := range users {
+			snapshotUsers[key] = true
+		}
+
+		node.setUsers(snapshotUsers)
+		node.snapshotChunks = nil
+		node.snapshotUsers = nil
+		return
+	}
+
+	if chunk < 0 || chunk >= chunks || (node.snapshotChunks != nil && snapshotId < node.snapshotId) {
+		return
+	}
+
+	if node.snapshotChunks == nil || snapshotId != node.snapshotId {
+		node.snapshotId = snapshotId
+		node.snapshotChunks = map[int]bool{}
+		node.snapshotUsers = map[presenceKey]bool{}
+	}
+
+	node.snapshotChunks[chunk] = true
+	for _, key := range users {
+		node.snapshotUsers[key] = true
+	}
+
+	if len(node.snapshotChunks) == chunks {
+		node.setUsers(node.snapshotUsers)
+		node.snapshotChunks = nil
+		node.snapshotUsers = nil
+	}
+}
+
+func (r *PresenceRegistry) RemoveNode(instanceId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.nodes, instanceId)
+}
+
+// RemoveExpired removes nodes which haven't been seen for ttl and returns their number.
+func (r *PresenceRegistry) RemoveExpired() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	removed := 0
+
+	for instanceId, node := range r.nodes {
+		if now.Sub(node.lastSeen) > r.ttl {
+			delete(r.nodes, instanceId)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// GetUserNodes returns nodes holding the user sorted by instance id, users of any tenant are matched if tenant is empty.
+func (r *PresenceRegistry) GetUserNodes(tenantId TenantId, userId UserId) []NodeInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	now := time.Now()
+	nodes := []NodeInfo{}
+
+	for instanceId, node := range r.nodes {
+		if node.hasUser(tenantId, userId) && now.Sub(node.lastSeen) <= r.ttl {
+			nodes = append(nodes, NodeInfo{InstanceId: instanceId, Channel: node.channel})
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].InstanceId < nodes[j].InstanceId
+	})
+
+	return nodes
+}
+
+func (r *PresenceRegistry) Size() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.nodes)
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func registryUsers(registry *PresenceRegistry, instanceId string) map[presenceKey]bool {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	node := registry.nodes[instanceId]
+	if node == nil {
+		return nil
+	}
+
+	return node.users
+}
+
+func TestPresenceRegistrySnapshotChunks(t *testing.T) {
+
+	registry := NewPresenceRegistry(time.Minute)
+	registry.SetUser("A", "wsNode.A", "", "old", true)
+
+	registry.SetSnapshotChunk("A", "wsNode.A", 1, 0, 2, []presenceKey{{userId: "u1"}})
+	if users := registryUsers(registry, "A"); !reflect.DeepEqual(users, map[presenceKey]bool{{userId: "old"}: true}) {
+		t.Errorf("users are replaced before all chunks arrived: %v", users)
+	}
+
+	registry.SetSnapshotChunk("A", "wsNode.A", 1, 1, 2, []presenceKey{{userId: "u2"}})
+	expected := map[presenceKey]bool{{userId: "u1"}: true, {userId: "u2"}: true}
+	if users := registryUsers(registry, "A"); !reflect.DeepEqual(users, expected) {
+		t.Errorf("users = %v, want %v", users, expected)
+	}
+
+	// Chunks of a newer snapshot replace an incomplete one, chunks of older snapshots are dropped.
+	registry.SetSnapshotChunk("A", "wsNode.A", 3, 0, 2, []presenceKey{{userId: "u3"}})
+	registry.SetSnapshotChunk("A", "wsNode.A", 4, 1, 2, []presenceKey{{userId: "u4"}})
+	registry.SetSnapshotChunk("A", "wsNode.A", 3, 1, 2, []presenceKey{{userId: "u5"}})
+	registry.SetSnapshotChunk("A", "wsNode.A", 4, 0, 2, []presenceKey{{userId: "u6"}})
+
+	expected = map[presenceKey]bool{{userId: "u4"}: true, {userId: "u6"}: true}
+	if users := registryUsers(registry, "A"); !reflect.DeepEqual(users, expected) {
+		t.Errorf("users = %v, want %v", users, expected)
+	}
+
+	registry.SetSnapshotChunk("A", "wsNode.A", 5, 2, 2, []presenceKey{{userId: "u7"}})
+	if users := registryUsers(registry, "A"); users[presenceKey{userId: "u7"}] {
+		t.Errorf("chunk with wrong index is applied")
+	}
+
+	registry.SetSnapshotChunk("A", "wsNode.A", 0, 0, 0, []presenceKey{{userId: "u8"}})
+	if users := registryUsers(registry, "A"); !reflect.DeepEqual(users, map[presenceKey]bool{{userId: "u8"}: true}) {
+		t.Errorf("snapshot without chunks isn't applied: %v", users)
+	}
+}
+
+func TestPresenceRegistryLiveness(t *testing.T) {
+
+	registry := NewPresenceRegistry(time.Minute)
+	registry.SetSnapshotChunk("A", "wsNode.A", 1, 0, 1, []presenceKey{{userId: "user"}})
+	registry.nodes["A"].lastSeen = time.Now().Add(-2 * time.Minute)
+
+	// Deltas don't keep the node alive.
+	registry.SetUser("A", "wsNode.A", "", "other", true)
+
+	if nodes := registry.GetUserNodes("", "user"); len(nodes) != 0 {
+		t.Errorf("users of the expired node are returned: %v", nodes)
+	}
+
+	if registry.RemoveExpired() != 1 || registry.Size() != 0 {
+		t.Errorf("node refreshed only by deltas isn't removed")
+	}
+
+	registry.SetUser("B", "wsNode.B", "", "user", true)
+	if nodes := registry.GetUserNodes("", "user"); !reflect.DeepEqual(nodes, []NodeInfo{{InstanceId: "B", Channel: "wsNode.B"}}) {
+		t.Errorf("user of the new node isn't returned: %v", nodes)
+	}
+}
+
+func TestPresenceSnapshotsInChunks(t *testing.T) {
+
+	bus := newMemoryBus()
+	nodeA := newClusterNode(t, bus, "A")
+	nodeB := newClusterNode(t, bus, "B")
+
+	numberOfUsers := presenceSnapshotChunkSize*2 + 1
+	for i := 0; i < numberOfUsers; i++ {
+		connection := newLoggedConnection(ConnectionId(i+1), UserId(fmt.Sprintf("user%v", i)), "phone")
+		nodeA.connections.AddNewConnection(connection)
+	}
+
+	waitFor(t, "users attached to node A", func() bool {
+		return nodeA.announceQueue.Len() == 0 && len(registryUsers(nodeB.presence, "A")) == numberOfUsers
+	})
+
+	// The snapshot removes users which node B kept because their detach was lost.
+	nodeB.presence.SetUser("A", "wsNode.A", "", "ghost", true)
+	nodeA.publishPresenceSnapshot(1)
+
+	chunks := 0
+	for _, message := range bus.Messages(DefaultNodeEventsChannel) {
+		if message.Method == "onNodeSnapshot" {
+			chunks++
+		}
+	}
+
+	if chunks != 3 {
+		t.Errorf("snapshot is sent in %v messages, want 3", chunks)
+	}
+
+	if users := registryUsers(nodeB.presence, "A"); len(users) != numberOfUsers || users[presenceKey{userId: "ghost"}] {
+		t.Errorf("node B has %v users of node A, want %v", len(users), numberOfUsers)
+	}
+}
+
+func TestPresenceRegistryAnyTenant(t *testing.T) {
+
+	registry := NewPresenceRegistry(time.Minute)
+	registry.SetUser("A", "wsNode.A", "acme", "user", true)
+	registry.SetUser("A", "wsNode.A", "other", "user", true)
+	registry.SetUser("A", "wsNode.A", "acme", "user", true)
+
+	expected := []NodeInfo{{InstanceId: "A", Channel: "wsNode.A"}}
+	if nodes := registry.GetUserNodes("", "user"); !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("user of tenants isn't found in any tenant: %v", nodes)
+	}
+
+	registry.SetUser("A", "wsNode.A", "acme", "user", false)
+	if nodes := registry.GetUserNodes("", "user"); !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("user is lost while connected in another tenant: %v", nodes)
+	}
+
+	registry.SetSnapshotChunk("A", "wsNode.A", 1, 0, 1, []presenceKey{{tenantId: "acme", userId: "other"}})
+	if nodes := registry.GetUserNodes("", "user"); len(nodes) != 0 {
+		t.Errorf("user removed by the snapshot is found: %v", nodes)
+	}
+
+	if nodes := registry.GetUserNodes("", "other"); !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("user of the snapshot isn't found in any tenant: %v", nodes)
+	}
+}
@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"errors"
+	"sync"
+)
+
+const DefaultMaxPresenceWatches = 100
+
+var ErrorTooManyWatches = errors.New("gateway: too many presence watches")
+
+// presenceOutbox keeps the latest presence of users watched by a connection until it is written, so a slow client
+// delays only its own frames and has at most one pending frame per watched user.
+type presenceOutbox struct {
+	mutex   sync.Mutex
+	pending map[UserId]bool
+	order   []UserId
+	sending bool
+}
+
+// push returns true if the caller has to start sending frames of the outbox.
+func (o *presenceOutbox) push(userId UserId, online bool) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.pending == nil {
+		o.pending = map[UserId]bool{}
+	}
+
+	_, ok := o.pending[userId]
+	if !ok {
+		o.order = append(o.order, userId)
+	}
+
+	o.pending[userId] = online
+
+	if o.sending {
+		return false
+	}
+
+	o.sending = true
+	return true
+}
+
+// next returns the oldest pending presence, sending stops when there is nothing left.
+func (o *presenceOutbox) next() (UserId, bool, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.order) == 0 {
+		o.sending = false
+		return "", false, false
+	}
+
+	userId := o.order[0]
+	o.order = o.order[1:]
+
+	online := o.pending[userId]
+	delete(o.pending, userId)
+
+	return userId, online, true
+}
+
+// PresenceWatches keeps users watched by connections, users are watched within the tenant of the connection.
+type PresenceWatches struct {
+	mutex    sync.RWMutex
+	watchers map[presenceKey]map[ConnectionId]bool
+	watched  map[ConnectionId]map[presenceKey]bool
+}
+
+func NewPresenceWatches() *PresenceWatches {
+	return &PresenceWatches{
+		mutex:    sync.RWMutex{},
+		watchers: map[presenceKey]map[ConnectionId]bool{},
+		watched:  map[ConnectionId]map[presenceKey]bool{},
+	}
+}
+
+// Watch adds users to the watch list of the connection, nothing is added if the list would exceed max.
+func (w *PresenceWatches) Watch(connectionId ConnectionId, tenantId TenantId, userIds []UserId, max int) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	watched := w.watched[connectionId]
+	if watched == nil {
+		watched = map[presenceKey]bool{}
+	}
+
+	newKeys := map[presenceKey]bool{}
+	for _, userId := range userIds {
+		key := presenceKey{tenantId: tenantId, userId: userId}
+		if !watched[key] {
+			newKeys[key] = true
+		}
+	}
+
+	if len(watched)+len(newKeys) > max {
+		return ErrorTooManyWatches
+	}
+
+	for key := range newKeys {
+		watched[key] = true
+
+		connections := w.watchers[key]
+		if connections == nil {
+			connections = map[ConnectionId]bool{}
+			w.watchers[key] = connections
+		}
+
+		connections[connectionId] = true
+	}
+
+	if len(watched) > 0 {
+		w.watched[connectionId] = watched
+	}
+
+	return nil
+}
+
+// Unwatch removes users from the watch list of the connection, all users are removed if userIds is empty.
+func (w *PresenceWatches) Unwatch(connectionId ConnectionId, tenantId TenantId, userIds []UserId) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(userIds) == 0 {
+		w.removeConnection(connectionId)
+		return
+	}
+
+	watched := w.watched[connectionId]
+	for _, userId := range userIds {
+		key := presenceKey{tenantId: tenantId, userId: userId}
+		delete(watched, key)
+		w.removeWatcher(key, connectionId)
+	}
+
+	if len(watched) == 0 {
+		delete(w.watched, connectionId)
+	}
+}
+
+func (w *PresenceWatches) RemoveConnection(connectionId ConnectionId) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.removeConnection(connectionId)
+}
+
+func (w *PresenceWatches) removeConnection(connectionId ConnectionId) {
+
+	for key := range w.watched[connectionId] {
+		w.removeWatcher(key, connectionId)
+	}
+
+	delete(w.watched, connectionId)
+}
+
+func (w *PresenceWatches) removeWatcher(key presenceKey, connectionId ConnectionId) {
+
+	connections := w.watchers[key]
+	delete(connections, connectionId)
+
+	if len(connections) == 0 {
+		delete(w.watchers, key)
+	}
+}
+
+func (w *PresenceWatches) GetWatchers(tenantId TenantId, userId UserId) []ConnectionId {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	connections := w.watchers[presenceKey{tenantId: tenantId, userId: userId}]
+
+	watchers := make([]ConnectionId, 0, len(connections))
+	for connectionId := range connections {
+		watchers = append(watchers, connectionId)
+	}
+
+	return watchers
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func TestPresenceOutbox(t *testing.T) {
+
+	outbox := presenceOutbox{}
+
+	if !outbox.push("a", true) {
+		t.Fatalf("first push doesn't start sending")
+	}
+
+	if outbox.push("b", true) || outbox.push("a", false) {
+		t.Errorf("push starts sending twice")
+	}
+
+	userId, online, ok := outbox.next()
+	if !ok || userId != "a" || online {
+		t.Errorf("next() = %v, %v, %v, want the latest presence of a", userId, online, ok)
+	}
+
+	userId, online, ok = outbox.next()
+	if !ok || userId != "b" || !online {
+		t.Errorf("next() = %v, %v, %v, want b online", userId, online, ok)
+	}
+
+	if _, _, ok = outbox.next(); ok {
+		t.Errorf("empty outbox returns presence")
+	}
+
+	if !outbox.push("c", true) {
+		t.Errorf("push to a drained outbox doesn't start sending")
+	}
+}
+
+func TestSlowWatcher(t *testing.T) {
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	slow, slowClient := newSocketLoggedConnection(t, 1, "slow", "phone")
+	fast, fastClient := newSocketLoggedConnection(t, 2, "fast", "phone")
+
+	for _, connection := range []*Connection{slow, fast} {
+		server.connections.AddNewConnection(connection)
+		server.presenceWatches.Watch(connection.id, "", []UserId{"user"}, DefaultMaxPresenceWatches)
+	}
+
+	// The slow client doesn't take its frames until the lock is released.
+	slow.writeMutex.Lock()
+
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+		server.notifyPresenceWatchers(UserChange{UserId: "user", Online: true})
+	}()
+
+	select {
+	case <-notified:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("slow watcher blocks notifications")
+	}
+
+	frame := readFrame(t, fastClient)
+	if frame.Type != js.PRESENCE_FRAME || frame.UserId != "user" || !*frame.Online {
+		t.Errorf("fast watcher got %+v", frame)
+	}
+
+	waitFor(t, "first frame taken by the slow watcher", func() bool {
+		slow.presenceOutbox.mutex.Lock()
+		defer slow.presenceOutbox.mutex.Unlock()
+
+		return len(slow.presenceOutbox.order) == 0
+	})
+
+	// Changes are kept while the slow client is busy, only the latest one is sent.
+	server.notifyPresenceWatchers(UserChange{UserId: "user", Online: false})
+	server.notifyPresenceWatchers(UserChange{UserId: "user", Online: true})
+	server.notifyPresenceWatchers(UserChange{UserId: "user", Online: false})
+
+	slow.writeMutex.Unlock()
+
+	for _, online := range []bool{true, false} {
+		frame = readFrame(t, slowClient)
+		if frame.Type != js.PRESENCE_FRAME || frame.UserId != "user" || *frame.Online != online {
+			t.Errorf("slow watcher got %+v, want online %v", frame, online)
+		}
+	}
+
+	expectNoFrame(t, slowClient)
+}
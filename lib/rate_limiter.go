@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket, rate is in tokens per second.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		mutex:  sync.Mutex{},
+		rate:   rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *RateLimiter) Allow() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
+
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
+
+func (l *RateLimiter) hasLimits(rate float64, burst int) bool {
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return l.rate == rate && l.burst == burst
+}
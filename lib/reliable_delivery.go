@@ -0,0 +1,314 @@
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+const (
+	DefaultDeliveryRetryInterval = 2 * time.Second
+	DefaultDeliveryMaxAttempts   = 5
+	maxDeliveryRetryInterval     = time.Minute
+)
+
+var ErrorConnectionClosed = errors.New("gateway: connection is closed")
+
+type pendingDelivery struct {
+	id           uint64
+	connectionId ConnectionId
+	tenantId     TenantId
+	userId       UserId
+	deviceId     DeviceId
+	entry        sessionEntry
+	attempts     int
+	timer        *time.Timer
+}
+
+// Deliveries keeps reliable messages which haven't been acknowledged by clients yet.
+type Deliveries struct {
+	mutex         sync.Mutex
+	lastId        uint64
+	pending       map[uint64]*pendingDelivery
+	byConnection  map[ConnectionId]map[uint64]bool
+	retryInterval time.Duration
+	maxAttempts   int
+}
+
+func NewDeliveries(retryInterval time.Duration, maxAttempts int) *Deliveries {
+
+	if retryInterval <= 0 {
+		retryInterval = DefaultDeliveryRetryInterval
+	}
+
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultDeliveryMaxAttempts
+	}
+
+	return &Deliveries{
+		mutex:         sync.Mutex{},
+		pending:       map[uint64]*pendingDelivery{},
+		byConnection:  map[ConnectionId]map[uint64]bool{},
+		retryInterval: retryInterval,
+		maxAttempts:   maxAttempts,
+	}
+}
+
+// backoff doubles the retry interval after every attempt.
+func (d *Deliveries) backoff(attempts int) time.Duration {
+
+	interval := d.retryInterval
+	for i := 1; i < attempts && interval < maxDeliveryRetryInterval; i++ {
+		interval *= 2
+	}
+
+	if interval > maxDeliveryRetryInterval {
+		interval = maxDeliveryRetryInterval
+	}
+
+	return interval
+}
+
+// Add registers the first attempt of the delivery, retry is called when the delivery isn't acknowledged in time.
+func (d *Deliveries) Add(connection *Connection, entry sessionEntry, retry func(deliveryId uint64)) uint64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	connectionId, userId, deviceId := connection.GetInfo()
+
+	d.lastId++
+	delivery := &pendingDelivery{
+		id:           d.lastId,
+		connectionId: connectionId,
+		tenantId:     connection.GetTenant(),
+		userId:       userId,
+		deviceId:     deviceId,
+		entry:        entry,
+		attempts:     1,
+	}
+
+	delivery.timer = time.AfterFunc(d.backoff(1), func() {
+		retry(delivery.id)
+	})
+
+	d.pending[delivery.id] = delivery
+
+	connectionDeliveries := d.byConnection[connectionId]
+	if connectionDeliveries == nil {
+		connectionDeliveries = map[uint64]bool{}
+		d.byConnection[connectionId] = connectionDeliveries
+	}
+
+	connectionDeliveries[delivery.id] = true
+	return delivery.id
+}
+
+// NextAttempt counts the retry of the delivery, it returns nil and removes the delivery if it has been acknowledged
+// or failed is true if no attempts are left or the message has expired.
+func (d *Deliveries) NextAttempt(deliveryId uint64, retry func(deliveryId uint64)) (delivery *pendingDelivery, failed bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delivery = d.pending[deliveryId]
+	if delivery == nil {
+		return nil, false
+	}
+
+	if delivery.attempts >= d.maxAttempts || delivery.entry.expired(time.Now()) {
+		d.remove(delivery)
+		return delivery, true
+	}
+
+	delivery.attempts++
+	delivery.timer = time.AfterFunc(d.backoff(delivery.attempts), func() {
+		retry(deliveryId)
+	})
+
+	return delivery, false
+}
+
+// Ack removes deliveries acknowledged by the connection and returns their number.
+func (d *Deliveries) Ack(connectionId ConnectionId, deliveryIds []uint64) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	acked := 0
+	for _, deliveryId := range deliveryIds {
+		delivery := d.pending[deliveryId]
+		if delivery == nil || delivery.connectionId != connectionId {
+			continue
+		}
+
+		d.remove(delivery)
+		acked++
+	}
+
+	return acked
+}
+
+// RemoveConnection removes and returns pending deliveries of the connection.
+func (d *Deliveries) RemoveConnection(connectionId ConnectionId) []*pendingDelivery {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	removed := []*pendingDelivery{}
+	for deliveryId := range d.byConnection[connectionId] {
+		delivery := d.pending[deliveryId]
+		d.remove(delivery)
+		removed = append(removed, delivery)
+	}
+
+	return removed
+}
+
+func (d *Deliveries) remove(delivery *pendingDelivery) {
+
+	delivery.timer.Stop()
+	delete(d.pending, delivery.id)
+
+	connectionDeliveries := d.byConnection[delivery.connectionId]
+	delete(connectionDeliveries, delivery.id)
+
+	if len(connectionDeliveries) == 0 {
+		delete(d.byConnection, delivery.connectionId)
+	}
+}
+
+func (d *Deliveries) Size() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.pending)
+}
+
+// writeMessage sends the entry to the connection. Reliable messages get a delivery id and are sent as message frames,
+// text messages are sent as message frames and binary messages are prefixed with 8 bytes big endian seq.
+// writeMessage returns the write error of not reliable messages, reliable messages are retransmitted
+// or reported as failed by the delivery, so their write errors aren't returned.
+func (s *Server) writeMessage(connection *Connection, entry sessionEntry) error {
+
+	if entry.reliable {
+		if connection.IsClosed() {
+			return ErrorConnectionClosed
+		}
+
+		deliveryId := s.deliveries.Add(connection, entry, s.retryDelivery)
+
+		s.metrics.Add("delivery.sent", 1)
+		s.metrics.Set("delivery.pending", int64(s.deliveries.Size()))
+
+		s.writeReliableMessage(connection, deliveryId, entry)
+		return nil
+	}
+
+	if entry.messageType == js.BINARY {
+		data := make([]byte, 8+len(entry.message))
+		binary.BigEndian.PutUint64(data, entry.seq)
+		copy(data[8:], entry.message)
+
+		return connection.SendBinary(data)
+	}
+
+	text := string(entry.message)
+	return s.sendFrame(connection, js.Frame{
+		Type: js.MESSAGE_FRAME,
+		Seq:  entry.seq,
+		Text: &text,
+	})
+}
+
+func (s *Server) writeReliableMessage(connection *Connection, deliveryId uint64, entry sessionEntry) {
+
+	frame := js.Frame{
+		Type:       js.MESSAGE_FRAME,
+		Seq:        entry.seq,
+		DeliveryId: deliveryId,
+	}
+
+	if entry.messageType == js.BINARY {
+		frame.Binary = entry.message
+	} else {
+		text := string(entry.message)
+		frame.Text = &text
+	}
+
+	s.sendFrame(connection, frame)
+}
+
+// retryDelivery retransmits the unacknowledged message or reports it as failed.
+func (s *Server) retryDelivery(deliveryId uint64) {
+
+	delivery, failed := s.deliveries.NextAttempt(deliveryId, s.retryDelivery)
+	if delivery == nil {
+		return
+	}
+
+	if failed {
+		reason := "noAck"
+		if delivery.entry.expired(time.Now()) {
+			reason = "expired"
+		}
+
+		s.failDelivery(delivery, reason)
+		return
+	}
+
+	connection := s.connections.GetConnectionById(delivery.connectionId)
+	if connection == nil {
+		s.failConnectionDeliveries(delivery.connectionId)
+		return
+	}
+
+	s.metrics.Add("delivery.retries", 1)
+	s.writeReliableMessage(connection, deliveryId, delivery.entry)
+}
+
+func (s *Server) ackDeliveries(connection *Connection, frame *js.ControlFrame) {
+
+	connectionId, _, _ := connection.GetInfo()
+
+	acked := s.deliveries.Ack(connectionId, frame.DeliveryIds)
+	s.metrics.Add("delivery.acked", int64(acked))
+	s.metrics.Set("delivery.pending", int64(s.deliveries.Size()))
+}
+
+// failConnectionDeliveries reports pending deliveries of the removed connection, deliveries of messages
+// which are still buffered in the session of the connection fail only if they aren't replayed.
+func (s *Server) failConnectionDeliveries(connectionId ConnectionId) {
+	for _, delivery := range s.deliveries.RemoveConnection(connectionId) {
+		if s.sessions.Orphan(delivery) {
+			s.metrics.Set("delivery.pending", int64(s.deliveries.Size()))
+			continue
+		}
+
+		s.failDelivery(delivery, "connectionClosed")
+	}
+}
+
+// failDelivery publishes "deliveryFailed" to the output channel of the connection tenant.
+func (s *Server) failDelivery(delivery *pendingDelivery, reason string) {
+
+	s.metrics.Add("delivery.failed", 1)
+	s.metrics.Set("delivery.pending", int64(s.deliveries.Size()))
+
+	packedParams, _ := json.Marshal(js.DeliveryFailedParams{
+		DeliveryId:   delivery.id,
+		ConnectionId: int64(delivery.connectionId),
+		UserId:       string(delivery.userId),
+		DeviceId:     string(delivery.deviceId),
+		Type:         delivery.entry.messageType,
+		Body:         delivery.entry.message,
+		Attempts:     delivery.attempts,
+		Reason:       reason,
+	})
+
+	s.publish(TenantChannel(cube.Channel("wsOutput"), delivery.tenantId), cube.Message{
+		Method: "deliveryFailed",
+		Params: (*json.RawMessage)(&packedParams),
+	})
+}
@@ -0,0 +1,372 @@
+package lib
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+const DefaultRetainedMaxKeys = 100
+
+var ErrorTooManyRetainedKeys = fmt.Errorf("too many retained keys")
+
+type retainedFile struct {
+	TenantId TenantId             `json:"tenantId,omitempty"`
+	UserId   UserId               `json:"userId"`
+	Messages []js.RetainedMessage `json:"messages"`
+}
+
+// RetainedMessages keeps the latest message per key of users and devices, they are sent to connections after login.
+// If dir is set, every user has a json file in it which is replaced on every change.
+type RetainedMessages struct {
+	mutex   sync.Mutex
+	dir     string
+	maxKeys int
+	users   map[presenceKey]*retainedFile
+	version uint64
+}
+
+// LoadRetainedMessages reads retained messages from the directory, it is created if it doesn't exist.
+// Messages are kept in memory only if dir is empty.
+func LoadRetainedMessages(dir string, maxKeys int) (*RetainedMessages, error) {
+
+	if maxKeys <= 0 {
+		maxKeys = DefaultRetainedMaxKeys
+	}
+
+	retained := &RetainedMessages{
+		mutex:   sync.Mutex{},
+		dir:     dir,
+		maxKeys: maxKeys,
+		users:   map[presenceKey]*retainedFile{},
+	}
+
+	if dir == "" {
+		return retained, nil
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var user retainedFile
+		err = json.Unmarshal(data, &user)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse retained messages %v: %v", file.Name(), err)
+		}
+
+		for _, message := range user.Messages {
+			if message.Version > retained.version {
+				retained.version = message.Version
+			}
+		}
+
+		retained.users[presenceKey{tenantId: user.TenantId, userId: user.UserId}] = &user
+	}
+
+	return retained, nil
+}
+
+func (r *RetainedMessages) path(key presenceKey) string {
+	hash := sha1.Sum([]byte(string(key.tenantId) + "\x00" + string(key.userId)))
+	return filepath.Join(r.dir, hex.EncodeToString(hash[:])+".json")
+}
+
+// save replaces the file of the user, the file is removed when there are no messages.
+func (r *RetainedMessages) save(key presenceKey, user *retainedFile) error {
+
+	if len(user.Messages) == 0 {
+		delete(r.users, key)
+	}
+
+	if r.dir == "" {
+		return nil
+	}
+
+	path := r.path(key)
+
+	if len(user.Messages) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func matchesRetainedMessage(message js.RetainedMessage, deviceId *DeviceId, key *string) bool {
+	return (deviceId == nil || message.DeviceId == string(*deviceId)) && (key == nil || message.Key == *key)
+}
+
+// Set replaces the message with the same key of the user or of the device if deviceId is set and returns the stored message.
+func (r *RetainedMessages) Set(tenantId TenantId, userId UserId, deviceId *DeviceId, key string, messageType js.MessageType,
+	body []byte) (*js.RetainedMessage, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	userKey := presenceKey{tenantId: tenantId, userId: userId}
+	user := r.users[userKey]
+	if user == nil {
+		user = &retainedFile{TenantId: tenantId, UserId: userId}
+	}
+
+	message := js.RetainedMessage{
+		Key:       key,
+		Type:      messageType,
+		Body:      body,
+		UpdatedAt: nowMilliseconds(),
+	}
+
+	if deviceId != nil {
+		message.DeviceId = string(*deviceId)
+	}
+
+	messages := []js.RetainedMessage{}
+	for _, existing := range user.Messages {
+		if existing.DeviceId != message.DeviceId || existing.Key != key {
+			messages = append(messages, existing)
+		}
+	}
+
+	if len(messages) >= r.maxKeys {
+		return nil, ErrorTooManyRetainedKeys
+	}
+
+	r.version++
+	message.Version = r.version
+
+	user.Messages = append(messages, message)
+	r.users[userKey] = user
+
+	return &message, r.save(userKey, user)
+}
+
+// Clear removes messages of the user, only messages of the device and with the key are removed if they are set.
+// It returns the number of removed messages.
+func (r *RetainedMessages) Clear(tenantId TenantId, userId UserId, deviceId *DeviceId, key *string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	userKey := presenceKey{tenantId: tenantId, userId: userId}
+	user := r.users[userKey]
+	if user == nil {
+		return 0, nil
+	}
+
+	rest := []js.RetainedMessage{}
+	for _, message := range user.Messages {
+		if !matchesRetainedMessage(message, deviceId, key) {
+			rest = append(rest, message)
+		}
+	}
+
+	removed := len(user.Messages) - len(rest)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	user.Messages = rest
+	return removed, r.save(userKey, user)
+}
+
+// List returns messages of the user filtered the same way as in Clear.
+func (r *RetainedMessages) List(tenantId TenantId, userId UserId, deviceId *DeviceId, key *string) []js.RetainedMessage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	messages := []js.RetainedMessage{}
+
+	user := r.users[presenceKey{tenantId: tenantId, userId: userId}]
+	if user == nil {
+		return messages
+	}
+
+	for _, message := range user.Messages {
+		if matchesRetainedMessage(message, deviceId, key) {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+// GetDeviceMessages returns messages of the user and of the device, a message of the device replaces the message
+// of the user with the same key.
+func (r *RetainedMessages) GetDeviceMessages(tenantId TenantId, userId UserId, deviceId DeviceId) []js.RetainedMessage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	messages := []js.RetainedMessage{}
+
+	user := r.users[presenceKey{tenantId: tenantId, userId: userId}]
+	if user == nil {
+		return messages
+	}
+
+	deviceKeys := map[string]bool{}
+	for _, message := range user.Messages {
+		if message.DeviceId == string(deviceId) {
+			deviceKeys[message.Key] = true
+		}
+	}
+
+	for _, message := range user.Messages {
+		if message.DeviceId == string(deviceId) || (message.DeviceId == "" && !deviceKeys[message.Key]) {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+// GetDeviceMessage returns the message with the key which is sent to the device or nil.
+func (r *RetainedMessages) GetDeviceMessage(tenantId TenantId, userId UserId, deviceId DeviceId, key string) *js.RetainedMessage {
+
+	for _, message := range r.GetDeviceMessages(tenantId, userId, deviceId) {
+		if message.Key == key {
+			return &message
+		}
+	}
+
+	return nil
+}
+
+// SetRetainedMessage keeps the message and sends it to current connections of the user or of the device,
+// devices which have their own message with the key don't get the message of the user.
+func (s *Server) SetRetainedMessage(tenantId TenantId, userId UserId, deviceId *DeviceId, key string, messageType js.MessageType,
+	message []byte) error {
+
+	stored, err := s.retained.Set(tenantId, userId, deviceId, key, messageType, message)
+	if err != nil {
+		s.metrics.Add("retained.errors", 1)
+		return err
+	}
+
+	s.metrics.Add("retained.set", 1)
+
+	connections := []*Connection{}
+	if deviceId != nil {
+		connections = s.connections.GetDeviceConnections(tenantId, userId, *deviceId)
+	} else {
+		connections = s.connections.GetUserConnections(tenantId, userId)
+	}
+
+	for _, connection := range connections {
+		_, _, connectionDeviceId := connection.GetInfo()
+
+		current := s.retained.GetDeviceMessage(tenantId, userId, connectionDeviceId, key)
+		if current != nil && current.Version == stored.Version {
+			s.pushRetainedMessage(connection, tenantId, *current)
+		}
+	}
+
+	return nil
+}
+
+// pushRetainedMessage sends the message unless the connection has got a newer message with the key,
+// so a snapshot sent after login doesn't override values pushed meanwhile.
+func (s *Server) pushRetainedMessage(connection *Connection, tenantId TenantId, message js.RetainedMessage) bool {
+	connection.retainedMutex.Lock()
+	defer connection.retainedMutex.Unlock()
+
+	key := string(tenantId) + "\x00" + message.Key
+	if connection.retainedVersions[key] >= message.Version {
+		return false
+	}
+
+	err := s.sendToConnection(connection, message.Type, message.Body, SendOptions{})
+	if err != nil {
+		return false
+	}
+
+	if connection.retainedVersions == nil {
+		connection.retainedVersions = map[string]uint64{}
+	}
+
+	connection.retainedVersions[key] = message.Version
+	return true
+}
+
+// GetRetainedMessages returns the storage of retained messages.
+func (s *Server) GetRetainedMessages() *RetainedMessages {
+	return s.retained
+}
+
+type tenantRetainedMessage struct {
+	tenantId TenantId
+	message  js.RetainedMessage
+}
+
+// sendRetainedMessages sends retained messages to the logged in connection, messages of any tenant are sent too.
+// It is called after the connection is added, so messages set meanwhile are pushed to it and the snapshot
+// doesn't send older versions.
+func (s *Server) sendRetainedMessages(connection *Connection) {
+
+	_, userId, deviceId := connection.GetInfo()
+	tenantIds := []TenantId{""}
+	if tenantId := connection.GetTenant(); tenantId != "" {
+		tenantIds = append(tenantIds, tenantId)
+	}
+
+	messages := []tenantRetainedMessage{}
+	for _, tenantId := range tenantIds {
+		for _, message := range s.retained.GetDeviceMessages(tenantId, userId, deviceId) {
+			messages = append(messages, tenantRetainedMessage{tenantId: tenantId, message: message})
+		}
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].message.Version < messages[j].message.Version
+	})
+
+	sent := 0
+	for _, item := range messages {
+		if s.pushRetainedMessage(connection, item.tenantId, item.message) {
+			sent++
+		}
+	}
+
+	if sent > 0 {
+		s.metrics.Add("retained.sent", int64(sent))
+	}
+}
@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func retainedBodies(messages []js.RetainedMessage) []string {
+
+	bodies := []string{}
+	for _, message := range messages {
+		bodies = append(bodies, string(message.Body))
+	}
+
+	return bodies
+}
+
+func expectRetainedBodies(t *testing.T, description string, messages []js.RetainedMessage, expected ...string) {
+	t.Helper()
+
+	bodies := retainedBodies(messages)
+	if len(bodies) != len(expected) {
+		t.Fatalf("%v: messages = %q, want %q", description, bodies, expected)
+	}
+
+	for i := range bodies {
+		if bodies[i] != expected[i] {
+			t.Fatalf("%v: messages = %q, want %q", description, bodies, expected)
+		}
+	}
+}
+
+func TestRetainedMessagesVersions(t *testing.T) {
+
+	retained, err := LoadRetainedMessages("", 0)
+	if err != nil {
+		t.Fatalf("LoadRetainedMessages: %v", err)
+	}
+
+	phone := DeviceId("phone")
+	first, _ := retained.Set("", "user", nil, "unread", js.TEXT, []byte("1"))
+	second, _ := retained.Set("acme", "other", &phone, "unread", js.TEXT, []byte("2"))
+	third, _ := retained.Set("", "user", nil, "unread", js.TEXT, []byte("3"))
+
+	if !(first.Version < second.Version && second.Version < third.Version) {
+		t.Errorf("versions %v, %v, %v aren't increasing", first.Version, second.Version, third.Version)
+	}
+
+	expectRetainedBodies(t, "replaced message", retained.List("", "user", nil, nil), "3")
+}
+
+func TestRetainedMessagesDevicePrecedence(t *testing.T) {
+
+	retained, err := LoadRetainedMessages("", 0)
+	if err != nil {
+		t.Fatalf("LoadRetainedMessages: %v", err)
+	}
+
+	phone := DeviceId("phone")
+	retained.Set("", "user", nil, "unread", js.TEXT, []byte("user unread"))
+	retained.Set("", "user", nil, "status", js.TEXT, []byte("user status"))
+	retained.Set("", "user", &phone, "unread", js.TEXT, []byte("phone unread"))
+
+	expectRetainedBodies(t, "phone messages", retained.GetDeviceMessages("", "user", "phone"), "user status", "phone unread")
+	expectRetainedBodies(t, "tablet messages", retained.GetDeviceMessages("", "user", "tablet"), "user unread", "user status")
+
+	if message := retained.GetDeviceMessage("", "user", "phone", "unread"); message == nil || string(message.Body) != "phone unread" {
+		t.Errorf("GetDeviceMessage() = %+v", message)
+	}
+
+	retained.Set("", "user", nil, "unread", js.TEXT, []byte("user unread 2"))
+	expectRetainedBodies(t, "phone messages after the user message is replaced", retained.GetDeviceMessages("", "user", "phone"),
+		"user status", "phone unread")
+
+	unread := "unread"
+	removed, err := retained.Clear("", "user", &phone, &unread)
+	if err != nil || removed != 1 {
+		t.Errorf("Clear() = %v, %v", removed, err)
+	}
+
+	expectRetainedBodies(t, "phone messages after its message is cleared", retained.GetDeviceMessages("", "user", "phone"),
+		"user status", "user unread 2")
+}
+
+func TestRetainedMessagesMaxKeys(t *testing.T) {
+
+	retained, err := LoadRetainedMessages("", 2)
+	if err != nil {
+		t.Fatalf("LoadRetainedMessages: %v", err)
+	}
+
+	phone := DeviceId("phone")
+	retained.Set("", "user", nil, "a", js.TEXT, []byte("a"))
+	retained.Set("", "user", &phone, "a", js.TEXT, []byte("phone a"))
+
+	_, err = retained.Set("", "user", nil, "b", js.TEXT, []byte("b"))
+	if err != ErrorTooManyRetainedKeys {
+		t.Errorf("Set() of a new key = %v, want ErrorTooManyRetainedKeys", err)
+	}
+
+	_, err = retained.Set("", "user", nil, "a", js.TEXT, []byte("a2"))
+	if err != nil {
+		t.Errorf("Set() of an existing key = %v", err)
+	}
+
+	_, err = retained.Set("", "other", nil, "b", js.TEXT, []byte("b"))
+	if err != nil {
+		t.Errorf("Set() for another user = %v", err)
+	}
+
+	expectRetainedBodies(t, "kept messages", retained.List("", "user", nil, nil), "phone a", "a2")
+}
+
+func TestRetainedMessagesFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "retained")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	retained, err := LoadRetainedMessages(dir, 0)
+	if err != nil {
+		t.Fatalf("LoadRetainedMessages: %v", err)
+	}
+
+	phone := DeviceId("phone")
+	retained.Set("", "user", nil, "unread", js.TEXT, []byte("1"))
+	retained.Set("acme", "user", &phone, "unread", js.BINARY, []byte{2})
+	last, _ := retained.Set("", "user", nil, "status", js.TEXT, []byte("3"))
+
+	restarted, err := LoadRetainedMessages(dir, 0)
+	if err != nil {
+		t.Fatalf("LoadRetainedMessages after restart: %v", err)
+	}
+
+	expectRetainedBodies(t, "restored messages", restarted.List("", "user", nil, nil), "1", "3")
+
+	tenantMessages := restarted.List("acme", "user", &phone, nil)
+	if len(tenantMessages) != 1 || tenantMessages[0].Type != js.BINARY || tenantMessages[0].DeviceId != "phone" {
+		t.Errorf("restored tenant messages = %+v", tenantMessages)
+	}
+
+	next, _ := restarted.Set("", "user", nil, "unread", js.TEXT, []byte("4"))
+	if next.Version <= last.Version {
+		t.Errorf("version %v after restart isn't newer than %v", next.Version, last.Version)
+	}
+
+	restarted.Clear("", "user", nil, nil)
+	restarted.Clear("acme", "user", nil, nil)
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("%v files are left after all messages are cleared", len(files))
+	}
+}
+
+func TestServerRetainedMessages(t *testing.T) {
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	phone, phoneClient := newSocketLoggedConnection(t, 1, "user", "phone")
+	tablet, tabletClient := newSocketLoggedConnection(t, 2, "user", "tablet")
+	server.connections.AddNewConnection(phone)
+	server.connections.AddNewConnection(tablet)
+
+	phoneId := DeviceId("phone")
+	server.SetRetainedMessage("", "user", &phoneId, "unread", js.TEXT, []byte("phone 1"))
+	expectText(t, phoneClient, "phone 1")
+
+	server.SetRetainedMessage("", "user", nil, "unread", js.TEXT, []byte("user 1"))
+	expectText(t, tabletClient, "user 1")
+
+	old := *server.retained.GetDeviceMessage("", "user", "phone", "unread")
+	server.SetRetainedMessage("", "user", &phoneId, "unread", js.TEXT, []byte("phone 2"))
+	expectText(t, phoneClient, "phone 2")
+
+	if server.pushRetainedMessage(phone, "", old) {
+		t.Errorf("older version is sent after a newer one")
+	}
+
+	server.sendRetainedMessages(phone)
+	server.sendRetainedMessages(tablet)
+
+	expectNoFrame(t, phoneClient)
+	expectNoFrame(t, tabletClient)
+}
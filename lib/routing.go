@@ -0,0 +1,371 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	TEXT_MESSAGE_TYPE   = "text"
+	BINARY_MESSAGE_TYPE = "binary"
+)
+
+// EndpointConfig describes how messages sent to the endpoint are handled.
+// MaxSize is in bytes, Timeout is the maximum request timeout in milliseconds,
+// RateLimit is the number of messages per second allowed for one connection.
+// Policy requires authentication and is checked against claims of the connection.
+// Schema is a path to JSON Schema of payloads, relative to the routing config file, endpoints with schema accept
+// only text messages.
+// Rules choose the channel by payload content, the first matching rule wins.
+// Without a matching rule Split distributes users between channels, otherwise Channel is used.
+type EndpointConfig struct {
+	Name         Endpoint      `json:"name"`
+	Channel      cube.Channel  `json:"channel"`
+	RequireAuth  bool          `json:"requireAuth"`
+	Policy       *AuthPolicy   `json:"policy"`
+	MessageTypes []string      `json:"messageTypes"`
+	MaxSize      int           `json:"maxSize"`
+	Timeout      int64         `json:"timeout"`
+	RateLimit    float64       `json:"rateLimit"`
+	RateBurst    int           `json:"rateBurst"`
+	Schema       string        `json:"schema"`
+	Rules        []ContentRule `json:"rules"`
+	Split        *TrafficSplit `json:"split"`
+
+	compiledSchema *Schema
+}
+
+// RoutingConfig routes endpoints without a match to DefaultChannel if it is set.
+type RoutingConfig struct {
+	DefaultChannel cube.Channel     `json:"defaultChannel"`
+	Endpoints      []EndpointConfig `json:"endpoints"`
+
+	path string
+}
+
+func (c *EndpointConfig) Validate() error {
+
+	if c.Name == "" {
+		return fmt.Errorf("endpoint name is required")
+	}
+
+	err := ValidateEndpointName(c.Name)
+	if err != nil {
+		return err
+	}
+
+	if c.Channel == "" {
+		return fmt.Errorf("endpoint %v: channel is required", c.Name)
+	}
+
+	for _, messageType := range c.MessageTypes {
+		if messageType != TEXT_MESSAGE_TYPE && messageType != BINARY_MESSAGE_TYPE {
+			return fmt.Errorf("endpoint %v: wrong message type %v", c.Name, messageType)
+		}
+	}
+
+	if c.Schema != "" {
+		for _, messageType := range c.MessageTypes {
+			if messageType == BINARY_MESSAGE_TYPE {
+				return fmt.Errorf("endpoint %v: binary messages can't be validated by schema", c.Name)
+			}
+		}
+	}
+
+	if c.MaxSize < 0 || c.Timeout < 0 || c.RateLimit < 0 || c.RateBurst < 0 {
+		return fmt.Errorf("endpoint %v: limits can't be negative", c.Name)
+	}
+
+	if c.Policy != nil {
+		err := c.Policy.Validate()
+		if err != nil {
+			return fmt.Errorf("endpoint %v: %v", c.Name, err)
+		}
+	}
+
+	for i := range c.Rules {
+		err := c.Rules[i].compile()
+		if err != nil {
+			return fmt.Errorf("endpoint %v: %v", c.Name, err)
+		}
+	}
+
+	if c.Split != nil {
+		err := c.Split.Validate()
+		if err != nil {
+			return fmt.Errorf("endpoint %v: %v", c.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *EndpointConfig) AllowsType(isText bool) bool {
+
+	if len(c.MessageTypes) == 0 {
+		return isText || c.Schema == ""
+	}
+
+	messageType := BINARY_MESSAGE_TYPE
+	if isText {
+		messageType = TEXT_MESSAGE_TYPE
+	}
+
+	for _, allowedType := range c.MessageTypes {
+		if allowedType == messageType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validatePayload checks the payload against the endpoint schema, nil means the payload is valid.
+func (c *EndpointConfig) validatePayload(payload *payloadDocument) []js.Violation {
+
+	if c.compiledSchema == nil {
+		return nil
+	}
+
+	document, err := payload.get()
+	if err != nil {
+		return []js.Violation{{Path: "", Message: "payload is not valid json"}}
+	}
+
+	return c.compiledSchema.Validate(document)
+}
+
+// ruleChannel applies content rules, payloads which aren't json don't match any rule.
+func (c *EndpointConfig) ruleChannel(payload *payloadDocument) (cube.Channel, bool) {
+
+	if len(c.Rules) == 0 {
+		return "", false
+	}
+
+	document, err := payload.get()
+	if err != nil {
+		return "", false
+	}
+
+	channel := SelectChannel(c.Rules, document, "")
+	return channel, channel != ""
+}
+
+// LoadRoutingConfig reads the routing config, files with ".yaml" or ".yml" extension are read as yaml
+// with the same field names as json.
+func LoadRoutingConfig(path string) (*RoutingConfig, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	extension := strings.ToLower(filepath.Ext(path))
+	if extension == ".yaml" || extension == ".yml" {
+		data, err = yamlToJson(data)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse routing config: %v", err)
+		}
+	}
+
+	config := RoutingConfig{
+		path: path,
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse routing config: %v", err)
+	}
+
+	return &config, nil
+}
+
+// yamlToJson converts the yaml document to json, so configs are decoded by json field tags in both formats.
+func yamlToJson(data []byte) ([]byte, error) {
+
+	var document interface{}
+	err := yaml.Unmarshal(data, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	document, err = toJsonValue(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(document)
+}
+
+// toJsonValue replaces yaml maps with string keyed maps, which can be encoded to json.
+func toJsonValue(value interface{}) (interface{}, error) {
+
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v isn't a string", key)
+			}
+
+			converted, err := toJsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+
+			object[name] = converted
+		}
+
+		return object, nil
+
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, item := range value {
+			converted, err := toJsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+
+			array[i] = converted
+		}
+
+		return array, nil
+	}
+
+	return value, nil
+}
+
+// RoutingTable is immutable, it is replaced as a whole on reload.
+// Patterns are sorted from the most specific one.
+type RoutingTable struct {
+	endpoints      map[Endpoint]*EndpointConfig
+	patterns       []*EndpointConfig
+	defaultChannel cube.Channel
+}
+
+// NewRoutingTable merges the endpoints map with the routing config, entries of the config win.
+func NewRoutingTable(endpointsMap map[Endpoint]cube.Channel, config *RoutingConfig) (*RoutingTable, error) {
+
+	table := &RoutingTable{
+		endpoints: map[Endpoint]*EndpointConfig{},
+	}
+
+	for endpoint, channel := range endpointsMap {
+		err := ValidateEndpointName(endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		table.endpoints[endpoint] = &EndpointConfig{
+			Name:    endpoint,
+			Channel: channel,
+		}
+	}
+
+	if config == nil {
+		table.sortPatterns()
+		return table, nil
+	}
+
+	table.defaultChannel = config.DefaultChannel
+
+	configured := map[Endpoint]bool{}
+
+	for i := range config.Endpoints {
+		endpointConfig := config.Endpoints[i]
+
+		err := endpointConfig.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		if configured[endpointConfig.Name] {
+			return nil, fmt.Errorf("endpoint %v is duplicated", endpointConfig.Name)
+		}
+
+		if endpointConfig.Schema != "" {
+			schemaPath := endpointConfig.Schema
+			if !filepath.IsAbs(schemaPath) {
+				schemaPath = filepath.Join(filepath.Dir(config.path), schemaPath)
+			}
+
+			endpointConfig.compiledSchema, err = LoadSchema(schemaPath)
+			if err != nil {
+				return nil, fmt.Errorf("endpoint %v: %v", endpointConfig.Name, err)
+			}
+		}
+
+		configured[endpointConfig.Name] = true
+		table.endpoints[endpointConfig.Name] = &endpointConfig
+	}
+
+	table.sortPatterns()
+	return table, nil
+}
+
+func (t *RoutingTable) sortPatterns() {
+
+	t.patterns = []*EndpointConfig{}
+	for name, endpoint := range t.endpoints {
+		if isEndpointPattern(name) {
+			t.patterns = append(t.patterns, endpoint)
+		}
+	}
+
+	sort.Slice(t.patterns, func(i, j int) bool {
+		return isMoreSpecific(t.patterns[i].Name, t.patterns[j].Name)
+	})
+}
+
+// Get returns the endpoint with exactly the same name.
+func (t *RoutingTable) Get(endpoint Endpoint) *EndpointConfig {
+	return t.endpoints[endpoint]
+}
+
+// Match returns the exact endpoint or the most specific pattern matching the endpoint.
+func (t *RoutingTable) Match(endpoint Endpoint) *EndpointConfig {
+
+	endpointConfig := t.endpoints[endpoint]
+	if endpointConfig != nil {
+		return endpointConfig
+	}
+
+	for _, pattern := range t.patterns {
+		if matchEndpoint(pattern.Name, endpoint) {
+			return pattern
+		}
+	}
+
+	return nil
+}
+
+// Default returns the fallback endpoint or nil if the default channel isn't set.
+func (t *RoutingTable) Default() *EndpointConfig {
+
+	if t.defaultChannel == "" {
+		return nil
+	}
+
+	return &EndpointConfig{
+		Channel: t.defaultChannel,
+	}
+}
+
+func (t *RoutingTable) Size() int {
+	return len(t.endpoints)
+}
+
+func (t *RoutingTable) forEach(fn func(endpoint *EndpointConfig)) {
+	for _, endpoint := range t.endpoints {
+		fn(endpoint)
+	}
+}
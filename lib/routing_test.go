@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeRoutingConfig(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadRoutingConfigFormats(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonPath := writeRoutingConfig(t, dir, "routing.json", `{"defaultChannel": "fallback", "endpoints": [
+		{"name": "chat.*", "channel": "chatChannel", "requireAuth": true, "messageTypes": ["text"], "maxSize": 65536, "rateLimit": 1.5,
+		"policy": {"allOf": [{"claim": "tenant", "equals": "acme"}]},
+		"rules": [{"path": "$.type", "op": "in", "value": ["a", "b"], "channel": "priorityChat"}]}]}`)
+
+	yamlPath := writeRoutingConfig(t, dir, "routing.YML", `
+defaultChannel: fallback
+endpoints:
+  - name: chat.*
+    channel: chatChannel
+    requireAuth: true
+    messageTypes: [text]
+    maxSize: 65536
+    rateLimit: 1.5
+    policy:
+      allOf:
+        - {claim: tenant, equals: acme}
+    rules:
+      - path: $.type
+        op: in
+        value: [a, b]
+        channel: priorityChat
+`)
+
+	expected, err := LoadRoutingConfig(jsonPath)
+	if err != nil {
+		t.Fatalf("LoadRoutingConfig(json): %v", err)
+	}
+
+	config, err := LoadRoutingConfig(yamlPath)
+	if err != nil {
+		t.Fatalf("LoadRoutingConfig(yaml): %v", err)
+	}
+
+	expected.path, config.path = "", ""
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("yaml config = %+v, want %+v", config, expected)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"broken.yaml", "endpoints: [\n"},
+		{"keys.yaml", "endpoints:\n  - {1: chat}\n"},
+		{"broken.json", `{"endpoints": [`},
+		{"yaml.json", "endpoints: []\n"},
+	}
+
+	for _, test := range tests {
+		_, err := LoadRoutingConfig(writeRoutingConfig(t, dir, test.name, test.content))
+		if err == nil {
+			t.Errorf("%v is loaded", test.name)
+		}
+	}
+}
+
+func TestEndpointConfigValidate(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		endpoint EndpointConfig
+		valid    bool
+	}{
+		{"minimal", EndpointConfig{Name: "chat", Channel: "chatChannel"}, true},
+		{"pattern", EndpointConfig{Name: "chat.>", Channel: "chatChannel", MessageTypes: []string{"text", "binary"}}, true},
+		{"no name", EndpointConfig{Channel: "chatChannel"}, false},
+		{"wrong name", EndpointConfig{Name: "chat..send", Channel: "chatChannel"}, false},
+		{"no channel", EndpointConfig{Name: "chat"}, false},
+		{"wrong message type", EndpointConfig{Name: "chat", Channel: "chatChannel", MessageTypes: []string{"json"}}, false},
+		{"binary with schema", EndpointConfig{Name: "chat", Channel: "chatChannel", Schema: "chat.json", MessageTypes: []string{"binary"}}, false},
+		{"negative max size", EndpointConfig{Name: "chat", Channel: "chatChannel", MaxSize: -1}, false},
+		{"negative timeout", EndpointConfig{Name: "chat", Channel: "chatChannel", Timeout: -1}, false},
+		{"negative rate limit", EndpointConfig{Name: "chat", Channel: "chatChannel", RateLimit: -1}, false},
+		{"negative rate burst", EndpointConfig{Name: "chat", Channel: "chatChannel", RateBurst: -1}, false},
+		{"wrong policy", EndpointConfig{Name: "chat", Channel: "chatChannel", Policy: &AuthPolicy{AllOf: []ClaimRule{{Claim: "tenant"}}}}, false},
+		{"wrong rule", EndpointConfig{Name: "chat", Channel: "chatChannel", Rules: []ContentRule{{Path: "type", Operator: "like", Channel: "a"}}}, false},
+		{"empty split", EndpointConfig{Name: "chat", Channel: "chatChannel", Split: &TrafficSplit{}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.endpoint.Validate()
+			if (err == nil) != test.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/akaumov/cube"
+)
+
+const routingConfigCheckInterval = 5 * time.Second
+
+// RoutingConfigWatcher reloads the routing config when the file is changed or SIGHUP is received.
+// Broken config is rejected and the previous routing table stays active.
+type RoutingConfigWatcher struct {
+	cubeInstance  cube.Cube
+	server        *Server
+	path          string
+	endpointsMap  map[Endpoint]cube.Channel
+	checkInterval time.Duration
+	lastModTime   time.Time
+	stop          chan struct{}
+}
+
+func NewRoutingConfigWatcher(cubeInstance cube.Cube, server *Server, path string, endpointsMap map[Endpoint]cube.Channel) *RoutingConfigWatcher {
+	return &RoutingConfigWatcher{
+		cubeInstance:  cubeInstance,
+		server:        server,
+		path:          path,
+		endpointsMap:  endpointsMap,
+		checkInterval: routingConfigCheckInterval,
+		stop:          make(chan struct{}),
+	}
+}
+
+// Load reads the config and replaces the routing table of the server.
+func (w *RoutingConfigWatcher) Load() error {
+
+	metrics := w.server.GetMetrics()
+
+	info, err := os.Stat(w.path)
+	if err == nil {
+		w.lastModTime = info.ModTime()
+	}
+
+	table, err := w.buildRoutingTable()
+	if err != nil {
+		metrics.Add("routing.reloadErrors", 1)
+		fmt.Println("Routing config reload error:", err)
+		w.cubeInstance.LogError("Routing config reload error: " + err.Error())
+		return err
+	}
+
+	w.server.SetRoutingTable(table)
+
+	metrics.Add("routing.reloads", 1)
+	metrics.Set("routing.lastReloadTime", time.Now().Unix())
+	metrics.Set("routing.endpoints", int64(table.Size()))
+
+	fmt.Println("Routing config is loaded, endpoints:", table.Size())
+	w.cubeInstance.LogInfo(fmt.Sprintf("Routing config is loaded, endpoints: %v", table.Size()))
+	return nil
+}
+
+func (w *RoutingConfigWatcher) buildRoutingTable() (*RoutingTable, error) {
+
+	config, err := LoadRoutingConfig(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRoutingTable(w.endpointsMap, config)
+}
+
+func (w *RoutingConfigWatcher) Watch() {
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(w.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-hangup:
+			w.Load()
+		case <-ticker.C:
+			info, err := os.Stat(w.path)
+			if err != nil || info.ModTime().Equal(w.lastModTime) {
+				continue
+			}
+
+			w.Load()
+		}
+	}
+}
+
+func (w *RoutingConfigWatcher) Stop() {
+	close(w.stop)
+}
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/akaumov/cube"
+)
+
+func newTestRoutingWatcher(t *testing.T, content string) (*RoutingConfigWatcher, *Server) {
+
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cubeInstance := newBusCube(newMemoryBus(), "A")
+	server, err := NewServer(cubeInstance, ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	path := writeRoutingConfig(t, dir, "routing.json", content)
+	watcher := NewRoutingConfigWatcher(cubeInstance, server, path, map[Endpoint]cube.Channel{"static": "staticChannel"})
+
+	err = watcher.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	return watcher, server
+}
+
+// rewriteRoutingConfig replaces the config and moves its modification time forward, so the change is seen
+// even on file systems with coarse timestamps.
+func rewriteRoutingConfig(t *testing.T, watcher *RoutingConfigWatcher, content string) {
+
+	info, err := os.Stat(watcher.path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	err = ioutil.WriteFile(watcher.path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	modTime := info.ModTime().Add(time.Second)
+	err = os.Chtimes(watcher.path, modTime, modTime)
+	if err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+}
+
+func routedChannel(server *Server, endpoint Endpoint) cube.Channel {
+
+	endpointConfig := server.getRoutingTable().Match(endpoint)
+	if endpointConfig == nil {
+		return ""
+	}
+
+	return endpointConfig.Channel
+}
+
+func TestRoutingConfigWatcherRejectsBrokenConfig(t *testing.T) {
+
+	watcher, server := newTestRoutingWatcher(t, `{"endpoints": [{"name": "chat", "channel": "chatV1"}]}`)
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"not json", `{"endpoints": [`},
+		{"invalid endpoint", `{"endpoints": [{"name": "chat", "channel": "chatV2", "maxSize": -1}]}`},
+		{"duplicated endpoint", `{"endpoints": [{"name": "chat", "channel": "chatV2"}, {"name": "chat", "channel": "chatV3"}]}`},
+		{"missing schema", `{"endpoints": [{"name": "chat", "channel": "chatV2", "schema": "missing.json"}]}`},
+	}
+
+	for i, test := range tests {
+		rewriteRoutingConfig(t, watcher, test.content)
+
+		err := watcher.Load()
+		if err == nil {
+			t.Errorf("%v: config is loaded", test.name)
+		}
+
+		if channel := routedChannel(server, "chat"); channel != "chatV1" {
+			t.Errorf("%v: chat is routed to %q, the previous table isn't kept", test.name, channel)
+		}
+
+		if errors := server.metrics.Get("routing.reloadErrors"); errors != int64(i+1) {
+			t.Errorf("%v: routing.reloadErrors = %v", test.name, errors)
+		}
+	}
+
+	rewriteRoutingConfig(t, watcher, `{"endpoints": [{"name": "chat", "channel": "chatV2"}]}`)
+
+	err := watcher.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if channel := routedChannel(server, "chat"); channel != "chatV2" {
+		t.Errorf("chat is routed to %q after the config is fixed", channel)
+	}
+
+	if reloads, endpoints := server.metrics.Get("routing.reloads"), server.metrics.Get("routing.endpoints"); reloads != 2 || endpoints != 2 {
+		t.Errorf("routing.reloads = %v, routing.endpoints = %v", reloads, endpoints)
+	}
+}
+
+func TestRoutingConfigWatcherReloadsChangedFile(t *testing.T) {
+
+	watcher, server := newTestRoutingWatcher(t, `{"endpoints": [{"name": "chat", "channel": "chatV1"}]}`)
+	watcher.checkInterval = 10 * time.Millisecond
+
+	go watcher.Watch()
+	defer watcher.Stop()
+
+	rewriteRoutingConfig(t, watcher, `{"endpoints": [{"name": "chat", "channel": "chatV2"}]}`)
+
+	waitFor(t, "changed config is reloaded", func() bool {
+		return routedChannel(server, "chat") == "chatV2"
+	})
+}
+
+func TestRoutingConfigWatcherReloadsOnHangup(t *testing.T) {
+
+	// SIGHUP terminates the process until the watcher subscribes to it
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	watcher, server := newTestRoutingWatcher(t, `{"endpoints": [{"name": "chat", "channel": "chatV1"}]}`)
+	watcher.checkInterval = time.Hour
+
+	go watcher.Watch()
+	defer watcher.Stop()
+
+	rewriteRoutingConfig(t, watcher, `{"endpoints": [{"name": "chat", "channel": "chatV2"}]}`)
+
+	waitFor(t, "config is reloaded on SIGHUP", func() bool {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+		return routedChannel(server, "chat") == "chatV2"
+	})
+}
@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DefaultMaxScheduledMessages = 10000
+
+var (
+	ErrorDuplicateMessage         = fmt.Errorf("duplicate message")
+	ErrorTooManyScheduledMessages = fmt.Errorf("too many scheduled messages")
+)
+
+// ScheduledMessages keeps timers of delayed messages, messages with id can be canceled until they are sent.
+type ScheduledMessages struct {
+	mutex       sync.Mutex
+	wheel       *TimerWheel
+	maxMessages int
+	byId        map[dedupKey]uint64
+}
+
+func NewScheduledMessages(maxMessages int) *ScheduledMessages {
+
+	if maxMessages <= 0 {
+		maxMessages = DefaultMaxScheduledMessages
+	}
+
+	return &ScheduledMessages{
+		mutex:       sync.Mutex{},
+		wheel:       NewTimerWheel(DefaultTimerWheelTick, DefaultTimerWheelSlots),
+		maxMessages: maxMessages,
+		byId:        map[dedupKey]uint64{},
+	}
+}
+
+// Schedule calls send at deliverAt, messageId may be empty.
+func (s *ScheduledMessages) Schedule(tenantId TenantId, messageId string, deliverAt time.Time, send func()) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := dedupKey{tenantId: tenantId, messageId: messageId}
+	if messageId != "" {
+		if _, ok := s.byId[key]; ok {
+			return ErrorDuplicateMessage
+		}
+	}
+
+	if s.wheel.Size() >= s.maxMessages {
+		return ErrorTooManyScheduledMessages
+	}
+
+	var timerId uint64
+	timerId = s.wheel.Schedule(deliverAt, func() {
+		if messageId != "" {
+			s.mutex.Lock()
+			if s.byId[key] == timerId {
+				delete(s.byId, key)
+			}
+			s.mutex.Unlock()
+		}
+
+		send()
+	})
+
+	if messageId != "" {
+		s.byId[key] = timerId
+	}
+
+	return nil
+}
+
+// Cancel removes the scheduled message, it returns false if there is no such message or it has been already sent.
+func (s *ScheduledMessages) Cancel(tenantId TenantId, messageId string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := dedupKey{tenantId: tenantId, messageId: messageId}
+	timerId, ok := s.byId[key]
+	if !ok {
+		return false
+	}
+
+	delete(s.byId, key)
+	return s.wheel.Cancel(timerId)
+}
+
+func (s *ScheduledMessages) Size() int {
+	return s.wheel.Size()
+}
+
+func (s *ScheduledMessages) Run() {
+	s.wheel.Run()
+}
+
+// PublishMessage calls send now or at deliverAt if it's in the future. Messages with id are sent once
+// within the dedup window, ids of messages which couldn't be scheduled are forgotten, so they can be published again.
+func (s *Server) PublishMessage(tenantId TenantId, messageId string, deliverAt time.Time, send func()) error {
+
+	if messageId != "" && !s.deduplicator.Check(tenantId, messageId) {
+		s.metrics.Add("messages.duplicates", 1)
+		return ErrorDuplicateMessage
+	}
+
+	if deliverAt.IsZero() || !deliverAt.After(time.Now()) {
+		send()
+		return nil
+	}
+
+	err := s.scheduled.Schedule(tenantId, messageId, deliverAt, func() {
+		s.metrics.Set("messages.scheduled", int64(s.scheduled.Size()))
+		send()
+	})
+
+	if err != nil {
+		if messageId != "" && err != ErrorDuplicateMessage {
+			s.deduplicator.Forget(tenantId, messageId)
+		}
+
+		s.metrics.Add("messages.scheduleErrors", 1)
+		return err
+	}
+
+	s.metrics.Set("messages.scheduled", int64(s.scheduled.Size()))
+	return nil
+}
+
+// CancelScheduledMessage returns false if there is no scheduled message with the id,
+// the id of the canceled message is forgotten, so it can be published again.
+func (s *Server) CancelScheduledMessage(tenantId TenantId, messageId string) bool {
+
+	canceled := s.scheduled.Cancel(tenantId, messageId)
+	if canceled {
+		s.deduplicator.Forget(tenantId, messageId)
+		s.metrics.Add("messages.canceled", 1)
+		s.metrics.Set("messages.scheduled", int64(s.scheduled.Size()))
+	}
+
+	return canceled
+}
@@ -0,0 +1,477 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+// Schema is a compiled JSON Schema. Supported keywords: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf, not. Schemas with other validation keywords
+// like $ref are rejected on compilation, annotations like title and description are ignored.
+type Schema struct {
+	alwaysValid          bool
+	neverValid           bool
+	types                []string
+	enum                 []interface{}
+	constValue           interface{}
+	hasConst             bool
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	items                *Schema
+	minItems             *int
+	maxItems             *int
+	minLength            *int
+	maxLength            *int
+	pattern              *regexp.Regexp
+	minimum              *float64
+	maximum              *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	allOf                []*Schema
+	anyOf                []*Schema
+	oneOf                []*Schema
+	not                  *Schema
+}
+
+var ignoredSchemaKeywords = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+	"format":      true,
+}
+
+var schemaTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+func LoadSchema(path string) (*Schema, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return CompileSchema(data)
+}
+
+func CompileSchema(data []byte) (*Schema, error) {
+
+	var rawSchema interface{}
+	err := json.Unmarshal(data, &rawSchema)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse schema: %v", err)
+	}
+
+	return compileSchema(rawSchema, "#")
+}
+
+func compileSchema(rawSchema interface{}, path string) (*Schema, error) {
+
+	if value, ok := rawSchema.(bool); ok {
+		return &Schema{alwaysValid: value, neverValid: !value}, nil
+	}
+
+	keywords, ok := rawSchema.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: schema must be an object or a boolean", path)
+	}
+
+	schema := &Schema{}
+
+	for keyword, value := range keywords {
+		keywordPath := path + "/" + keyword
+		var err error
+
+		switch keyword {
+		case "type":
+			schema.types, err = compileTypes(value, keywordPath)
+		case "enum":
+			values, ok := value.([]interface{})
+			if !ok {
+				err = fmt.Errorf("%v: must be an array", keywordPath)
+			}
+			schema.enum = values
+		case "const":
+			schema.constValue = value
+			schema.hasConst = true
+		case "properties":
+			schema.properties, err = compileSchemaMap(value, keywordPath)
+		case "required":
+			schema.required, err = compileStrings(value, keywordPath)
+		case "additionalProperties":
+			schema.additionalProperties, err = compileSchema(value, keywordPath)
+		case "items":
+			schema.items, err = compileSchema(value, keywordPath)
+		case "minItems":
+			schema.minItems, err = compileInt(value, keywordPath)
+		case "maxItems":
+			schema.maxItems, err = compileInt(value, keywordPath)
+		case "minLength":
+			schema.minLength, err = compileInt(value, keywordPath)
+		case "maxLength":
+			schema.maxLength, err = compileInt(value, keywordPath)
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				err = fmt.Errorf("%v: must be a string", keywordPath)
+				break
+			}
+			schema.pattern, err = regexp.Compile(pattern)
+		case "minimum":
+			schema.minimum, err = compileNumber(value, keywordPath)
+		case "maximum":
+			schema.maximum, err = compileNumber(value, keywordPath)
+		case "exclusiveMinimum":
+			schema.exclusiveMinimum, err = compileNumber(value, keywordPath)
+		case "exclusiveMaximum":
+			schema.exclusiveMaximum, err = compileNumber(value, keywordPath)
+		case "allOf":
+			schema.allOf, err = compileSchemaList(value, keywordPath)
+		case "anyOf":
+			schema.anyOf, err = compileSchemaList(value, keywordPath)
+		case "oneOf":
+			schema.oneOf, err = compileSchemaList(value, keywordPath)
+		case "not":
+			schema.not, err = compileSchema(value, keywordPath)
+		default:
+			if !ignoredSchemaKeywords[keyword] {
+				err = fmt.Errorf("%v: keyword is not supported", keywordPath)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return schema, nil
+}
+
+func compileTypes(value interface{}, path string) ([]string, error) {
+
+	if typeName, ok := value.(string); ok {
+		value = []interface{}{typeName}
+	}
+
+	types, err := compileStrings(value, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, typeName := range types {
+		if !schemaTypes[typeName] {
+			return nil, fmt.Errorf("%v: unknown type %v", path, typeName)
+		}
+	}
+
+	return types, nil
+}
+
+func compileStrings(value interface{}, path string) ([]string, error) {
+
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: must be an array of strings", path)
+	}
+
+	result := []string{}
+	for _, item := range values {
+		text, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v: must be an array of strings", path)
+		}
+
+		result = append(result, text)
+	}
+
+	return result, nil
+}
+
+func compileInt(value interface{}, path string) (*int, error) {
+
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != math.Trunc(number) {
+		return nil, fmt.Errorf("%v: must be a non-negative integer", path)
+	}
+
+	result := int(number)
+	return &result, nil
+}
+
+func compileNumber(value interface{}, path string) (*float64, error) {
+
+	number, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%v: must be a number", path)
+	}
+
+	return &number, nil
+}
+
+func compileSchemaMap(value interface{}, path string) (map[string]*Schema, error) {
+
+	rawSchemas, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: must be an object", path)
+	}
+
+	schemas := map[string]*Schema{}
+	for name, rawSchema := range rawSchemas {
+		schema, err := compileSchema(rawSchema, path+"/"+name)
+		if err != nil {
+			return nil, err
+		}
+
+		schemas[name] = schema
+	}
+
+	return schemas, nil
+}
+
+func compileSchemaList(value interface{}, path string) ([]*Schema, error) {
+
+	rawSchemas, ok := value.([]interface{})
+	if !ok || len(rawSchemas) == 0 {
+		return nil, fmt.Errorf("%v: must be a non-empty array", path)
+	}
+
+	schemas := []*Schema{}
+	for i, rawSchema := range rawSchemas {
+		schema, err := compileSchema(rawSchema, path+"/"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+
+		schemas = append(schemas, schema)
+	}
+
+	return schemas, nil
+}
+
+func (s *Schema) Validate(value interface{}) []js.Violation {
+	violations := []js.Violation{}
+	s.validate(value, "", &violations)
+
+	if len(violations) == 0 {
+		return nil
+	}
+
+	return violations
+}
+
+func (s *Schema) validate(value interface{}, path string, violations *[]js.Violation) {
+
+	report := func(message string, args ...interface{}) {
+		*violations = append(*violations, js.Violation{Path: path, Message: fmt.Sprintf(message, args...)})
+	}
+
+	if s.alwaysValid {
+		return
+	}
+
+	if s.neverValid {
+		report("value is not allowed")
+		return
+	}
+
+	if len(s.types) > 0 && !matchesSchemaType(value, s.types) {
+		report("must be of type %v", strings.Join(s.types, " or "))
+		return
+	}
+
+	if s.hasConst && !reflect.DeepEqual(value, s.constValue) {
+		report("must be equal to the constant")
+	}
+
+	if s.enum != nil && !containsValue(s.enum, value) {
+		report("must be one of the allowed values")
+	}
+
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		s.validateObject(typedValue, path, violations)
+	case []interface{}:
+		s.validateArray(typedValue, path, violations)
+	case string:
+		length := utf8.RuneCountInString(typedValue)
+		if s.minLength != nil && length < *s.minLength {
+			report("must be at least %v characters long", *s.minLength)
+		}
+
+		if s.maxLength != nil && length > *s.maxLength {
+			report("must be at most %v characters long", *s.maxLength)
+		}
+
+		if s.pattern != nil && !s.pattern.MatchString(typedValue) {
+			report("must match pattern %v", s.pattern.String())
+		}
+	case float64:
+		if s.minimum != nil && typedValue < *s.minimum {
+			report("must be >= %v", *s.minimum)
+		}
+
+		if s.maximum != nil && typedValue > *s.maximum {
+			report("must be <= %v", *s.maximum)
+		}
+
+		if s.exclusiveMinimum != nil && typedValue <= *s.exclusiveMinimum {
+			report("must be > %v", *s.exclusiveMinimum)
+		}
+
+		if s.exclusiveMaximum != nil && typedValue >= *s.exclusiveMaximum {
+			report("must be < %v", *s.exclusiveMaximum)
+		}
+	}
+
+	for _, schema := range s.allOf {
+		schema.validate(value, path, violations)
+	}
+
+	if s.anyOf != nil {
+		matched := false
+		for _, schema := range s.anyOf {
+			if schema.Validate(value) == nil {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			report("must match at least one schema of anyOf")
+		}
+	}
+
+	if s.oneOf != nil {
+		matched := 0
+		for _, schema := range s.oneOf {
+			if schema.Validate(value) == nil {
+				matched++
+			}
+		}
+
+		if matched != 1 {
+			report("must match exactly one schema of oneOf")
+		}
+	}
+
+	if s.not != nil && s.not.Validate(value) == nil {
+		report("must not match the schema of not")
+	}
+}
+
+func (s *Schema) validateObject(object map[string]interface{}, path string, violations *[]js.Violation) {
+
+	for _, name := range s.required {
+		if _, ok := object[name]; !ok {
+			*violations = append(*violations, js.Violation{Path: path + "/" + name, Message: "is required"})
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		propertySchema, ok := s.properties[name]
+		if ok {
+			propertySchema.validate(object[name], path+"/"+name, violations)
+			continue
+		}
+
+		if s.additionalProperties != nil {
+			s.additionalProperties.validate(object[name], path+"/"+name, violations)
+		}
+	}
+}
+
+func (s *Schema) validateArray(array []interface{}, path string, violations *[]js.Violation) {
+
+	if s.minItems != nil && len(array) < *s.minItems {
+		*violations = append(*violations, js.Violation{Path: path, Message: fmt.Sprintf("must have at least %v items", *s.minItems)})
+	}
+
+	if s.maxItems != nil && len(array) > *s.maxItems {
+		*violations = append(*violations, js.Violation{Path: path, Message: fmt.Sprintf("must have at most %v items", *s.maxItems)})
+	}
+
+	if s.items == nil {
+		return
+	}
+
+	for i, item := range array {
+		s.items.validate(item, path+"/"+strconv.Itoa(i), violations)
+	}
+}
+
+func matchesSchemaType(value interface{}, types []string) bool {
+
+	for _, typeName := range types {
+		switch typeName {
+		case "null":
+			if value == nil {
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "object":
+			if _, ok := value.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := value.([]interface{}); ok {
+				return true
+			}
+		case "number":
+			if _, ok := value.(float64); ok {
+				return true
+			}
+		case "integer":
+			if number, ok := value.(float64); ok && number == math.Trunc(number) {
+				return true
+			}
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, item := range values {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
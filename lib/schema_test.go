@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func TestCompileSchema(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		schema string
+		valid  bool
+	}{
+		{"empty", `{}`, true},
+		{"true", `true`, true},
+		{"annotations", `{"title": "message", "description": "text", "$schema": "x", "format": "email"}`, true},
+		{"not json", `{"type": `, false},
+		{"not object", `"string"`, false},
+		{"unknown type", `{"type": "text"}`, false},
+		{"type list", `{"type": ["string", "null"]}`, true},
+		{"ref", `{"$ref": "#/definitions/a"}`, false},
+		{"enum not array", `{"enum": "a"}`, false},
+		{"required not strings", `{"required": [1]}`, false},
+		{"negative minLength", `{"minLength": -1}`, false},
+		{"fractional maxItems", `{"maxItems": 1.5}`, false},
+		{"wrong pattern", `{"pattern": "("}`, false},
+		{"minimum not number", `{"minimum": "1"}`, false},
+		{"empty anyOf", `{"anyOf": []}`, false},
+		{"nested unsupported", `{"properties": {"a": {"if": {}}}}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CompileSchema([]byte(test.schema))
+			if (err == nil) != test.valid {
+				t.Errorf("CompileSchema() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+
+	schema, err := CompileSchema([]byte(`{
+		"type": "object",
+		"required": ["text", "to"],
+		"additionalProperties": false,
+		"properties": {
+			"text": {"type": "string", "minLength": 1, "maxLength": 5},
+			"to": {"type": "array", "minItems": 1, "maxItems": 2, "items": {"type": "string", "pattern": "^u[0-9]+$"}},
+			"priority": {"type": "integer", "minimum": 1, "exclusiveMaximum": 4},
+			"kind": {"enum": ["chat", "system"]},
+			"version": {"const": 1},
+			"ttl": {"anyOf": [{"type": "null"}, {"type": "number", "exclusiveMinimum": 0}]},
+			"target": {"oneOf": [{"type": "string"}, {"type": "string", "maxLength": 2}]},
+			"tag": {"not": {"const": "spam"}}
+		}
+	}`))
+
+	if err != nil {
+		t.Fatalf("CompileSchema: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		document   string
+		violations []js.Violation
+	}{
+		{"valid", `{"text": "hi", "to": ["u1"], "priority": 3, "kind": "chat", "version": 1, "ttl": null, "target": "abc", "tag": "x"}`, nil},
+		{"not object", `[]`, []js.Violation{{Path: "", Message: "must be of type object"}}},
+		{"missing required", `{}`, []js.Violation{
+			{Path: "/text", Message: "is required"},
+			{Path: "/to", Message: "is required"},
+		}},
+		{"additional property", `{"text": "hi", "to": ["u1"], "extra": 1}`, []js.Violation{
+			{Path: "/extra", Message: "value is not allowed"},
+		}},
+		{"string limits", `{"text": "", "to": ["u1"]}`, []js.Violation{
+			{Path: "/text", Message: "must be at least 1 characters long"},
+		}},
+		{"string length in runes", `{"text": "привет", "to": ["u1"]}`, []js.Violation{
+			{Path: "/text", Message: "must be at most 5 characters long"},
+		}},
+		{"array items", `{"text": "hi", "to": ["u1", "x", "u3"]}`, []js.Violation{
+			{Path: "/to", Message: "must have at most 2 items"},
+			{Path: "/to/1", Message: "must match pattern ^u[0-9]+$"},
+		}},
+		{"integer", `{"text": "hi", "to": ["u1"], "priority": 1.5}`, []js.Violation{
+			{Path: "/priority", Message: "must be of type integer"},
+		}},
+		{"number limits", `{"text": "hi", "to": ["u1"], "priority": 4}`, []js.Violation{
+			{Path: "/priority", Message: "must be < 4"},
+		}},
+		{"enum and const", `{"text": "hi", "to": ["u1"], "kind": "other", "version": 2}`, []js.Violation{
+			{Path: "/kind", Message: "must be one of the allowed values"},
+			{Path: "/version", Message: "must be equal to the constant"},
+		}},
+		{"anyOf", `{"text": "hi", "to": ["u1"], "ttl": 0}`, []js.Violation{
+			{Path: "/ttl", Message: "must match at least one schema of anyOf"},
+		}},
+		{"oneOf", `{"text": "hi", "to": ["u1"], "target": "ab"}`, []js.Violation{
+			{Path: "/target", Message: "must match exactly one schema of oneOf"},
+		}},
+		{"not", `{"text": "hi", "to": ["u1"], "tag": "spam"}`, []js.Violation{
+			{Path: "/tag", Message: "must not match the schema of not"},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations := schema.Validate(decodeDocument(t, test.document))
+			if !reflect.DeepEqual(violations, test.violations) {
+				t.Errorf("Validate() = %v, want %v", violations, test.violations)
+			}
+		})
+	}
+}
+
+func TestEndpointValidatePayload(t *testing.T) {
+
+	schema, err := CompileSchema([]byte(`{"type": "object"}`))
+	if err != nil {
+		t.Fatalf("CompileSchema: %v", err)
+	}
+
+	endpoint := EndpointConfig{Name: "chat", Channel: "chat", compiledSchema: schema}
+
+	if violations := endpoint.validatePayload(newPayloadDocument([]byte(`{}`))); violations != nil {
+		t.Errorf("valid payload has violations %v", violations)
+	}
+
+	if violations := endpoint.validatePayload(newPayloadDocument([]byte(`{`))); len(violations) != 1 {
+		t.Errorf("payload which isn't json has violations %v", violations)
+	}
+
+	endpoint.compiledSchema = nil
+	if violations := endpoint.validatePayload(newPayloadDocument([]byte(`{`))); violations != nil {
+		t.Errorf("payload of endpoint without schema has violations %v", violations)
+	}
+}
+
+func TestEndpointConfigSchemaMessageTypes(t *testing.T) {
+
+	endpoint := EndpointConfig{Name: "chat", Channel: "chat", Schema: "chat.json"}
+	if endpoint.AllowsType(false) || !endpoint.AllowsType(true) {
+		t.Errorf("endpoint with schema must accept only text messages")
+	}
+
+	endpoint.MessageTypes = []string{TEXT_MESSAGE_TYPE, BINARY_MESSAGE_TYPE}
+	if endpoint.Validate() == nil {
+		t.Errorf("endpoint with schema and binary messages is valid")
+	}
+
+	endpoint.Schema = ""
+	if endpoint.Validate() != nil || !endpoint.AllowsType(false) {
+		t.Errorf("endpoint without schema must accept binary messages")
+	}
+}
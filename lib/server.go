@@ -8,6 +8,7 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/SermoDigital/jose/crypto"
 	"github.com/SermoDigital/jose/jws"
@@ -18,6 +19,48 @@ import (
 
 type Endpoint string
 
+const (
+	DefaultMaxInFlightRequests = 16
+	DefaultRequestTimeout      = 10 * time.Second
+)
+
+type ServerConfig struct {
+	DevMode                bool
+	EnableRouting          bool
+	EndpointsMap           map[Endpoint]cube.Channel
+	OnlyAuthorizedRequests bool
+	JwtSecret              string
+	Port                   int
+	MaxInFlightRequests    int
+	MaxRequestTimeout      time.Duration
+	LegacyFrames           bool
+	ForwardedClaims        []string
+	TenantClaim            string
+	DefaultTenantQuota     TenantQuota
+	TenantQuotas           map[TenantId]TenantQuota
+	BreakerThreshold       int
+	BreakerTimeout         time.Duration
+	DeadLetterChannel      cube.Channel
+	SpillQueueSize         int
+	NodeChannel            cube.Channel
+	NodeEventsChannel      cube.Channel
+	PresenceInterval       time.Duration
+	PresenceGracePeriod    time.Duration
+	PresenceChannel        cube.Channel
+	MaxPresenceWatches     int
+	PresenceAuthChannel    cube.Channel
+	SessionWindow          time.Duration
+	SessionBufferSize      int
+	Inbox                  *Inbox
+	DeliveryRetryInterval  time.Duration
+	DeliveryMaxAttempts    int
+	OrderedEvents          bool
+	Retained               *RetainedMessages
+	DedupWindow            time.Duration
+	MaxScheduledMessages   int
+	MaxEndpointLeases      int
+}
+
 type Server struct {
 	cubeInstance           cube.Cube
 	upgrader               websocket.Upgrader
@@ -29,22 +72,279 @@ type Server struct {
 	lastConnectionNumber   int64
 	port                   int
 	enableRouting          bool
-	endpointsMap           map[Endpoint]cube.Channel
+	routingTable           atomic.Value
+	endpointRegistry       *EndpointRegistry
+	trafficSplits          *TrafficSplits
+	metrics                *Metrics
+	maxInFlightRequests    int32
+	maxRequestTimeout      time.Duration
+	legacyFrames           bool
+	forwardedClaims        []string
+	tenantClaim            string
+	tenantLimits           *tenantLimits
+	breakers               *CircuitBreakers
+	deadLetterChannel      cube.Channel
+	spillQueue             *SpillQueue
+	clusterEnabled         bool
+	nodeChannel            cube.Channel
+	nodeEventsChannel      cube.Channel
+	presence               *PresenceRegistry
+	presenceInterval       time.Duration
+	presenceEvents         *presenceEvents
+	presenceQueue          *taskQueue
+	announceQueue          *taskQueue
+	presenceChannel        cube.Channel
+	presenceWatches        *PresenceWatches
+	maxPresenceWatches     int
+	presenceAuthChannel    cube.Channel
+	sessions               *Sessions
+	inbox                  *Inbox
+	deliveries             *Deliveries
+	orderedEvents          bool
+	retained               *RetainedMessages
+	deduplicator           *Deduplicator
+	scheduled              *ScheduledMessages
 }
 
-func NewServer(cubeInstance cube.Cube, devMode bool, enableRouting bool, endpointsMap map[Endpoint]cube.Channel,
-	onlyAuthorizedRequests bool, jwtSecret string, port int) *Server {
-	return &Server{
+// NewServer returns an error if the endpoints map has invalid endpoint names.
+func NewServer(cubeInstance cube.Cube, config ServerConfig) (*Server, error) {
+
+	maxInFlightRequests := config.MaxInFlightRequests
+	if maxInFlightRequests <= 0 {
+		maxInFlightRequests = DefaultMaxInFlightRequests
+	}
+
+	maxRequestTimeout := config.MaxRequestTimeout
+	if maxRequestTimeout <= 0 {
+		maxRequestTimeout = DefaultRequestTimeout
+	}
+
+	nodeEventsChannel := config.NodeEventsChannel
+	if nodeEventsChannel == "" {
+		nodeEventsChannel = DefaultNodeEventsChannel
+	}
+
+	presenceInterval := config.PresenceInterval
+	if presenceInterval <= 0 {
+		presenceInterval = DefaultPresenceInterval
+	}
+
+	maxPresenceWatches := config.MaxPresenceWatches
+	if maxPresenceWatches <= 0 {
+		maxPresenceWatches = DefaultMaxPresenceWatches
+	}
+
+	retained := config.Retained
+	if retained == nil {
+		retained, _ = LoadRetainedMessages("", 0)
+	}
+
+	routingTable, err := NewRoutingTable(config.EndpointsMap, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong endpoints map: %v", err)
+	}
+
+	server := &Server{
 		cubeInstance:           cubeInstance,
 		upgrader:               websocket.Upgrader{},
-		devMode:                devMode,
-		onlyAuthorizedRequests: onlyAuthorizedRequests,
-		jwtSecret:              jwtSecret,
+		devMode:                config.DevMode,
+		onlyAuthorizedRequests: config.OnlyAuthorizedRequests,
+		jwtSecret:              config.JwtSecret,
 		connections:            NewConnectionsStorage(),
-		port:                   port,
-		enableRouting:          enableRouting,
-		endpointsMap:           endpointsMap,
+		port:                   config.Port,
+		enableRouting:          config.EnableRouting,
+		endpointRegistry:       NewEndpointRegistry(config.MaxEndpointLeases),
+		trafficSplits:          NewTrafficSplits(),
+		metrics:                NewMetrics(),
+		maxInFlightRequests:    int32(maxInFlightRequests),
+		maxRequestTimeout:      maxRequestTimeout,
+		legacyFrames:           config.LegacyFrames,
+		forwardedClaims:        config.ForwardedClaims,
+		tenantClaim:            config.TenantClaim,
+		tenantLimits:           newTenantLimits(config.DefaultTenantQuota, config.TenantQuotas),
+		breakers:               NewCircuitBreakers(config.BreakerThreshold, config.BreakerTimeout),
+		deadLetterChannel:      config.DeadLetterChannel,
+		spillQueue:             NewSpillQueue(config.SpillQueueSize),
+		clusterEnabled:         config.NodeChannel != "",
+		nodeChannel:            config.NodeChannel,
+		nodeEventsChannel:      nodeEventsChannel,
+		presence:               NewPresenceRegistry(presenceMissedSnapshots * presenceInterval),
+		presenceInterval:       presenceInterval,
+		presenceChannel:        config.PresenceChannel,
+		presenceWatches:        NewPresenceWatches(),
+		presenceQueue:          newTaskQueue(),
+		announceQueue:          newTaskQueue(),
+		maxPresenceWatches:     maxPresenceWatches,
+		presenceAuthChannel:    config.PresenceAuthChannel,
+		inbox:                  config.Inbox,
+		deliveries:             NewDeliveries(config.DeliveryRetryInterval, config.DeliveryMaxAttempts),
+		orderedEvents:          config.OrderedEvents,
+		retained:               retained,
+		deduplicator:           NewDeduplicator(config.DedupWindow),
+		scheduled:              NewScheduledMessages(config.MaxScheduledMessages),
+	}
+
+	server.presenceEvents = newPresenceEvents(config.PresenceGracePeriod, server.queuePresenceEvent)
+	server.sessions = NewSessions(config.SessionWindow, config.SessionBufferSize, server.writeMessage, server.announceSession,
+		server.failDelivery)
+	server.connections.SetRemoveListener(server.onConnectionRemoved)
+
+	server.connections.SetUserListener(server.onUserChange)
+	server.SetRoutingTable(routingTable)
+	return server, nil
+}
+
+func (s *Server) SetRoutingTable(table *RoutingTable) {
+	s.routingTable.Store(table)
+	s.updateSplitMetrics()
+}
+
+// SetTrafficSplit overrides the split of the routing config for the endpoint, nil split restores it.
+func (s *Server) SetTrafficSplit(endpoint Endpoint, split *TrafficSplit) {
+	s.trafficSplits.Set(endpoint, split)
+	s.updateSplitMetrics()
+}
+
+func (s *Server) getTrafficSplit(endpoint *EndpointConfig) *TrafficSplit {
+
+	split := s.trafficSplits.Get(endpoint.Name)
+	if split != nil {
+		return split
+	}
+
+	return endpoint.Split
+}
+
+// updateSplitMetrics exposes weights of the effective splits as "routing.splitWeight.<endpoint>.<channel>".
+func (s *Server) updateSplitMetrics() {
+
+	s.metrics.DeletePrefix("routing.splitWeight.")
+
+	setWeights := func(endpoint Endpoint, split *TrafficSplit) {
+		for _, target := range split.Targets {
+			s.metrics.Set(fmt.Sprintf("routing.splitWeight.%v.%v", endpoint, target.Channel), int64(target.Weight))
+		}
+	}
+
+	s.getRoutingTable().forEach(func(endpoint *EndpointConfig) {
+		split := s.getTrafficSplit(endpoint)
+		if split != nil {
+			setWeights(endpoint.Name, split)
+		}
+	})
+
+	s.trafficSplits.forEach(func(endpoint Endpoint, split *TrafficSplit) {
+		if s.getRoutingTable().Get(endpoint) == nil {
+			setWeights(endpoint, split)
+		}
+	})
+}
+
+// selectChannel picks the channel by content rules first, then by the traffic split.
+func (s *Server) selectChannel(connection *Connection, endpoint *EndpointConfig, payload *payloadDocument) cube.Channel {
+
+	channel, ok := endpoint.ruleChannel(payload)
+	if ok {
+		return channel
+	}
+
+	split := s.getTrafficSplit(endpoint)
+	if split == nil {
+		return endpoint.Channel
+	}
+
+	connectionId, userId, _ := connection.GetInfo()
+	if userId == "" {
+		userId = UserId(fmt.Sprintf("connection:%v", connectionId))
+	}
+
+	channel = split.Select(string(endpoint.Name), userId)
+	s.metrics.Add(fmt.Sprintf("routing.splitMessages.%v.%v", endpoint.Name, channel), 1)
+	return channel
+}
+
+func (s *Server) getRoutingTable() *RoutingTable {
+	return s.routingTable.Load().(*RoutingTable)
+}
+
+// resolveEndpoint looks up the routing table first, so registered endpoints can't override static ones.
+// The default channel is used only if nothing matches.
+func (s *Server) resolveEndpoint(endpoint Endpoint) *EndpointConfig {
+
+	if endpoint == "" {
+		return nil
 	}
+
+	table := s.getRoutingTable()
+
+	endpointConfig := table.Match(endpoint)
+	if endpointConfig != nil {
+		return endpointConfig
+	}
+
+	endpointConfig = s.endpointRegistry.Match(endpoint)
+	if endpointConfig != nil {
+		return endpointConfig
+	}
+
+	return table.Default()
+}
+
+func (s *Server) RegisterEndpoint(endpoint Endpoint, channel cube.Channel, ttl time.Duration) (time.Time, error) {
+
+	expiresAt, err := s.endpointRegistry.Register(endpoint, channel, ttl)
+	if err == ErrorEndpointTaken {
+		s.metrics.Add("endpoints.conflicts", 1)
+	}
+
+	if err == ErrorTooManyEndpoints {
+		s.metrics.Add("endpoints.rejected", 1)
+	}
+
+	return expiresAt, err
+}
+
+func (s *Server) UnregisterEndpoint(endpoint Endpoint, channel cube.Channel) bool {
+	return s.endpointRegistry.Unregister(endpoint, channel)
+}
+
+// GetRoutingEntries returns the effective routing table.
+func (s *Server) GetRoutingEntries() []js.RoutingEntry {
+
+	table := s.getRoutingTable()
+	entries := []js.RoutingEntry{}
+
+	table.forEach(func(endpoint *EndpointConfig) {
+		entries = append(entries, js.RoutingEntry{
+			Endpoint: string(endpoint.Name),
+			Channel:  string(endpoint.Channel),
+			Source:   js.STATIC_ROUTE,
+		})
+	})
+
+	s.endpointRegistry.forEach(func(endpoint Endpoint, channel cube.Channel, expiresAt time.Time) {
+		if table.Get(endpoint) != nil {
+			return
+		}
+
+		entries = append(entries, js.RoutingEntry{
+			Endpoint:  string(endpoint),
+			Channel:   string(channel),
+			Source:    js.DYNAMIC_ROUTE,
+			ExpiresAt: expiresAt.UnixNano() / int64(time.Millisecond),
+		})
+	})
+
+	return entries
+}
+
+func (s *Server) GetMetrics() *Metrics {
+	return s.metrics
+}
+
+// GetInbox returns the offline inbox or nil if it is disabled.
+func (s *Server) GetInbox() *Inbox {
+	return s.inbox
 }
 
 func (s *Server) Start(cubeInstance cube.Cube) {
@@ -55,6 +355,19 @@ func (s *Server) Start(cubeInstance cube.Cube) {
 	}
 
 	s.httpServer = &srv
+	go s.replaySpilledMessages()
+	go s.scheduled.Run()
+	go s.presenceQueue.Run()
+	go s.announceQueue.Run()
+	s.announceNode("onNodeStarted")
+
+	if s.clusterEnabled {
+		go s.publishPresenceSnapshots()
+	}
+
+	if s.sessions.Enabled() {
+		go s.removeExpiredSessions()
+	}
 
 	fmt.Println("Start http listening")
 	cubeInstance.LogInfo("Start http listening")
@@ -68,33 +381,66 @@ func (s *Server) Start(cubeInstance cube.Cube) {
 	cubeInstance.LogFatal(err.Error())
 }
 
-func (s *Server) getAuthData(tokenString string) (*UserId, *DeviceId, error) {
+// Stop announces that the node has left the cluster.
+func (s *Server) Stop() {
+	s.announceNode("onNodeStopped")
+}
+
+func (s *Server) getAuthData(tokenString string) (*UserId, *DeviceId, Claims, error) {
 
 	if tokenString == "" {
-		return nil, nil, fmt.Errorf("empty token")
+		return nil, nil, nil, fmt.Errorf("empty token")
 	}
 
 	newToken, err := jws.ParseJWT([]byte(tokenString))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	err = newToken.Validate([]byte(s.jwtSecret), crypto.SigningMethodHS512)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	claims := newToken.Claims()
-	userId := UserId(claims.Get("userId").(string))
-	deviceId := DeviceId(claims.Get("deviceId").(string))
 
-	return &userId, &deviceId, nil
+	rawUserId, ok := claims.Get("userId").(string)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("wrong userId claim")
+	}
+
+	rawDeviceId, ok := claims.Get("deviceId").(string)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("wrong deviceId claim")
+	}
+
+	userId := UserId(rawUserId)
+	deviceId := DeviceId(rawDeviceId)
+
+	return &userId, &deviceId, Claims(claims), nil
+}
+
+// getTenant reads the tenant from claims, it is required if tenants are enabled.
+func (s *Server) getTenant(claims Claims) (TenantId, error) {
+
+	if s.tenantClaim == "" {
+		return "", nil
+	}
+
+	tenant, ok := claims[s.tenantClaim].(string)
+	if !ok || !IsValidTenant(TenantId(tenant)) {
+		return "", fmt.Errorf("wrong %v claim", s.tenantClaim)
+	}
+
+	return TenantId(tenant), nil
 }
 
 //On connection
 func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	var userId *UserId
 	var deviceId *DeviceId
+	var claims Claims
+	var tenantId TenantId
 	var err error
 
 	if s.devMode {
@@ -123,7 +469,7 @@ func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 
 	if token != "" && s.jwtSecret != "" {
 
-		userId, deviceId, err = s.getAuthData(token)
+		userId, deviceId, claims, err = s.getAuthData(token)
 
 		if err != nil {
 			http.Error(writer,
@@ -140,25 +486,58 @@ func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if s.tenantClaim != "" {
+
+		if userId == nil {
+			http.Error(writer,
+				http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		tenantId, err = s.getTenant(claims)
+		if err != nil {
+			http.Error(writer,
+				http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		// The slot is reserved until the connection is stored, so concurrent connections can't exceed the quota.
+		maxConnections := s.tenantLimits.getQuota(tenantId).MaxConnections
+		if !s.connections.ReserveTenantConnection(tenantId, maxConnections) {
+			s.metrics.Add("tenants.rejectedConnections", 1)
+			http.Error(writer,
+				http.StatusText(http.StatusTooManyRequests),
+				http.StatusTooManyRequests)
+			return
+		}
+	}
+
 	responseHeader := http.Header{}
 	responseHeader.Set("Sec-WebSocket-Protocol", "token")
 	connection, err := s.upgrader.Upgrade(writer, request, responseHeader)
 	if err != nil {
+		if tenantId != "" {
+			s.connections.ReleaseTenantConnection(tenantId)
+		}
+
 		return
 	}
 
 	fmt.Println(deviceId)
 	connection.SetReadLimit(100000000)
-	con := s.registerConnection(connection)
-	//TODO: add onlyAuthorized connections support
-	con.Login(*userId, *deviceId)
+	con := s.registerConnection(connection, userId, deviceId, tenantId, claims, parseSessionRequest(request))
+
+	// onConnect is published before messages of the connection are read, so it is always the first event.
+	s.publishEvent(con, TenantChannel(cube.Channel("wsOutput"), tenantId), func(seq uint64) *cube.Message {
+		packedMessage, _ := s.packMessage(con, con.id, userId, deviceId, claims, "", "onConnect", &[]byte{}, seq)
+		return packedMessage
+	})
 
 	go s.handleInputMessages(con)
 	s.cleanConnectionsIfNeed(con)
 
-	packedMessage, _ := s.packMessage(userId, deviceId, "onConnect", &[]byte{})
-	s.cubeInstance.PublishMessage(cube.Channel("wsOutput"), *packedMessage)
-
 	//TODO: add onlyAuthorized connections support
 }
 
@@ -170,7 +549,7 @@ func (s *Server) cleanConnectionsIfNeed(netConnection *Connection) {
 	if stats.NumberOfNotLoggedConnections > 200 {
 		s.connections.RemoveIf(func(con *Connection) bool {
 
-			return now-con.GetStartTime().Unix() > 60
+			return con.userId == "" && now-con.startTime.Unix() > 60
 
 		}, func(connections []*Connection) {
 
@@ -186,8 +565,8 @@ func (s *Server) handleInputMessages(netConnection *Connection) {
 	for {
 		messageType, message, err := netConnection.ReadMessage()
 		if err != nil {
-			netConnection.Close(websocket.CloseInternalServerErr, "ServerError")
 			s.onClose(netConnection)
+			netConnection.Close(websocket.CloseInternalServerErr, "ServerError")
 			return
 		}
 
@@ -209,11 +588,30 @@ func (s *Server) getNewConnectionId() ConnectionId {
 	return ConnectionId(atomic.AddInt64(&s.lastConnectionNumber, 1))
 }
 
-func (s *Server) registerConnection(connection *websocket.Conn) *Connection {
+// registerConnection logs the connection in before it is stored, so it is indexed by its tenant.
+// The connection is attached to its session before it is stored, so missed messages are replayed first.
+func (s *Server) registerConnection(connection *websocket.Conn, userId *UserId, deviceId *DeviceId, tenantId TenantId, claims Claims,
+	sessionRequest *SessionRequest) *Connection {
 
 	wsConnection := NewConnection(s.getNewConnectionId(), connection)
+	if userId != nil {
+		wsConnection.Login(*userId, *deviceId, tenantId, claims)
+
+		if sessionRequest != nil && s.sessions.Enabled() {
+			s.sessions.Attach(wsConnection, *sessionRequest)
+		}
+
+	}
+
 	s.connections.AddNewConnection(wsConnection)
 
+	// Retained messages and the inbox are sent after the connection is added, so messages retained or stored
+	// meanwhile are sent to it too.
+	if userId != nil {
+		s.sendRetainedMessages(wsConnection)
+		s.flushInbox(wsConnection)
+	}
+
 	connection.SetCloseHandler(func(code int, text string) error {
 		s.onClose(wsConnection)
 		return nil
@@ -222,8 +620,14 @@ func (s *Server) registerConnection(connection *websocket.Conn) *Connection {
 	return wsConnection
 }
 
-func (s *Server) unregisterConnection(connection *Connection) {
-	s.connections.RemoveConnection(connection)
+func (s *Server) onConnectionRemoved(connectionId ConnectionId) {
+	s.presenceWatches.RemoveConnection(connectionId)
+	s.sessions.Detach(connectionId)
+	s.failConnectionDeliveries(connectionId)
+}
+
+func (s *Server) unregisterConnection(connection *Connection) bool {
+	return s.connections.RemoveConnection(connection)
 }
 
 func (s *Server) onClose(connection *Connection) {
@@ -233,42 +637,76 @@ func (s *Server) onClose(connection *Connection) {
 		return
 	}
 
-	s.unregisterConnection(connection)
-	packedMessage, _ := s.packMessage(&userId, &deviceId, "onClose", &[]byte{})
-	s.cubeInstance.PublishMessage(cube.Channel("wsOutput"), *packedMessage)
+	claims := connection.GetClaims()
+	tenantId := connection.GetTenant()
+
+	if !s.unregisterConnection(connection) {
+		return
+	}
+
+	s.publishEvent(connection, TenantChannel(cube.Channel("wsOutput"), tenantId), func(seq uint64) *cube.Message {
+		packedMessage, _ := s.packMessage(connection, connectionId, &userId, &deviceId, claims, "", "onClose", &[]byte{}, seq)
+		return packedMessage
+	})
 }
 
 func (s *Server) onReceiveMessage(connection *Connection, isText bool, rawBody *[]byte) {
 
 	outputChannel := cube.Channel("wsOutput")
 	body := rawBody
+	requestId := ""
+	endpointName := Endpoint("")
+	tenantId := connection.GetTenant()
+
+	if tenantId != "" && !s.tenantLimits.allowMessage(tenantId) {
+		s.metrics.Add("tenants.rateLimited", 1)
+		s.sendError(connection, js.ERROR_RATE_LIMIT, "", true)
+		return
+	}
+
+	if isText && s.handleControlFrame(connection, *rawBody) {
+		return
+	}
 
 	if s.enableRouting {
 
-		var packet js.RoutingPacket
-		err := json.Unmarshal(*rawBody, &packet)
+		packet, err := parseRoutingPacket(isText, *rawBody)
 		if err != nil {
-			connection.SendText([]byte("ErrorParsingRoutingPacket"))
+			s.sendError(connection, js.ERROR_PARSING_ROUTING_PACKET, "", false)
 			return
 		}
 
-		outputChannel = s.endpointsMap[Endpoint(packet.Endpoint)]
-		if outputChannel == "" {
-			connection.SendText([]byte("ErrorEndpointNotFound"))
+		endpoint := s.resolveEndpoint(Endpoint(packet.Endpoint))
+		if endpoint == nil {
+			s.sendError(connection, js.ERROR_ENDPOINT_NOT_FOUND, packet.RequestId, false)
 			return
 		}
 
 		if len(packet.Payload) == 0 {
-			connection.SendText([]byte("ErrorEmptyPayload"))
+			s.sendError(connection, js.ERROR_EMPTY_PAYLOAD, packet.RequestId, false)
+			return
+		}
+
+		payload := newPayloadDocument(packet.Payload)
+		if !s.checkEndpointLimits(connection, endpoint, isText, packet, payload) {
+			return
+		}
+
+		outputChannel = s.selectChannel(connection, endpoint, payload)
+
+		if packet.Mode == js.REQUEST_MODE {
+			s.handleRequest(connection, endpoint, outputChannel, packet, isText)
 			return
 		}
 
 		body = (*[]byte)(&packet.Payload)
+		requestId = packet.RequestId
+		endpointName = Endpoint(packet.Endpoint)
 
 	} else {
-		mapChannel := s.endpointsMap["wsOutput"]
-		if mapChannel != "" {
-			outputChannel = mapChannel
+		endpoint := s.getRoutingTable().Get("wsOutput")
+		if endpoint != nil {
+			outputChannel = endpoint.Channel
 		}
 	}
 
@@ -277,22 +715,231 @@ func (s *Server) onReceiveMessage(connection *Connection, isText bool, rawBody *
 		method = "onBinaryMessage"
 	}
 
-	_, userId, deviceId := connection.GetInfo()
-	packedMessage, err := s.packMessage(&userId, &deviceId, method, body)
+	connectionId, userId, deviceId := connection.GetInfo()
+	err := s.publishClientEvent(connection, TenantChannel(outputChannel, tenantId), func(seq uint64) *cube.Message {
+		packedMessage, _ := s.packMessage(connection, connectionId, &userId, &deviceId, connection.GetClaims(), endpointName, method, body, seq)
+		return packedMessage
+	})
+
+	// Queued messages are delivered later from the dead letter channel, the client mustn't retry them.
+	if err == ErrorMessageQueued {
+		s.sendNotice(connection, js.NOTICE_QUEUED, requestId)
+		return
+	}
+
+	if err == ErrorServiceUnavailable {
+		s.sendError(connection, js.ERROR_SERVICE_UNAVAILABLE, requestId, true)
+		return
+	}
+
+	if requestId != "" {
+		s.sendAck(connection, requestId)
+	}
+}
+
+// parseRoutingPacket reads json packet from text frames and binary packet from binary frames,
+// payload of binary packet refers to the frame data.
+func parseRoutingPacket(isText bool, data []byte) (*js.RoutingPacket, error) {
+
+	if isText {
+		var packet js.RoutingPacket
+		err := json.Unmarshal(data, &packet)
+		if err != nil {
+			return nil, err
+		}
+
+		return &packet, nil
+	}
+
+	binaryPacket, err := js.ParseBinaryRoutingPacket(data)
 	if err != nil {
+		return nil, err
+	}
+
+	packet := &js.RoutingPacket{
+		Endpoint:  string(binaryPacket.Endpoint),
+		RequestId: string(binaryPacket.RequestId),
+		Timeout:   int64(binaryPacket.Timeout),
+		Payload:   json.RawMessage(binaryPacket.Payload),
+	}
+
+	if binaryPacket.IsRequest() {
+		packet.Mode = js.REQUEST_MODE
+	}
+
+	return packet, nil
+}
+
+// checkEndpointLimits answers the client with an error frame if the packet isn't allowed by the endpoint config.
+func (s *Server) checkEndpointLimits(connection *Connection, endpoint *EndpointConfig, isText bool, packet *js.RoutingPacket,
+	payload *payloadDocument) bool {
+
+	if (endpoint.RequireAuth || endpoint.Policy != nil) && !connection.IsLoggedIn() {
+		s.metrics.Add("messages.unauthorized", 1)
+		s.sendError(connection, js.ERROR_UNAUTHORIZED, packet.RequestId, false)
+		return false
+	}
+
+	if endpoint.Policy != nil && !endpoint.Policy.IsAllowed(connection.GetClaims()) {
+		s.metrics.Add("messages.forbidden", 1)
+		s.sendError(connection, js.ERROR_FORBIDDEN, packet.RequestId, false)
+		return false
+	}
+
+	if !endpoint.AllowsType(isText) {
+		s.metrics.Add("messages.wrongType", 1)
+		s.sendError(connection, js.ERROR_WRONG_MESSAGE_TYPE, packet.RequestId, false)
+		return false
+	}
+
+	if endpoint.MaxSize > 0 && len(packet.Payload) > endpoint.MaxSize {
+		s.metrics.Add("messages.tooBig", 1)
+		s.sendError(connection, js.ERROR_MESSAGE_TOO_BIG, packet.RequestId, false)
+		return false
+	}
+
+	if endpoint.RateLimit > 0 && !connection.AllowEndpointMessage(endpoint.Name, endpoint.RateLimit, endpoint.RateBurst) {
+		s.metrics.Add("messages.rateLimited", 1)
+		s.sendError(connection, js.ERROR_RATE_LIMIT, packet.RequestId, true)
+		return false
+	}
+
+	violations := endpoint.validatePayload(payload)
+	if violations != nil {
+		s.metrics.Add("messages.invalid", 1)
+		s.sendViolations(connection, packet.RequestId, violations)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) handleRequest(connection *Connection, endpoint *EndpointConfig, channel cube.Channel, packet *js.RoutingPacket,
+	isText bool) {
+
+	if packet.RequestId == "" {
+		s.sendError(connection, js.ERROR_EMPTY_REQUEST_ID, "", false)
 		return
 	}
 
-	s.cubeInstance.PublishMessage(outputChannel, *packedMessage)
+	if !connection.AcquireRequestSlot(s.maxInFlightRequests) {
+		s.sendError(connection, js.ERROR_TOO_MANY_REQUESTS, packet.RequestId, true)
+		return
+	}
+
+	timeout := s.maxRequestTimeout
+	if endpoint.Timeout > 0 && time.Duration(endpoint.Timeout)*time.Millisecond < timeout {
+		timeout = time.Duration(endpoint.Timeout) * time.Millisecond
+	}
+
+	if packet.Timeout > 0 && time.Duration(packet.Timeout)*time.Millisecond < timeout {
+		timeout = time.Duration(packet.Timeout) * time.Millisecond
+	}
+
+	messageType := js.TEXT
+	if !isText {
+		messageType = js.BINARY
+	}
+
+	// Requests have their own numbers, so gaps in events of the output channel are always lost events.
+	connectionId, userId, deviceId := connection.GetInfo()
+	params := js.OnReceiveRequestParams{
+		ConnectionId:  int64(connectionId),
+		ConnectionUid: connection.GetUid(),
+		Seq:           connection.nextRequestSeq(),
+		DeviceId:      (*string)(&deviceId),
+		UserId:        (*string)(&userId),
+		RequestId:     packet.RequestId,
+		Type:          messageType,
+		InputTime:     time.Now().UnixNano(),
+		Endpoint:      packet.Endpoint,
+		Claims:        s.forwardClaims(connection.GetClaims()),
+		Body:          packet.Payload,
+	}
+
+	packedParams, _ := json.Marshal(params)
+	request := cube.Request{
+		Method: "onRequest",
+		Params: (*json.RawMessage)(&packedParams),
+	}
+
+	go func() {
+		defer connection.ReleaseRequestSlot()
+
+		response, err := s.callMethod(TenantChannel(channel, connection.GetTenant()), request, timeout)
+		if err == cube.ErrorTimeout {
+			s.sendError(connection, js.ERROR_TIMEOUT, packet.RequestId, true)
+			return
+		}
+
+		if err == ErrorCircuitOpen {
+			s.sendError(connection, js.ERROR_SERVICE_UNAVAILABLE, packet.RequestId, true)
+			return
+		}
+
+		if err != nil || response == nil {
+			s.sendError(connection, js.ERROR_SERVER, packet.RequestId, true)
+			return
+		}
+
+		response.Id = packet.RequestId
+		s.sendResponse(connection, *response)
+	}()
 }
 
-func (s *Server) packMessage(userId *UserId, deviceId *DeviceId, method string, body *[]byte) (*cube.Message, error) {
+// forwardClaims picks configured claims to be sent to backends, they can trust them as the token is validated.
+func (s *Server) forwardClaims(claims Claims) map[string]interface{} {
+
+	if len(s.forwardedClaims) == 0 || claims == nil {
+		return nil
+	}
+
+	forwarded := map[string]interface{}{}
+	for _, name := range s.forwardedClaims {
+		value, ok := claims[name]
+		if ok {
+			forwarded[name] = value
+		}
+	}
+
+	return forwarded
+}
+
+// publishEvent numbers the event of the connection and publishes it. With ordered events the connection
+// is locked until the event is published, so events reach the bus in the order of their numbers.
+func (s *Server) publishEvent(connection *Connection, channel cube.Channel, packEvent func(seq uint64) *cube.Message) error {
+	return s.publishEventWith(s.publish, connection, channel, packEvent)
+}
+
+// publishClientEvent publishes the event the same way with publishClientMessage.
+func (s *Server) publishClientEvent(connection *Connection, channel cube.Channel, packEvent func(seq uint64) *cube.Message) error {
+	return s.publishEventWith(s.publishClientMessage, connection, channel, packEvent)
+}
+
+func (s *Server) publishEventWith(publish func(channel cube.Channel, message cube.Message) error, connection *Connection,
+	channel cube.Channel, packEvent func(seq uint64) *cube.Message) error {
+
+	if s.orderedEvents {
+		connection.eventMutex.Lock()
+		defer connection.eventMutex.Unlock()
+	}
+
+	return publish(channel, *packEvent(connection.nextEventSeq()))
+}
+
+func (s *Server) packMessage(connection *Connection, connectionId ConnectionId, userId *UserId, deviceId *DeviceId, claims Claims,
+	endpoint Endpoint, method string, body *[]byte, seq uint64) (*cube.Message, error) {
 
 	params := js.OnReceiveMessageParams{
-		DeviceId:  (*string)(deviceId),
-		UserId:    (*string)(userId),
-		InputTime: time.Now().UnixNano(),
-		Body:      *body,
+		ConnectionId:  int64(connectionId),
+		ConnectionUid: connection.GetUid(),
+		Seq:           seq,
+		Endpoint:      string(endpoint),
+		DeviceId:      (*string)(deviceId),
+		UserId:        (*string)(userId),
+		Claims:        s.forwardClaims(claims),
+		InputTime:     time.Now().UnixNano(),
+		Body:          *body,
 	}
 
 	packedParams, _ := json.Marshal(params)
@@ -305,42 +952,197 @@ func (s *Server) packMessage(userId *UserId, deviceId *DeviceId, method string,
 	return messageData, nil
 }
 
-func (s *Server) CloseDeviceConnections(userId UserId, deviceId DeviceId, reason string) {
-	s.connections.RemoveDeviceConnections(userId, deviceId, func(connections []*Connection) {
+// Close frame payload is limited to 125 bytes, two of them are taken by the code.
+const MaxCloseReasonLength = 123
+
+// IsValidCloseCode reports whether the code can be sent to clients in a close frame.
+func IsValidCloseCode(code int) bool {
+	switch code {
+	case websocket.CloseNormalClosure,
+		websocket.CloseGoingAway,
+		websocket.ClosePolicyViolation,
+		websocket.CloseMessageTooBig,
+		websocket.CloseInternalServerErr,
+		websocket.CloseServiceRestart,
+		websocket.CloseTryAgainLater:
+		return true
+	}
+
+	return code >= 3000 && code <= 4999
+}
+
+// normalizeClose defaults the code and cuts the reason on a rune boundary, so it fits the close frame.
+func normalizeClose(code int, reason string) (int, string) {
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+
+	if len(reason) > MaxCloseReasonLength {
+		end := MaxCloseReasonLength
+		for end > 0 && !utf8.RuneStart(reason[end]) {
+			end--
+		}
+
+		reason = reason[:end]
+	}
+
+	return code, reason
+}
+
+// CloseDeviceConnections closes connections of the tenant, empty tenant means any tenant.
+func (s *Server) CloseDeviceConnections(tenantId TenantId, userId UserId, deviceId DeviceId, code int, reason string) {
+	code, reason = normalizeClose(code, reason)
+
+	s.connections.RemoveDeviceConnections(tenantId, userId, deviceId, func(connections []*Connection) {
 
 		for _, connection := range connections {
-			connection.Close(websocket.CloseNormalClosure, reason)
+			connection.Close(code, reason)
 		}
 	})
 }
 
-func (s *Server) CloseUserConnections(userId UserId, reason string) {
-	s.connections.RemoveUserConnections(userId, func(connections []*Connection) {
+func (s *Server) CloseUserConnections(tenantId TenantId, userId UserId, exceptDevices []DeviceId, code int, reason string) {
+	code, reason = normalizeClose(code, reason)
+
+	s.connections.RemoveUserConnectionsExcept(tenantId, userId, exceptDevices, func(connections []*Connection) {
 
 		for _, connection := range connections {
-			connection.Close(websocket.CloseNormalClosure, reason)
+			connection.Close(code, reason)
 		}
 	})
 }
 
-func (s *Server) SendMessage(userId *UserId, deviceId *DeviceId, messageType js.MessageType, message []byte) {
+// Exclusion lists connections which must be skipped while sending a message.
+type Exclusion struct {
+	ConnectionIds []ConnectionId
+	DeviceIds     []DeviceId
+}
+
+func (e *Exclusion) excludes(connection *Connection) bool {
+	connectionId, _, deviceId := connection.GetInfo()
+
+	for _, id := range e.ConnectionIds {
+		if id == connectionId {
+			return true
+		}
+	}
+
+	return e.excludesDevice(deviceId)
+}
+
+func (e *Exclusion) excludesDevice(deviceId DeviceId) bool {
+	for _, id := range e.DeviceIds {
+		if id == deviceId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SendOptions are delivery options of SendMessage.
+type SendOptions struct {
+	// Store puts messages to users and devices without connections into the offline inbox for StoreTtl.
+	Store    bool
+	StoreTtl time.Duration
+	// Reliable messages are retransmitted until the client acknowledges them.
+	Reliable bool
+	// ExpiresAt discards the message if it isn't sent, buffered in sessions or retransmitted by then.
+	ExpiresAt time.Time
+}
+
+func (o SendOptions) expired(now time.Time) bool {
+	return !o.ExpiresAt.IsZero() && !now.Before(o.ExpiresAt)
+}
+
+// GetConnectionIdByUid returns false if the connection isn't on this instance.
+func (s *Server) GetConnectionIdByUid(uid string) (ConnectionId, bool) {
+
+	connection := s.connections.GetConnectionByUid(uid)
+	if connection == nil {
+		return 0, false
+	}
+
+	connectionId, _, _ := connection.GetInfo()
+	return connectionId, connectionId != -1
+}
+
+func (s *Server) IsClusterEnabled() bool {
+	return s.clusterEnabled
+}
+
+// SendMessage sends the message to connections of the tenant, empty tenant means any tenant.
+func (s *Server) SendMessage(tenantId TenantId, connectionId *ConnectionId, userId *UserId, deviceId *DeviceId,
+	exclusion Exclusion, messageType js.MessageType, message []byte, options SendOptions) {
+
+	if options.expired(time.Now()) {
+		s.metrics.Add("messages.expired", 1)
+		return
+	}
 
 	connections := []*Connection{}
-	if deviceId != nil {
-		connections = s.connections.GetDeviceConnections(*userId, *deviceId)
+	if connectionId != nil {
+		connection := s.connections.GetConnectionById(*connectionId)
+		if connection != nil && connection.IsLoggedIn() && (tenantId == "" || connection.GetTenant() == tenantId) {
+			_, connectionUserId, _ := connection.GetInfo()
+			if userId == nil || *userId == connectionUserId {
+				connections = append(connections, connection)
+			}
+		}
+	} else if deviceId != nil && userId != nil {
+		connections = s.connections.GetDeviceConnections(tenantId, *userId, *deviceId)
 	} else if userId != nil {
-		connections = s.connections.GetUserConnections(*userId)
+		connections = s.connections.GetUserConnections(tenantId, *userId)
 	}
 
-	if len(connections) > 0 {
-		for _, connection := range connections {
-			switch messageType {
-			case js.TEXT:
-				connection.SendText(message)
-			case js.BINARY:
-				connection.SendBinary(message)
+	if connectionId == nil && userId != nil && len(connections) == 0 && options.Store {
+		s.storeMessage(tenantId, *userId, deviceId, messageType, message, options)
+		return
+	}
+
+	// Messages to users and devices are buffered in their sessions even if there are no connections.
+	if connectionId == nil && userId != nil && s.sessions.Enabled() {
+		for _, session := range s.sessions.Find(tenantId, *userId, deviceId) {
+			if !exclusion.excludesDevice(session.deviceId) {
+				s.sessions.Send(session, messageType, message, options, exclusion)
 			}
+		}
+	}
+
+	for _, connection := range connections {
+		if exclusion.excludes(connection) {
+			continue
+		}
 
+		// Connections with sessions got messages to users and devices through their sessions.
+		id, _, _ := connection.GetInfo()
+		if connectionId == nil && s.sessions.HasConnection(id) {
+			continue
 		}
+
+		s.sendToConnection(connection, messageType, message, options)
 	}
 }
+
+// sendToConnection sends the message to the connection only, messages to connections with sessions aren't buffered.
+func (s *Server) sendToConnection(connection *Connection, messageType js.MessageType, message []byte, options SendOptions) error {
+
+	connectionId, _, _ := connection.GetInfo()
+	if options.Reliable || s.sessions.HasConnection(connectionId) {
+		return s.writeMessage(connection, sessionEntry{
+			messageType: messageType,
+			message:     message,
+			reliable:    options.Reliable,
+			expiresAt:   options.ExpiresAt,
+		})
+	}
+
+	switch messageType {
+	case js.TEXT:
+		return connection.SendText(message)
+	case js.BINARY:
+		return connection.SendBinary(message)
+	}
+
+	return fmt.Errorf("wrong message type %v", messageType)
+}
@@ -0,0 +1,584 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/SermoDigital/jose/jws"
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+	"github.com/gorilla/websocket"
+)
+
+// newSocketConnection returns a connection over a real socket and the client side of the socket.
+func newSocketConnection(t *testing.T, id ConnectionId) (*Connection, *websocket.Conn) {
+
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		accepted <- ws
+	}))
+	t.Cleanup(httpServer.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return NewConnection(id, <-accepted), client
+}
+
+func newSocketLoggedConnection(t *testing.T, id ConnectionId, userId UserId, deviceId DeviceId) (*Connection, *websocket.Conn) {
+
+	connection, client := newSocketConnection(t, id)
+	connection.userId = userId
+	connection.deviceId = deviceId
+
+	return connection, client
+}
+
+// newRoutedServer returns a server with routing enabled and the endpoints in its routing table.
+func newRoutedServer(t *testing.T, config ServerConfig, endpoints ...EndpointConfig) (*Server, *busCube) {
+
+	cubeInstance := newBusCube(newMemoryBus(), "A")
+	config.EnableRouting = true
+
+	server, err := NewServer(cubeInstance, config)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	table, err := NewRoutingTable(nil, &RoutingConfig{Endpoints: endpoints})
+	if err != nil {
+		t.Fatalf("NewRoutingTable: %v", err)
+	}
+
+	server.SetRoutingTable(table)
+	return server, cubeInstance
+}
+
+// readFrame reads the next frame sent to the client.
+func readFrame(t *testing.T, client *websocket.Conn) js.Frame {
+	t.Helper()
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+
+	var frame js.Frame
+	err = json.Unmarshal(data, &frame)
+	if err != nil {
+		t.Fatalf("frame %q can't be parsed: %v", data, err)
+	}
+
+	return frame
+}
+
+// readText reads the next message sent to the client without parsing it.
+func readText(t *testing.T, client *websocket.Conn) string {
+	t.Helper()
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+
+	return string(data)
+}
+
+// expectText fails unless the next message sent to the client is the text, messages without sessions are written as is.
+func expectText(t *testing.T, client *websocket.Conn, expected string) {
+	t.Helper()
+
+	if text := readText(t, client); text != expected {
+		t.Fatalf("got %q, want %q", text, expected)
+	}
+}
+
+// expectNoFrame fails if anything is sent to the client within a short time, the client can't be read after it.
+func expectNoFrame(t *testing.T, client *websocket.Conn) {
+	t.Helper()
+
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, data, err := client.ReadMessage()
+	if err == nil {
+		t.Fatalf("unexpected frame %q", data)
+	}
+}
+
+func TestNormalizeClose(t *testing.T) {
+
+	code, reason := normalizeClose(0, "bye")
+	if code != websocket.CloseNormalClosure || reason != "bye" {
+		t.Errorf("normalizeClose() = %v, %v", code, reason)
+	}
+
+	code, _ = normalizeClose(4001, "")
+	if code != 4001 {
+		t.Errorf("code isn't kept: %v", code)
+	}
+
+	tests := []string{
+		strings.Repeat("a", 200),
+		strings.Repeat("я", 100),
+		"a" + strings.Repeat("я", 100),
+		strings.Repeat("🙂", 40),
+	}
+
+	for _, test := range tests {
+		_, reason := normalizeClose(0, test)
+		if len(reason) > MaxCloseReasonLength || len(reason) < MaxCloseReasonLength-3 {
+			t.Errorf("reason of %v bytes is cut to %v bytes", len(test), len(reason))
+		}
+
+		if !utf8.ValidString(reason) || !strings.HasPrefix(test, reason) {
+			t.Errorf("reason is cut inside a rune: %q", reason)
+		}
+	}
+}
+
+// dialServer connects an anonymous client to the server.
+func dialServer(t *testing.T, server *Server) *websocket.Conn {
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"),
+		http.Header{"Sec-Websocket-Protocol": {"token,"}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func eventParams(t *testing.T, message cube.Message) js.OnReceiveMessageParams {
+	t.Helper()
+
+	var params js.OnReceiveMessageParams
+	err := json.Unmarshal(*message.Params, &params)
+	if err != nil {
+		t.Fatalf("event params can't be parsed: %v", err)
+	}
+
+	return params
+}
+
+func TestEventSeq(t *testing.T) {
+
+	cubeInstance := newBusCube(newMemoryBus(), "A")
+	server, err := NewServer(cubeInstance, ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		client := dialServer(t, server)
+		for _, text := range []string{"1", "2", "3"} {
+			client.WriteMessage(websocket.TextMessage, []byte(text))
+		}
+
+		client.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}
+
+	waitFor(t, "events of both connections", func() bool {
+		return len(cubeInstance.bus.Messages("wsOutput")) == 10
+	})
+
+	seqs := map[string][]string{}
+	for _, message := range cubeInstance.bus.Messages("wsOutput") {
+		params := eventParams(t, message)
+		if params.ConnectionUid == "" {
+			t.Fatalf("%v has no connectionUid", message.Method)
+		}
+
+		seqs[params.ConnectionUid] = append(seqs[params.ConnectionUid], fmt.Sprintf("%v:%v", message.Method, params.Seq))
+	}
+
+	expected := "[onConnect:1 onTextMessage:2 onTextMessage:3 onTextMessage:4 onClose:5]"
+	if len(seqs) != 2 {
+		t.Fatalf("events of %v connections, want 2", len(seqs))
+	}
+
+	for uid, connectionSeqs := range seqs {
+		if fmt.Sprint(connectionSeqs) != expected {
+			t.Errorf("events of %v = %v, want %v", uid, connectionSeqs, expected)
+		}
+	}
+}
+
+func TestOrderedEvents(t *testing.T) {
+
+	cubeInstance := newBusCube(newMemoryBus(), "A")
+	server, err := NewServer(cubeInstance, ServerConfig{OrderedEvents: true})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	// Publishing takes a different time, so unordered events overtake each other.
+	var published int64
+	cubeInstance.SetPublishHook(func(channel cube.Channel) error {
+		time.Sleep(time.Duration(atomic.AddInt64(&published, 1)%3) * time.Millisecond)
+		return nil
+	})
+
+	connection, _ := newSocketLoggedConnection(t, 1, "user", "phone")
+
+	wait := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			body := []byte("hello")
+			server.onReceiveMessage(connection, true, &body)
+		}()
+	}
+
+	wait.Wait()
+
+	for i, message := range cubeInstance.bus.Messages("wsOutput") {
+		if seq := eventParams(t, message).Seq; seq != uint64(i+1) {
+			t.Fatalf("event %v has seq %v", i+1, seq)
+		}
+	}
+}
+
+func TestRequestSeq(t *testing.T) {
+
+	server, cubeInstance := newRoutedServer(t, ServerConfig{}, EndpointConfig{Name: "chat", Channel: "chatChannel"})
+
+	seqs := make(chan uint64, 2)
+	cubeInstance.bus.HandleMethod("chatChannel", func(request cube.Request, timeout time.Duration) (*cube.Response, error) {
+		var params js.OnReceiveRequestParams
+		json.Unmarshal(*request.Params, &params)
+		seqs <- params.Seq
+
+		return &cube.Response{Result: request.Params}, nil
+	})
+
+	connection, client := newSocketLoggedConnection(t, 1, "user", "phone")
+
+	message := []byte(`{"endpoint": "chat", "payload": {}}`)
+	server.onReceiveMessage(connection, true, &message)
+
+	for _, requestId := range []string{"1", "2"} {
+		request := []byte(`{"endpoint": "chat", "mode": "request", "requestId": "` + requestId + `", "payload": {}}`)
+		server.onReceiveMessage(connection, true, &request)
+
+		if frame := readFrame(t, client); frame.Type != js.RESPONSE_FRAME || frame.RequestId != requestId {
+			t.Fatalf("request is answered with %+v", frame)
+		}
+	}
+
+	close(seqs)
+	requestSeqs := []uint64{}
+	for seq := range seqs {
+		requestSeqs = append(requestSeqs, seq)
+	}
+
+	if fmt.Sprint(requestSeqs) != "[1 2]" {
+		t.Errorf("request seqs = %v", requestSeqs)
+	}
+
+	message = []byte(`{"endpoint": "chat", "payload": {}}`)
+	server.onReceiveMessage(connection, true, &message)
+
+	events := cubeInstance.bus.Messages("chatChannel")
+	if len(events) != 2 || eventParams(t, events[0]).Seq != 1 || eventParams(t, events[1]).Seq != 2 {
+		t.Errorf("requests change seq of events")
+	}
+}
+
+func TestHandleRequest(t *testing.T) {
+
+	server, cubeInstance := newRoutedServer(t, ServerConfig{MaxRequestTimeout: time.Second},
+		EndpointConfig{Name: "chat", Channel: "chatChannel", Timeout: 500},
+		EndpointConfig{Name: "search", Channel: "searchChannel"})
+
+	calls := make(chan js.OnReceiveRequestParams, 10)
+	timeouts := make(chan time.Duration, 10)
+	cubeInstance.bus.HandleMethod("chatChannel", func(request cube.Request, timeout time.Duration) (*cube.Response, error) {
+		var params js.OnReceiveRequestParams
+		json.Unmarshal(*request.Params, &params)
+		calls <- params
+		timeouts <- timeout
+
+		if string(params.Body) == `{"fail": true}` {
+			return &cube.Response{Error: &cube.Error{Name: "NotFound", Message: "no such chat"}}, nil
+		}
+
+		result := json.RawMessage(`{"ok": true}`)
+		return &cube.Response{Id: "backend id", Result: &result}, nil
+	})
+
+	connection, client := newSocketLoggedConnection(t, 1, "user", "phone")
+
+	send := func(packet string) js.Frame {
+		t.Helper()
+
+		body := []byte(packet)
+		server.onReceiveMessage(connection, true, &body)
+		return readFrame(t, client)
+	}
+
+	frame := send(`{"endpoint": "chat", "mode": "request", "requestId": "1", "payload": {"text": "hi"}}`)
+	if frame.Type != js.RESPONSE_FRAME || frame.RequestId != "1" || string(*frame.Result) != `{"ok":true}` {
+		t.Errorf("response frame = %+v", frame)
+	}
+
+	params := <-calls
+	if *params.UserId != "user" || *params.DeviceId != "phone" || params.RequestId != "1" || params.Endpoint != "chat" ||
+		params.Type != js.TEXT || string(params.Body) != `{"text": "hi"}` {
+		t.Errorf("request params = %+v", params)
+	}
+
+	if timeout := <-timeouts; timeout != 500*time.Millisecond {
+		t.Errorf("timeout = %v, endpoint timeout isn't the limit", timeout)
+	}
+
+	frame = send(`{"endpoint": "chat", "mode": "request", "requestId": "2", "timeout": 100, "payload": {"fail": true}}`)
+	if frame.Type != js.ERROR_FRAME || frame.Code != "NotFound" || frame.Message != "no such chat" || frame.RequestId != "2" {
+		t.Errorf("error response frame = %+v", frame)
+	}
+
+	<-calls
+	if timeout := <-timeouts; timeout != 100*time.Millisecond {
+		t.Errorf("timeout = %v, packet timeout isn't used", timeout)
+	}
+
+	frame = send(`{"endpoint": "chat", "mode": "request", "timeout": 5000, "payload": {}}`)
+	if frame.Code != js.ERROR_EMPTY_REQUEST_ID {
+		t.Errorf("request without id is answered with %+v", frame)
+	}
+
+	// Calls of channels without handlers time out.
+	frame = send(`{"endpoint": "search", "mode": "request", "requestId": "3", "payload": {}}`)
+	if frame.Code != js.ERROR_TIMEOUT || frame.RequestId != "3" || !frame.Retryable {
+		t.Errorf("timed out request is answered with %+v", frame)
+	}
+
+	if len(calls) != 0 {
+		t.Errorf("invalid requests are sent to the backend")
+	}
+}
+
+func TestHandleRequestLimits(t *testing.T) {
+
+	server, cubeInstance := newRoutedServer(t, ServerConfig{MaxInFlightRequests: 2}, EndpointConfig{Name: "slow", Channel: "slowChannel"})
+
+	release := make(chan struct{})
+	cubeInstance.bus.HandleMethod("slowChannel", func(request cube.Request, timeout time.Duration) (*cube.Response, error) {
+		<-release
+		return &cube.Response{}, nil
+	})
+
+	connection, client := newSocketLoggedConnection(t, 1, "user", "phone")
+
+	for _, requestId := range []string{"1", "2", "3"} {
+		body := []byte(`{"endpoint": "slow", "mode": "request", "requestId": "` + requestId + `", "payload": {}}`)
+		server.onReceiveMessage(connection, true, &body)
+	}
+
+	frame := readFrame(t, client)
+	if frame.Code != js.ERROR_TOO_MANY_REQUESTS || frame.RequestId != "3" || !frame.Retryable {
+		t.Errorf("request beyond the limit is answered with %+v", frame)
+	}
+
+	close(release)
+
+	answered := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		frame := readFrame(t, client)
+		if frame.Type != js.RESPONSE_FRAME {
+			t.Errorf("request is answered with %+v", frame)
+		}
+
+		answered[frame.RequestId] = true
+	}
+
+	if !answered["1"] || !answered["2"] {
+		t.Errorf("answered requests = %v", answered)
+	}
+
+	waitFor(t, "released request slots", func() bool {
+		return connection.AcquireRequestSlot(1)
+	})
+}
+
+// dialServerWithToken connects a client authenticated with HS512 token of the claims.
+func dialServerWithToken(t *testing.T, server *Server, secret string, claims map[string]interface{}) *websocket.Conn {
+
+	token, err := jws.NewJWT(jws.Claims(claims), crypto.SigningMethodHS512).Serialize([]byte(secret))
+	if err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"),
+		http.Header{"Sec-Websocket-Protocol": {"token," + string(token)}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestForwardClaims(t *testing.T) {
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	if claims := server.forwardClaims(Claims{"roles": []interface{}{"admin"}}); claims != nil {
+		t.Errorf("claims are forwarded without forwarded-claims: %v", claims)
+	}
+
+	server, err = NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{ForwardedClaims: []string{"roles", "locale"}})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	if claims := server.forwardClaims(nil); claims != nil {
+		t.Errorf("claims of anonymous connections = %v", claims)
+	}
+
+	claims := server.forwardClaims(Claims{"roles": []interface{}{"admin"}, "tenant": "acme"})
+	if fmt.Sprint(claims) != "map[roles:[admin]]" {
+		t.Errorf("forwarded claims = %v", claims)
+	}
+}
+
+func TestForwardedClaimsInEvents(t *testing.T) {
+
+	cubeInstance := newBusCube(newMemoryBus(), "A")
+	server, err := NewServer(cubeInstance, ServerConfig{JwtSecret: "secret", ForwardedClaims: []string{"roles", "locale"}})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	client := dialServerWithToken(t, server, "secret", map[string]interface{}{
+		"userId":   "user",
+		"deviceId": "phone",
+		"roles":    []string{"admin"},
+		"locale":   "en",
+		"password": "secret",
+	})
+
+	client.WriteMessage(websocket.TextMessage, []byte("hello"))
+	client.WriteMessage(websocket.BinaryMessage, []byte{1})
+	client.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+	waitFor(t, "events", func() bool {
+		return len(cubeInstance.bus.Messages("wsOutput")) == 4
+	})
+
+	for _, message := range cubeInstance.bus.Messages("wsOutput") {
+		params := eventParams(t, message)
+		if *params.UserId != "user" || fmt.Sprint(params.Claims) != "map[locale:en roles:[admin]]" {
+			t.Errorf("%v has user %v and claims %v", message.Method, *params.UserId, params.Claims)
+		}
+	}
+}
+
+func TestForwardedClaimsInRequests(t *testing.T) {
+
+	server, cubeInstance := newRoutedServer(t, ServerConfig{ForwardedClaims: []string{"locale"}},
+		EndpointConfig{Name: "chat", Channel: "chatChannel"})
+
+	claims := make(chan map[string]interface{}, 1)
+	cubeInstance.bus.HandleMethod("chatChannel", func(request cube.Request, timeout time.Duration) (*cube.Response, error) {
+		var params js.OnReceiveRequestParams
+		json.Unmarshal(*request.Params, &params)
+		claims <- params.Claims
+
+		return &cube.Response{}, nil
+	})
+
+	connection, _ := newSocketConnection(t, 1)
+	connection.Login("user", "phone", "", Claims{"locale": "en", "tenant": "acme"})
+
+	body := []byte(`{"endpoint": "chat", "mode": "request", "requestId": "1", "payload": {}}`)
+	server.onReceiveMessage(connection, true, &body)
+
+	if forwarded := <-claims; fmt.Sprint(forwarded) != "map[locale:en]" {
+		t.Errorf("claims of the request = %v", forwarded)
+	}
+}
+
+func TestSendMessageTargets(t *testing.T) {
+
+	server, err := NewServer(newBusCube(newMemoryBus(), "A"), ServerConfig{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	phone, phoneClient := newSocketLoggedConnection(t, 1, "user", "phone")
+	tablet, tabletClient := newSocketLoggedConnection(t, 2, "user", "tablet")
+	secondTablet, secondTabletClient := newSocketLoggedConnection(t, 3, "user", "tablet")
+	other, otherClient := newSocketLoggedConnection(t, 4, "other", "phone")
+	tenant, tenantClient := newSocketConnection(t, 5)
+	tenant.Login("user", "laptop", "acme", nil)
+	anonymous, anonymousClient := newSocketConnection(t, 6)
+
+	for _, connection := range []*Connection{phone, tablet, secondTablet, other, tenant, anonymous} {
+		server.connections.AddNewConnection(connection)
+	}
+
+	userId := UserId("user")
+	tabletId := DeviceId("tablet")
+	send := func(tenantId TenantId, connectionId *ConnectionId, userId *UserId, deviceId *DeviceId, exclusion Exclusion, text string) {
+		server.SendMessage(tenantId, connectionId, userId, deviceId, exclusion, js.TEXT, []byte(text), SendOptions{})
+	}
+
+	connectionId := ConnectionId(3)
+	send("", &connectionId, nil, nil, Exclusion{}, "to connection")
+	expectText(t, secondTabletClient, "to connection")
+
+	// Connection ids are checked against the user, the tenant and the login.
+	wrongUser, tenantConnection, anonymousConnection := ConnectionId(4), ConnectionId(5), ConnectionId(6)
+	send("", &wrongUser, &userId, nil, Exclusion{}, "wrong user")
+	send("other", &tenantConnection, nil, nil, Exclusion{}, "wrong tenant")
+	send("", &anonymousConnection, nil, nil, Exclusion{}, "anonymous")
+
+	send("", nil, &userId, &tabletId, Exclusion{ConnectionIds: []ConnectionId{2}}, "to device except the sender")
+	expectText(t, secondTabletClient, "to device except the sender")
+
+	send("", nil, &userId, nil, Exclusion{DeviceIds: []DeviceId{"tablet"}}, "to user except tablets")
+	expectText(t, phoneClient, "to user except tablets")
+	expectText(t, tenantClient, "to user except tablets")
+
+	send("acme", nil, &userId, nil, Exclusion{}, "to tenant user")
+	expectText(t, tenantClient, "to tenant user")
+
+	send("", nil, &userId, nil, Exclusion{ConnectionIds: []ConnectionId{1, 3, 5}}, "to user except connections")
+	expectText(t, tabletClient, "to user except connections")
+
+	for _, client := range []*websocket.Conn{phoneClient, tabletClient, secondTabletClient, otherClient, tenantClient, anonymousClient} {
+		expectNoFrame(t, client)
+	}
+}
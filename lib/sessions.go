@@ -0,0 +1,510 @@
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+const DefaultSessionBufferSize = 100
+
+const sessionCleanupInterval = 5 * time.Second
+
+// sessionEntry is a message sent to a connection, seq is zero for messages which aren't buffered in sessions.
+type sessionEntry struct {
+	seq         uint64
+	messageType js.MessageType
+	message     []byte
+	reliable    bool
+	createdAt   time.Time
+	expiresAt   time.Time
+}
+
+func (e sessionEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// sessionOutbox keeps messages of the session to the connection until they are written, so sessions aren't locked
+// while slow clients are written to and messages reach the client in the order of seq.
+type sessionOutbox struct {
+	mutex   sync.Mutex
+	entries []sessionEntry
+	sending bool
+}
+
+// push returns true if the caller has to write entries of the outbox.
+func (o *sessionOutbox) push(entries ...sessionEntry) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.entries = append(o.entries, entries...)
+
+	if o.sending {
+		return false
+	}
+
+	o.sending = true
+	return true
+}
+
+// next returns the oldest entry, writing stops when there is nothing left.
+func (o *sessionOutbox) next() (sessionEntry, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.entries) == 0 {
+		o.sending = false
+		o.entries = nil
+		return sessionEntry{}, false
+	}
+
+	entry := o.entries[0]
+	o.entries[0] = sessionEntry{}
+	o.entries = o.entries[1:]
+
+	return entry, true
+}
+
+// Session is a resumable session of a device. Messages sent to the device are numbered and buffered
+// for the session window, so a reconnected client gets messages it missed.
+type Session struct {
+	id          string
+	tenantId    TenantId
+	userId      UserId
+	deviceId    DeviceId
+	mutex       sync.Mutex
+	seq         uint64
+	buffer      []sessionEntry
+	connections map[ConnectionId]*Connection
+	detachedAt  time.Time
+	// orphaned keeps unacknowledged reliable deliveries of closed connections by seq, they are replayed on resume
+	// and fail when they leave the buffer or the client can't resume.
+	orphaned map[uint64]*pendingDelivery
+}
+
+// SessionRequest is sent by the client on connect, empty Id asks for a new session.
+type SessionRequest struct {
+	Id      string
+	LastSeq *uint64
+}
+
+// Sessions keeps sessions of devices, sessions without connections expire after the window.
+type Sessions struct {
+	mutex        sync.RWMutex
+	byId         map[string]*Session
+	byDevice     map[presenceKey]*Session
+	byConnection map[ConnectionId]*Session
+	window       time.Duration
+	bufferSize   int
+	send         func(connection *Connection, entry sessionEntry) error
+	announce     func(connection *Connection, sessionId string, seq uint64, resumed bool)
+	fail         func(delivery *pendingDelivery, reason string)
+}
+
+// NewSessions creates sessions with the window, zero window disables sessions. Messages are sent with send,
+// announce tells the client its session before any message of the session is sent and fail reports
+// orphaned deliveries which won't be replayed.
+func NewSessions(window time.Duration, bufferSize int, send func(connection *Connection, entry sessionEntry) error,
+	announce func(connection *Connection, sessionId string, seq uint64, resumed bool),
+	fail func(delivery *pendingDelivery, reason string)) *Sessions {
+
+	if bufferSize <= 0 {
+		bufferSize = DefaultSessionBufferSize
+	}
+
+	return &Sessions{
+		mutex:        sync.RWMutex{},
+		byId:         map[string]*Session{},
+		byDevice:     map[presenceKey]*Session{},
+		byConnection: map[ConnectionId]*Session{},
+		window:       window,
+		bufferSize:   bufferSize,
+		send:         send,
+		announce:     announce,
+		fail:         fail,
+	}
+}
+
+func (s *Sessions) failDeliveries(deliveries []*pendingDelivery) {
+
+	now := time.Now()
+	for _, delivery := range deliveries {
+		if delivery.entry.expired(now) {
+			s.fail(delivery, "expired")
+		} else {
+			s.fail(delivery, "connectionClosed")
+		}
+	}
+}
+
+func (s *Sessions) Enabled() bool {
+	return s.window > 0
+}
+
+// Attach attaches the logged in connection to the session of its device and replays missed messages
+// before any new message can reach the connection. It returns false if the requested session
+// can't be resumed and the client must resync.
+func (s *Sessions) Attach(connection *Connection, request SessionRequest) bool {
+	s.mutex.Lock()
+
+	connectionId, userId, deviceId := connection.GetInfo()
+	key := presenceKey{tenantId: connection.GetTenant(), userId: userId, deviceId: deviceId}
+
+	session := s.byDevice[key]
+	if session == nil {
+		session = &Session{
+			id:          newRandomId(),
+			tenantId:    key.tenantId,
+			userId:      userId,
+			deviceId:    deviceId,
+			connections: map[ConnectionId]*Connection{},
+		}
+
+		s.byId[session.id] = session
+		s.byDevice[key] = session
+	}
+
+	s.byConnection[connectionId] = session
+
+	session.mutex.Lock()
+	s.mutex.Unlock()
+
+	resumed := true
+	if request.Id != "" {
+		resumed = request.Id == session.id && request.LastSeq != nil && session.canReplay(*request.LastSeq)
+	}
+
+	sessionId, seq := session.id, session.seq
+
+	// Expired messages are skipped, so the client may see gaps in seq. Replayed reliable messages get new deliveries,
+	// so only orphaned deliveries of expired messages fail, others are replayed or have been received by the client.
+	failed := []*pendingDelivery{}
+	replayed := []sessionEntry{}
+	if resumed && request.LastSeq != nil {
+		now := time.Now()
+		for _, entry := range session.buffer {
+			if entry.seq <= *request.LastSeq {
+				continue
+			}
+
+			if entry.expired(now) {
+				if delivery := session.orphaned[entry.seq]; delivery != nil {
+					failed = append(failed, delivery)
+				}
+
+				continue
+			}
+
+			replayed = append(replayed, entry)
+		}
+
+		session.orphaned = nil
+	} else if !resumed {
+		failed = session.takeOrphaned(0)
+	}
+
+	// The outbox of the new connection is taken before the connection is added, so new messages of the session
+	// are written after the session frame and replayed messages.
+	write := connection.sessionOutbox.push(replayed...)
+	session.connections[connectionId] = connection
+	session.mutex.Unlock()
+
+	s.announce(connection, sessionId, seq, resumed)
+	if write {
+		s.writeOutbox(connection)
+	}
+
+	s.failDeliveries(failed)
+	return resumed
+}
+
+// writeOutbox writes messages of the outbox until there are none left.
+func (s *Sessions) writeOutbox(connection *Connection) {
+	for {
+		entry, ok := connection.sessionOutbox.next()
+		if !ok {
+			return
+		}
+
+		s.send(connection, entry)
+	}
+}
+
+// Orphan keeps the delivery of the closed connection in its session if the session still buffers the message,
+// it returns false if the delivery can't be replayed.
+func (s *Sessions) Orphan(delivery *pendingDelivery) bool {
+
+	if delivery.entry.seq == 0 {
+		return false
+	}
+
+	s.mutex.RLock()
+	session := s.byDevice[presenceKey{tenantId: delivery.tenantId, userId: delivery.userId, deviceId: delivery.deviceId}]
+	s.mutex.RUnlock()
+
+	if session == nil {
+		return false
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if len(session.buffer) == 0 || delivery.entry.seq < session.buffer[0].seq {
+		return false
+	}
+
+	if session.orphaned == nil {
+		session.orphaned = map[uint64]*pendingDelivery{}
+	}
+
+	session.orphaned[delivery.entry.seq] = delivery
+	return true
+}
+
+// takeOrphaned removes orphaned deliveries with seq below beforeSeq, zero takes all of them.
+func (session *Session) takeOrphaned(beforeSeq uint64) []*pendingDelivery {
+
+	taken := []*pendingDelivery{}
+	for seq, delivery := range session.orphaned {
+		if beforeSeq == 0 || seq < beforeSeq {
+			delete(session.orphaned, seq)
+			taken = append(taken, delivery)
+		}
+	}
+
+	return taken
+}
+
+// canReplay returns false if some messages after lastSeq are not buffered anymore.
+func (session *Session) canReplay(lastSeq uint64) bool {
+
+	if lastSeq > session.seq {
+		return false
+	}
+
+	firstSeq := session.seq + 1
+	if len(session.buffer) > 0 {
+		firstSeq = session.buffer[0].seq
+	}
+
+	return lastSeq+1 >= firstSeq
+}
+
+func (s *Sessions) Detach(connectionId ConnectionId) {
+	s.mutex.Lock()
+	session := s.byConnection[connectionId]
+	delete(s.byConnection, connectionId)
+	s.mutex.Unlock()
+
+	if session == nil {
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	delete(session.connections, connectionId)
+	if len(session.connections) == 0 {
+		session.detachedAt = time.Now()
+	}
+}
+
+// Find returns sessions of the user or of the device if deviceId is set, empty tenant means any tenant.
+func (s *Sessions) Find(tenantId TenantId, userId UserId, deviceId *DeviceId) []*Session {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sessions := []*Session{}
+	for key, session := range s.byDevice {
+		if key.userId != userId || (tenantId != "" && key.tenantId != tenantId) {
+			continue
+		}
+
+		if deviceId != nil && key.deviceId != *deviceId {
+			continue
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// Send numbers and buffers the message and sends it to connections of the session, the session isn't locked
+// while the message is written.
+func (s *Sessions) Send(session *Session, messageType js.MessageType, message []byte, options SendOptions, exclusion Exclusion) {
+	session.mutex.Lock()
+
+	now := time.Now()
+	session.seq++
+
+	entry := sessionEntry{
+		seq:         session.seq,
+		messageType: messageType,
+		message:     message,
+		reliable:    options.Reliable,
+		createdAt:   now,
+		expiresAt:   options.ExpiresAt,
+	}
+
+	session.buffer = append(session.buffer, entry)
+	failed := session.trim(now.Add(-s.window), s.bufferSize)
+
+	writers := []*Connection{}
+	for _, connection := range session.connections {
+		if !exclusion.excludes(connection) && connection.sessionOutbox.push(entry) {
+			writers = append(writers, connection)
+		}
+	}
+
+	session.mutex.Unlock()
+
+	for _, connection := range writers {
+		s.writeOutbox(connection)
+	}
+
+	s.failDeliveries(failed)
+}
+
+// trim drops messages created before the window or exceeding the buffer size and returns orphaned deliveries
+// of dropped messages.
+func (session *Session) trim(windowStart time.Time, bufferSize int) []*pendingDelivery {
+
+	dropped := 0
+	for dropped < len(session.buffer) &&
+		(len(session.buffer)-dropped > bufferSize || session.buffer[dropped].createdAt.Before(windowStart)) {
+		dropped++
+	}
+
+	if dropped == 0 {
+		return nil
+	}
+
+	session.buffer = append([]sessionEntry{}, session.buffer[dropped:]...)
+	if len(session.buffer) == 0 {
+		return session.takeOrphaned(0)
+	}
+
+	return session.takeOrphaned(session.buffer[0].seq)
+}
+
+func (session *Session) expired(now time.Time, window time.Duration) bool {
+	return len(session.connections) == 0 && now.Sub(session.detachedAt) > window
+}
+
+// RemoveExpired removes sessions which had no connections for the window and returns their number.
+// Sessions are checked without locking all of them, only expired ones are checked again while they are removed.
+func (s *Sessions) RemoveExpired() int {
+	s.mutex.RLock()
+	sessions := make(map[presenceKey]*Session, len(s.byDevice))
+	for key, session := range s.byDevice {
+		sessions[key] = session
+	}
+	s.mutex.RUnlock()
+
+	now := time.Now()
+	failed := []*pendingDelivery{}
+	expired := map[presenceKey]*Session{}
+
+	for key, session := range sessions {
+		session.mutex.Lock()
+		if session.expired(now, s.window) {
+			expired[key] = session
+		} else {
+			failed = append(failed, session.trim(now.Add(-s.window), s.bufferSize)...)
+		}
+		session.mutex.Unlock()
+	}
+
+	removed := 0
+	if len(expired) > 0 {
+		s.mutex.Lock()
+		for key, session := range expired {
+			// The session may have been resumed meanwhile.
+			session.mutex.Lock()
+			if s.byDevice[key] == session && session.expired(now, s.window) {
+				failed = append(failed, session.takeOrphaned(0)...)
+				delete(s.byDevice, key)
+				delete(s.byId, session.id)
+				removed++
+			}
+			session.mutex.Unlock()
+		}
+		s.mutex.Unlock()
+	}
+
+	s.failDeliveries(failed)
+	return removed
+}
+
+func (s *Sessions) Size() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.byDevice)
+}
+
+// HasConnection returns true if messages to the connection must be sent through its session.
+func (s *Sessions) HasConnection(connectionId ConnectionId) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.byConnection[connectionId] != nil
+}
+
+func (s *Server) announceSession(connection *Connection, sessionId string, seq uint64, resumed bool) {
+
+	frame := js.Frame{
+		Type:      js.SESSION_FRAME,
+		SessionId: sessionId,
+		Seq:       seq,
+	}
+
+	if !resumed {
+		s.metrics.Add("sessions.resyncs", 1)
+		frame.Code = js.NOTICE_RESYNC_REQUIRED
+	}
+
+	s.sendFrame(connection, frame)
+}
+
+func (s *Server) removeExpiredSessions() {
+
+	ticker := time.NewTicker(sessionCleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired := s.sessions.RemoveExpired()
+		if expired > 0 {
+			s.metrics.Add("sessions.expired", int64(expired))
+		}
+
+		s.metrics.Set("sessions.active", int64(s.sessions.Size()))
+	}
+}
+
+// parseSessionRequest reads "session" and "lastSeq" query params, "session=new" asks for a new session.
+func parseSessionRequest(request *http.Request) *SessionRequest {
+
+	query := request.URL.Query()
+	sessionId := query.Get("session")
+	if sessionId == "" {
+		return nil
+	}
+
+	if sessionId == "new" {
+		return &SessionRequest{}
+	}
+
+	sessionRequest := &SessionRequest{Id: sessionId}
+
+	lastSeq, err := strconv.ParseUint(query.Get("lastSeq"), 10, 64)
+	if err == nil {
+		sessionRequest.LastSeq = &lastSeq
+	}
+
+	return sessionRequest
+}
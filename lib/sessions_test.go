@@ -0,0 +1,280 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akaumov/cube-websocket-gateway/js"
+)
+
+func newTestSession(firstSeq uint64, lastSeq uint64) *Session {
+
+	session := &Session{seq: lastSeq, connections: map[ConnectionId]*Connection{}}
+	for seq := firstSeq; seq <= lastSeq && firstSeq > 0; seq++ {
+		session.buffer = append(session.buffer, sessionEntry{seq: seq, createdAt: time.Now()})
+	}
+
+	return session
+}
+
+func TestSessionCanReplay(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		session   *Session
+		lastSeq   uint64
+		canReplay bool
+	}{
+		{"nothing sent", newTestSession(0, 0), 0, true},
+		{"all received", newTestSession(3, 5), 5, true},
+		{"missed buffered", newTestSession(3, 5), 2, true},
+		{"missed some buffered", newTestSession(3, 5), 4, true},
+		{"missed dropped", newTestSession(3, 5), 1, false},
+		{"ahead of session", newTestSession(3, 5), 6, false},
+		{"empty buffer all received", newTestSession(0, 5), 5, true},
+		{"empty buffer missed", newTestSession(0, 5), 4, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			canReplay := test.session.canReplay(test.lastSeq)
+			if canReplay != test.canReplay {
+				t.Errorf("canReplay(%v) = %v, want %v", test.lastSeq, canReplay, test.canReplay)
+			}
+		})
+	}
+}
+
+func bufferSeqs(session *Session) []uint64 {
+
+	seqs := []uint64{}
+	for _, entry := range session.buffer {
+		seqs = append(seqs, entry.seq)
+	}
+
+	return seqs
+}
+
+func TestSessionTrim(t *testing.T) {
+
+	now := time.Now()
+
+	session := newTestSession(1, 5)
+	session.trim(now.Add(-time.Minute), 3)
+	if seqs := bufferSeqs(session); !reflect.DeepEqual(seqs, []uint64{3, 4, 5}) {
+		t.Errorf("trim by size left %v", seqs)
+	}
+
+	session = newTestSession(1, 4)
+	session.buffer[0].createdAt = now.Add(-2 * time.Minute)
+	session.buffer[1].createdAt = now.Add(-2 * time.Minute)
+	session.trim(now.Add(-time.Minute), 10)
+	if seqs := bufferSeqs(session); !reflect.DeepEqual(seqs, []uint64{3, 4}) {
+		t.Errorf("trim by window left %v", seqs)
+	}
+
+	session = newTestSession(1, 2)
+	session.trim(now.Add(time.Minute), 10)
+	if seqs := bufferSeqs(session); len(seqs) != 0 {
+		t.Errorf("trim of expired messages left %v", seqs)
+	}
+}
+
+func TestSessionTrimFailsOrphanedDeliveries(t *testing.T) {
+
+	session := newTestSession(1, 3)
+	session.orphaned = map[uint64]*pendingDelivery{
+		1: {id: 10, entry: session.buffer[0]},
+		3: {id: 30, entry: session.buffer[2]},
+	}
+
+	failed := session.trim(time.Now().Add(-time.Minute), 2)
+	if len(failed) != 1 || failed[0].id != 10 {
+		t.Errorf("trim failed %v, want the delivery of the dropped message", failed)
+	}
+
+	if len(session.orphaned) != 1 || session.orphaned[3] == nil {
+		t.Errorf("delivery of the buffered message isn't kept: %v", session.orphaned)
+	}
+}
+
+type sentEntries struct {
+	seqs      []uint64
+	announced []bool
+	failed    []uint64
+}
+
+func newTestSessions(sent *sentEntries) *Sessions {
+	return NewSessions(time.Minute, 10,
+		func(connection *Connection, entry sessionEntry) error {
+			sent.seqs = append(sent.seqs, entry.seq)
+			return nil
+		},
+		func(connection *Connection, sessionId string, seq uint64, resumed bool) {
+			sent.announced = append(sent.announced, resumed)
+		},
+		func(delivery *pendingDelivery, reason string) {
+			sent.failed = append(sent.failed, delivery.id)
+		})
+}
+
+func newLoggedConnection(id ConnectionId, userId UserId, deviceId DeviceId) *Connection {
+	connection := NewConnection(id, nil)
+	connection.userId = userId
+	connection.deviceId = deviceId
+	return connection
+}
+
+func TestSessionsResume(t *testing.T) {
+
+	sent := &sentEntries{}
+	sessions := newTestSessions(sent)
+
+	first := newLoggedConnection(1, "user", "phone")
+	sessions.Attach(first, SessionRequest{})
+
+	session := sessions.Find("", "user", nil)[0]
+	for i := 0; i < 3; i++ {
+		sessions.Send(session, js.TEXT, []byte("message"), SendOptions{}, Exclusion{})
+	}
+
+	sessions.Detach(1)
+	sent.seqs = nil
+
+	lastSeq := uint64(1)
+	second := newLoggedConnection(2, "user", "phone")
+	if !sessions.Attach(second, SessionRequest{Id: session.id, LastSeq: &lastSeq}) {
+		t.Fatalf("session isn't resumed")
+	}
+
+	if !reflect.DeepEqual(sent.seqs, []uint64{2, 3}) {
+		t.Errorf("replayed %v, want [2 3]", sent.seqs)
+	}
+
+	third := newLoggedConnection(3, "user", "phone")
+	if sessions.Attach(third, SessionRequest{Id: "other", LastSeq: &lastSeq}) {
+		t.Errorf("unknown session is resumed")
+	}
+
+	if !reflect.DeepEqual(sent.announced, []bool{true, true, false}) {
+		t.Errorf("announced %v", sent.announced)
+	}
+}
+
+func TestSessionsOrphanedDeliveries(t *testing.T) {
+
+	sent := &sentEntries{}
+	sessions := newTestSessions(sent)
+
+	connection := newLoggedConnection(1, "user", "phone")
+	sessions.Attach(connection, SessionRequest{})
+
+	session := sessions.Find("", "user", nil)[0]
+	sessions.Send(session, js.TEXT, []byte("message"), SendOptions{Reliable: true}, Exclusion{})
+	sessions.Send(session, js.TEXT, []byte("message"), SendOptions{Reliable: true}, Exclusion{})
+	sessions.Detach(1)
+
+	delivery := &pendingDelivery{id: 7, userId: "user", deviceId: "phone", entry: session.buffer[1]}
+	if !sessions.Orphan(delivery) {
+		t.Fatalf("delivery of the buffered message isn't kept")
+	}
+
+	if sessions.Orphan(&pendingDelivery{id: 8, userId: "user", deviceId: "phone"}) {
+		t.Errorf("delivery of a message which isn't buffered is kept")
+	}
+
+	if sessions.Orphan(&pendingDelivery{id: 9, userId: "user", deviceId: "tablet", entry: session.buffer[1]}) {
+		t.Errorf("delivery without a session is kept")
+	}
+
+	lastSeq := uint64(1)
+	sent.seqs = nil
+	sessions.Attach(newLoggedConnection(2, "user", "phone"), SessionRequest{Id: session.id, LastSeq: &lastSeq})
+
+	if !reflect.DeepEqual(sent.seqs, []uint64{2}) || len(sent.failed) != 0 {
+		t.Errorf("orphaned delivery isn't replayed: sent %v, failed %v", sent.seqs, sent.failed)
+	}
+
+	sessions.Detach(2)
+	sessions.Orphan(delivery)
+	sessions.Attach(newLoggedConnection(3, "user", "phone"), SessionRequest{Id: "other"})
+
+	if !reflect.DeepEqual(sent.failed, []uint64{7}) {
+		t.Errorf("orphaned delivery of not resumed session failed %v, want [7]", sent.failed)
+	}
+}
+
+func TestSessionsDontWaitForSlowClients(t *testing.T) {
+
+	mutex := sync.Mutex{}
+	written := map[ConnectionId][]uint64{}
+	writing := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	sessions := NewSessions(time.Minute, 10,
+		func(connection *Connection, entry sessionEntry) error {
+			connectionId, _, _ := connection.GetInfo()
+			if connectionId == 1 {
+				select {
+				case writing <- struct{}{}:
+				default:
+				}
+
+				<-release
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			written[connectionId] = append(written[connectionId], entry.seq)
+			return nil
+		},
+		func(connection *Connection, sessionId string, seq uint64, resumed bool) {},
+		func(delivery *pendingDelivery, reason string) {})
+
+	sessions.Attach(newLoggedConnection(1, "user", "phone"), SessionRequest{})
+	sessions.Attach(newLoggedConnection(2, "user", "tablet"), SessionRequest{})
+
+	phoneId, tabletId := DeviceId("phone"), DeviceId("tablet")
+	phone := sessions.Find("", "user", &phoneId)[0]
+	tablet := sessions.Find("", "user", &tabletId)[0]
+
+	go sessions.Send(phone, js.TEXT, []byte("1"), SendOptions{}, Exclusion{})
+	<-writing
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		sessions.Send(phone, js.TEXT, []byte("2"), SendOptions{}, Exclusion{})
+		sessions.Send(tablet, js.TEXT, []byte("1"), SendOptions{}, Exclusion{})
+		sessions.Attach(newLoggedConnection(3, "user", "phone"), SessionRequest{})
+		sessions.Send(phone, js.TEXT, []byte("3"), SendOptions{}, Exclusion{})
+		sessions.RemoveExpired()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sessions are blocked by a slow client")
+	}
+
+	close(release)
+
+	waitFor(t, "messages of the slow client", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return len(written[1]) == 3
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if fmt.Sprint(written[1]) != "[1 2 3]" || fmt.Sprint(written[2]) != "[1]" || fmt.Sprint(written[3]) != "[3]" {
+		t.Errorf("written = %v", written)
+	}
+}
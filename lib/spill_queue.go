@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/akaumov/cube"
+)
+
+const DefaultSpillQueueSize = 10000
+
+type spilledMessage struct {
+	id      uint64
+	message cube.Message
+}
+
+// SpillQueue keeps undelivered messages of every channel until they can be replayed in order,
+// the oldest message is dropped when it is full.
+type SpillQueue struct {
+	mutex    sync.Mutex
+	channels map[cube.Channel][]spilledMessage
+	size     int
+	maxSize  int
+	lastId   uint64
+}
+
+func NewSpillQueue(maxSize int) *SpillQueue {
+	if maxSize <= 0 {
+		maxSize = DefaultSpillQueueSize
+	}
+
+	return &SpillQueue{
+		mutex:    sync.Mutex{},
+		channels: map[cube.Channel][]spilledMessage{},
+		maxSize:  maxSize,
+	}
+}
+
+// Push returns false if the oldest message has been dropped.
+func (q *SpillQueue) Push(channel cube.Channel, message cube.Message) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.push(channel, message)
+}
+
+// PushIfQueued queues the message only if the channel has queued messages, so new messages don't overtake them.
+func (q *SpillQueue) PushIfQueued(channel cube.Channel, message cube.Message) (queued bool, dropped bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.channels[channel]) == 0 {
+		return false, false
+	}
+
+	return true, !q.push(channel, message)
+}
+
+// HasMessages returns true if the channel has queued messages.
+func (q *SpillQueue) HasMessages(channel cube.Channel) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.channels[channel]) > 0
+}
+
+func (q *SpillQueue) push(channel cube.Channel, message cube.Message) bool {
+
+	dropped := false
+	if q.size >= q.maxSize {
+		q.dropOldest()
+		dropped = true
+	}
+
+	q.lastId++
+	q.channels[channel] = append(q.channels[channel], spilledMessage{id: q.lastId, message: message})
+	q.size++
+	return !dropped
+}
+
+// dropOldest removes the message which has been queued first among all channels.
+func (q *SpillQueue) dropOldest() {
+
+	var oldestChannel cube.Channel
+	oldestId := uint64(0)
+
+	for channel, messages := range q.channels {
+		if oldestId == 0 || messages[0].id < oldestId {
+			oldestChannel = channel
+			oldestId = messages[0].id
+		}
+	}
+
+	if oldestId != 0 {
+		q.removeFirst(oldestChannel, oldestId)
+	}
+}
+
+// removeFirst removes the first message of the channel if it has the id.
+func (q *SpillQueue) removeFirst(channel cube.Channel, id uint64) bool {
+
+	messages := q.channels[channel]
+	if len(messages) == 0 || messages[0].id != id {
+		return false
+	}
+
+	if len(messages) == 1 {
+		delete(q.channels, channel)
+	} else {
+		q.channels[channel] = messages[1:]
+	}
+
+	q.size--
+	return true
+}
+
+func (q *SpillQueue) first(channel cube.Channel) (spilledMessage, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	messages := q.channels[channel]
+	if len(messages) == 0 {
+		return spilledMessage{}, false
+	}
+
+	return messages[0], true
+}
+
+// Channels returns channels with queued messages.
+func (q *SpillQueue) Channels() []cube.Channel {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	channels := make([]cube.Channel, 0, len(q.channels))
+	for channel := range q.channels {
+		channels = append(channels, channel)
+	}
+
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i] < channels[j]
+	})
+
+	return channels
+}
+
+// Replay publishes messages of every channel in order. Replay of a channel stops on its first failure
+// and the failed message stays first, channels for which skip returns true aren't replayed.
+// The queue isn't locked while messages are published.
+func (q *SpillQueue) Replay(skip func(channel cube.Channel) bool, publish func(channel cube.Channel, message cube.Message) error) int {
+
+	replayed := 0
+
+	for _, channel := range q.Channels() {
+		if skip(channel) {
+			continue
+		}
+
+		for {
+			next, ok := q.first(channel)
+			if !ok {
+				break
+			}
+
+			err := publish(channel, next.message)
+			if err != nil {
+				break
+			}
+
+			q.mutex.Lock()
+			q.removeFirst(channel, next.id)
+			q.mutex.Unlock()
+
+			replayed++
+		}
+	}
+
+	return replayed
+}
+
+func (q *SpillQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.size
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/akaumov/cube"
+)
+
+func spillMessage(method string) cube.Message {
+	return cube.Message{Method: method}
+}
+
+func TestSpillQueuePush(t *testing.T) {
+
+	queue := NewSpillQueue(3)
+
+	queued, _ := queue.PushIfQueued("a", spillMessage("a0"))
+	if queued {
+		t.Errorf("message is queued to a channel without queued messages")
+	}
+
+	queue.Push("a", spillMessage("a1"))
+	queue.Push("b", spillMessage("b1"))
+
+	queued, dropped := queue.PushIfQueued("a", spillMessage("a2"))
+	if !queued || dropped {
+		t.Errorf("PushIfQueued() = %v, %v, want true, false", queued, dropped)
+	}
+
+	// The queue is full, the oldest message of all channels is dropped.
+	if queue.Push("b", spillMessage("b2")) {
+		t.Errorf("Push() to the full queue didn't report the dropped message")
+	}
+
+	if queue.Len() != 3 {
+		t.Errorf("Len() = %v, want 3", queue.Len())
+	}
+
+	replayed := map[cube.Channel][]string{}
+	queue.Replay(func(channel cube.Channel) bool { return false }, func(channel cube.Channel, message cube.Message) error {
+		replayed[channel] = append(replayed[channel], message.Method)
+		return nil
+	})
+
+	expected := map[cube.Channel][]string{"a": {"a2"}, "b": {"b1", "b2"}}
+	if !reflect.DeepEqual(replayed, expected) {
+		t.Errorf("replayed %v, want %v", replayed, expected)
+	}
+
+	if queue.Len() != 0 || len(queue.Channels()) != 0 {
+		t.Errorf("replayed messages are kept")
+	}
+}
+
+func TestSpillQueueReplay(t *testing.T) {
+
+	queue := NewSpillQueue(10)
+	for i := 0; i < 3; i++ {
+		queue.Push("failing", spillMessage(fmt.Sprintf("f%v", i)))
+		queue.Push("working", spillMessage(fmt.Sprintf("w%v", i)))
+		queue.Push("skipped", spillMessage(fmt.Sprintf("s%v", i)))
+	}
+
+	attempts := map[cube.Channel][]string{}
+	replayed := queue.Replay(
+		func(channel cube.Channel) bool {
+			return channel == "skipped"
+		},
+		func(channel cube.Channel, message cube.Message) error {
+			attempts[channel] = append(attempts[channel], message.Method)
+			if channel == "failing" && message.Method == "f1" {
+				return fmt.Errorf("publish failed")
+			}
+
+			return nil
+		})
+
+	if replayed != 4 {
+		t.Errorf("Replay() = %v, want 4", replayed)
+	}
+
+	expected := map[cube.Channel][]string{"failing": {"f0", "f1"}, "working": {"w0", "w1", "w2"}}
+	if !reflect.DeepEqual(attempts, expected) {
+		t.Errorf("attempts %v, want %v", attempts, expected)
+	}
+
+	if next, _ := queue.first("failing"); next.message.Method != "f1" {
+		t.Errorf("failed message isn't first, first is %v", next.message.Method)
+	}
+
+	if !reflect.DeepEqual(queue.Channels(), []cube.Channel{"failing", "skipped"}) || queue.Len() != 5 {
+		t.Errorf("queue has %v messages of %v", queue.Len(), queue.Channels())
+	}
+}
@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/akaumov/cube"
+)
+
+// TenantQuota limits all connections of a tenant together, zero means no limit.
+// RateLimit is the number of messages per second.
+type TenantQuota struct {
+	MaxConnections int     `json:"maxConnections"`
+	RateLimit      float64 `json:"rateLimit"`
+	RateBurst      int     `json:"rateBurst"`
+}
+
+// LoadTenantQuotas reads quotas of tenants from a json file: {"tenant": {"maxConnections": 100}}.
+func LoadTenantQuotas(path string) (map[TenantId]TenantQuota, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	quotas := map[TenantId]TenantQuota{}
+	err = json.Unmarshal(data, &quotas)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse tenant quotas: %v", err)
+	}
+
+	return quotas, nil
+}
+
+// IsValidTenant returns false for tenants which can't be a single token of a bus subject,
+// e.g. "acme.*" would make "wsOutput.acme.*" reach other tenants.
+func IsValidTenant(tenantId TenantId) bool {
+	return tenantId != "" && !strings.ContainsAny(string(tenantId), ".*>") &&
+		strings.IndexFunc(string(tenantId), unicode.IsSpace) == -1
+}
+
+// TenantChannel scopes the channel to the tenant, e.g. "wsOutput.tenant".
+func TenantChannel(channel cube.Channel, tenantId TenantId) cube.Channel {
+	if tenantId == "" {
+		return channel
+	}
+
+	return cube.Channel(string(channel) + "." + string(tenantId))
+}
+
+type tenantLimits struct {
+	mutex        sync.Mutex
+	defaultQuota TenantQuota
+	quotas       map[TenantId]TenantQuota
+	rateLimiters map[TenantId]*RateLimiter
+}
+
+func newTenantLimits(defaultQuota TenantQuota, quotas map[TenantId]TenantQuota) *tenantLimits {
+	if quotas == nil {
+		quotas = map[TenantId]TenantQuota{}
+	}
+
+	return &tenantLimits{
+		mutex:        sync.Mutex{},
+		defaultQuota: defaultQuota,
+		quotas:       quotas,
+		rateLimiters: map[TenantId]*RateLimiter{},
+	}
+}
+
+func (l *tenantLimits) getQuota(tenantId TenantId) TenantQuota {
+	quota, ok := l.quotas[tenantId]
+	if !ok {
+		return l.defaultQuota
+	}
+
+	return quota
+}
+
+func (l *tenantLimits) allowMessage(tenantId TenantId) bool {
+
+	quota := l.getQuota(tenantId)
+	if quota.RateLimit <= 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	limiter := l.rateLimiters[tenantId]
+	if limiter == nil {
+		limiter = NewRateLimiter(quota.RateLimit, quota.RateBurst)
+		l.rateLimiters[tenantId] = limiter
+	}
+	l.mutex.Unlock()
+
+	return limiter.Allow()
+}
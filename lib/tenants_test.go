@@ -0,0 +1,39 @@
+package lib
+
+import "testing"
+
+func TestIsValidTenant(t *testing.T) {
+
+	tests := []struct {
+		tenantId TenantId
+		valid    bool
+	}{
+		{"acme", true},
+		{"acme-eu_1", true},
+		{"", false},
+		{"acme.eu", false},
+		{"*", false},
+		{"acme>", false},
+		{"ac me", false},
+		{"acme\t", false},
+		{"acme ", false},
+	}
+
+	for _, test := range tests {
+		valid := IsValidTenant(test.tenantId)
+		if valid != test.valid {
+			t.Errorf("IsValidTenant(%q) = %v, want %v", test.tenantId, valid, test.valid)
+		}
+	}
+}
+
+func TestTenantChannel(t *testing.T) {
+
+	if channel := TenantChannel("wsOutput", "acme"); channel != "wsOutput.acme" {
+		t.Errorf("TenantChannel() = %v, want wsOutput.acme", channel)
+	}
+
+	if channel := TenantChannel("wsOutput", ""); channel != "wsOutput" {
+		t.Errorf("TenantChannel() without tenant = %v, want wsOutput", channel)
+	}
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimerWheelTick  = 100 * time.Millisecond
+	DefaultTimerWheelSlots = 600
+)
+
+type wheelTimer struct {
+	id       uint64
+	slot     int
+	rounds   int
+	callback func()
+}
+
+// TimerWheel runs callbacks at the given time with the precision of a tick. Timers are kept in slots of the wheel,
+// timers which are more than one turn away wait for their rounds, so scheduling and canceling don't depend
+// on the number of timers.
+type TimerWheel struct {
+	mutex    sync.Mutex
+	tick     time.Duration
+	slots    []map[uint64]*wheelTimer
+	position int
+	timers   map[uint64]*wheelTimer
+	lastId   uint64
+}
+
+func NewTimerWheel(tick time.Duration, numberOfSlots int) *TimerWheel {
+
+	if tick <= 0 {
+		tick = DefaultTimerWheelTick
+	}
+
+	if numberOfSlots <= 0 {
+		numberOfSlots = DefaultTimerWheelSlots
+	}
+
+	slots := make([]map[uint64]*wheelTimer, numberOfSlots)
+	for i := range slots {
+		slots[i] = map[uint64]*wheelTimer{}
+	}
+
+	return &TimerWheel{
+		mutex:  sync.Mutex{},
+		tick:   tick,
+		slots:  slots,
+		timers: map[uint64]*wheelTimer{},
+	}
+}
+
+// Schedule adds the timer and returns its id, the callback is called on the first tick after the time.
+func (w *TimerWheel) Schedule(at time.Time, callback func()) uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	ticks := int((time.Until(at) + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	w.lastId++
+	timer := &wheelTimer{
+		id:       w.lastId,
+		slot:     (w.position + ticks) % len(w.slots),
+		rounds:   (ticks - 1) / len(w.slots),
+		callback: callback,
+	}
+
+	w.slots[timer.slot][timer.id] = timer
+	w.timers[timer.id] = timer
+	return timer.id
+}
+
+// Cancel removes the timer, it returns false if the timer has been already fired or canceled.
+func (w *TimerWheel) Cancel(timerId uint64) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	timer := w.timers[timerId]
+	if timer == nil {
+		return false
+	}
+
+	delete(w.timers, timerId)
+	delete(w.slots[timer.slot], timerId)
+	return true
+}
+
+func (w *TimerWheel) Size() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return len(w.timers)
+}
+
+// advance moves the wheel to the next slot and returns callbacks of fired timers.
+func (w *TimerWheel) advance() []func() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.position = (w.position + 1) % len(w.slots)
+
+	callbacks := []func(){}
+	for id, timer := range w.slots[w.position] {
+		if timer.rounds > 0 {
+			timer.rounds--
+			continue
+		}
+
+		delete(w.slots[w.position], id)
+		delete(w.timers, id)
+		callbacks = append(callbacks, timer.callback)
+	}
+
+	return callbacks
+}
+
+// Run turns the wheel every tick, callbacks are called one by one in the goroutine of the wheel.
+func (w *TimerWheel) Run() {
+
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, callback := range w.advance() {
+			callback()
+		}
+	}
+}
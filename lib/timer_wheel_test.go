@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+// advanceTicks turns the wheel without waiting and returns the number of fired timers.
+func advanceTicks(wheel *TimerWheel, ticks int) int {
+
+	fired := 0
+	for i := 0; i < ticks; i++ {
+		for _, callback := range wheel.advance() {
+			callback()
+			fired++
+		}
+	}
+
+	return fired
+}
+
+func TestTimerWheelSchedule(t *testing.T) {
+
+	wheel := NewTimerWheel(time.Second, 10)
+	now := time.Now()
+
+	fired := map[string]bool{}
+	wheel.Schedule(now.Add(-time.Minute), func() { fired["past"] = true })
+	wheel.Schedule(now.Add(3*time.Second), func() { fired["soon"] = true })
+	wheel.Schedule(now.Add(25*time.Second), func() { fired["later"] = true })
+
+	if wheel.Size() != 3 {
+		t.Fatalf("Size() = %v, want 3", wheel.Size())
+	}
+
+	if advanceTicks(wheel, 1) != 1 || !fired["past"] {
+		t.Errorf("timer in the past isn't fired on the first tick: %v", fired)
+	}
+
+	if advanceTicks(wheel, 2) != 1 || !fired["soon"] {
+		t.Errorf("timer isn't fired after its ticks: %v", fired)
+	}
+
+	// The third timer is more than one turn away, it waits for its rounds in the slot.
+	if advanceTicks(wheel, 21) != 0 {
+		t.Errorf("timer is fired before its rounds: %v", fired)
+	}
+
+	if advanceTicks(wheel, 1) != 1 || !fired["later"] {
+		t.Errorf("timer isn't fired after its rounds: %v", fired)
+	}
+
+	if wheel.Size() != 0 {
+		t.Errorf("Size() = %v, want 0", wheel.Size())
+	}
+}
+
+func TestTimerWheelCancel(t *testing.T) {
+
+	wheel := NewTimerWheel(time.Second, 10)
+	timerId := wheel.Schedule(time.Now().Add(2*time.Second), func() {
+		t.Errorf("canceled timer is fired")
+	})
+
+	if !wheel.Cancel(timerId) {
+		t.Errorf("Cancel() = false for a scheduled timer")
+	}
+
+	if wheel.Cancel(timerId) {
+		t.Errorf("Cancel() = true for a canceled timer")
+	}
+
+	advanceTicks(wheel, 20)
+
+	firedId := wheel.Schedule(time.Now(), func() {})
+	advanceTicks(wheel, 1)
+
+	if wheel.Cancel(firedId) {
+		t.Errorf("Cancel() = true for a fired timer")
+	}
+}
+
+func TestScheduledMessages(t *testing.T) {
+
+	scheduled := NewScheduledMessages(2)
+	deliverAt := time.Now().Add(time.Minute)
+
+	err := scheduled.Schedule("acme", "m1", deliverAt, func() {})
+	if err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+
+	err = scheduled.Schedule("acme", "m1", deliverAt, func() {})
+	if err != ErrorDuplicateMessage {
+		t.Errorf("Schedule of the same id = %v, want %v", err, ErrorDuplicateMessage)
+	}
+
+	err = scheduled.Schedule("other", "m1", deliverAt, func() {})
+	if err != nil {
+		t.Errorf("ids of other tenants must not clash: %v", err)
+	}
+
+	err = scheduled.Schedule("acme", "", deliverAt, func() {})
+	if err != ErrorTooManyScheduledMessages {
+		t.Errorf("Schedule over the limit = %v, want %v", err, ErrorTooManyScheduledMessages)
+	}
+
+	if !scheduled.Cancel("acme", "m1") || scheduled.Cancel("acme", "m1") {
+		t.Errorf("message is canceled not exactly once")
+	}
+
+	if scheduled.Size() != 1 {
+		t.Errorf("Size() = %v, want 1", scheduled.Size())
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+
+	deduplicator := NewDeduplicator(time.Minute)
+
+	if !deduplicator.Check("acme", "m1") {
+		t.Errorf("new id is a duplicate")
+	}
+
+	if deduplicator.Check("acme", "m1") {
+		t.Errorf("seen id isn't a duplicate")
+	}
+
+	if !deduplicator.Check("other", "m1") {
+		t.Errorf("ids of other tenants must not clash")
+	}
+
+	deduplicator.Forget("acme", "m1")
+	if !deduplicator.Check("acme", "m1") {
+		t.Errorf("forgotten id is a duplicate")
+	}
+
+	deduplicator.seen[dedupKey{tenantId: "acme", messageId: "old"}] = time.Now().Add(-2 * time.Minute)
+	if !deduplicator.Check("acme", "old") {
+		t.Errorf("id seen before the window is a duplicate")
+	}
+}
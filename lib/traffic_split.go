@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/akaumov/cube"
+)
+
+const splitBuckets = 10000
+
+type WeightedTarget struct {
+	Channel cube.Channel `json:"channel"`
+	Weight  int          `json:"weight"`
+}
+
+// TrafficSplit sends a share of the endpoint traffic to every target proportionally to its weight.
+// Users are hashed into buckets, so a user stays on the same target while weights are the same,
+// and only a part of users moves when weights are changed. Overrides pin users to channels.
+type TrafficSplit struct {
+	Targets   []WeightedTarget        `json:"targets"`
+	Overrides map[UserId]cube.Channel `json:"overrides"`
+}
+
+func (t *TrafficSplit) Validate() error {
+
+	if len(t.Targets) == 0 {
+		return fmt.Errorf("split: targets are required")
+	}
+
+	for _, target := range t.Targets {
+		if target.Channel == "" {
+			return fmt.Errorf("split: channel is required")
+		}
+
+		if target.Weight < 0 {
+			return fmt.Errorf("split: weight of %v can't be negative", target.Channel)
+		}
+	}
+
+	if t.totalWeight() == 0 {
+		return fmt.Errorf("split: total weight must be positive")
+	}
+
+	return nil
+}
+
+func (t *TrafficSplit) totalWeight() int {
+	total := 0
+	for _, target := range t.Targets {
+		total += target.Weight
+	}
+
+	return total
+}
+
+// Select picks the target of the user, key makes distribution of different endpoints independent.
+func (t *TrafficSplit) Select(key string, userId UserId) cube.Channel {
+
+	if channel, ok := t.Overrides[userId]; ok {
+		return channel
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write([]byte(userId))
+
+	bucket := int(hash.Sum32() % splitBuckets)
+	total := t.totalWeight()
+	upperBound := 0
+
+	for _, target := range t.Targets {
+		upperBound += target.Weight
+		if bucket*total < upperBound*splitBuckets {
+			return target.Channel
+		}
+	}
+
+	return t.Targets[len(t.Targets)-1].Channel
+}
+
+// TrafficSplits keeps splits set at runtime, they override splits of the routing config.
+type TrafficSplits struct {
+	mutex  sync.RWMutex
+	splits map[Endpoint]*TrafficSplit
+}
+
+func NewTrafficSplits() *TrafficSplits {
+	return &TrafficSplits{
+		mutex:  sync.RWMutex{},
+		splits: map[Endpoint]*TrafficSplit{},
+	}
+}
+
+// Set replaces the split of the endpoint, nil split removes it.
+func (s *TrafficSplits) Set(endpoint Endpoint, split *TrafficSplit) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if split == nil {
+		delete(s.splits, endpoint)
+		return
+	}
+
+	s.splits[endpoint] = split
+}
+
+func (s *TrafficSplits) Get(endpoint Endpoint) *TrafficSplit {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.splits[endpoint]
+}
+
+func (s *TrafficSplits) forEach(fn func(endpoint Endpoint, split *TrafficSplit)) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for endpoint, split := range s.splits {
+		fn(endpoint, split)
+	}
+}
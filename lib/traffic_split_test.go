@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/akaumov/cube"
+)
+
+func TestTrafficSplitValidate(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		split TrafficSplit
+		valid bool
+	}{
+		{"valid", TrafficSplit{Targets: []WeightedTarget{{Channel: "a", Weight: 90}, {Channel: "b", Weight: 10}}}, true},
+		{"zero weight target", TrafficSplit{Targets: []WeightedTarget{{Channel: "a", Weight: 1}, {Channel: "b"}}}, true},
+		{"no targets", TrafficSplit{}, false},
+		{"no channel", TrafficSplit{Targets: []WeightedTarget{{Weight: 1}}}, false},
+		{"negative weight", TrafficSplit{Targets: []WeightedTarget{{Channel: "a", Weight: 2}, {Channel: "b", Weight: -1}}}, false},
+		{"zero total weight", TrafficSplit{Targets: []WeightedTarget{{Channel: "a"}}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.split.Validate()
+			if (err == nil) != test.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func selectUsers(split *TrafficSplit, key string, numberOfUsers int) map[UserId]cube.Channel {
+
+	selected := map[UserId]cube.Channel{}
+	for i := 0; i < numberOfUsers; i++ {
+		userId := UserId(fmt.Sprintf("user%v", i))
+		selected[userId] = split.Select(key, userId)
+	}
+
+	return selected
+}
+
+func TestTrafficSplitSelect(t *testing.T) {
+
+	split := &TrafficSplit{
+		Targets:   []WeightedTarget{{Channel: "stable", Weight: 80}, {Channel: "canary", Weight: 20}, {Channel: "off"}},
+		Overrides: map[UserId]cube.Channel{"tester": "canary"},
+	}
+
+	selected := selectUsers(split, "chat", 10000)
+
+	counts := map[cube.Channel]int{}
+	for _, channel := range selected {
+		counts[channel]++
+	}
+
+	if counts["canary"] < 1700 || counts["canary"] > 2300 || counts["off"] != 0 {
+		t.Errorf("users aren't split by weights: %v", counts)
+	}
+
+	for userId, channel := range selectUsers(split, "chat", 10000) {
+		if selected[userId] != channel {
+			t.Fatalf("user %v moved from %v to %v", userId, selected[userId], channel)
+		}
+	}
+
+	if split.Select("chat", "tester") != "canary" {
+		t.Errorf("override isn't applied")
+	}
+
+	// Growing the canary moves only stable users to it.
+	split.Targets = []WeightedTarget{{Channel: "stable", Weight: 70}, {Channel: "canary", Weight: 30}}
+	for userId, channel := range selectUsers(split, "chat", 10000) {
+		if selected[userId] == "canary" && channel != "canary" {
+			t.Fatalf("canary user %v moved to %v", userId, channel)
+		}
+	}
+}
+
+func TestTrafficSplitKey(t *testing.T) {
+
+	split := &TrafficSplit{Targets: []WeightedTarget{{Channel: "a", Weight: 50}, {Channel: "b", Weight: 50}}}
+
+	chat := selectUsers(split, "chat", 1000)
+	billing := selectUsers(split, "billing", 1000)
+
+	differs := 0
+	for userId, channel := range chat {
+		if billing[userId] != channel {
+			differs++
+		}
+	}
+
+	if differs < 400 || differs > 600 {
+		t.Errorf("distributions of endpoints aren't independent: %v of 1000 users differ", differs)
+	}
+}
+
+func TestTrafficSplits(t *testing.T) {
+
+	splits := NewTrafficSplits()
+	split := &TrafficSplit{Targets: []WeightedTarget{{Channel: "a", Weight: 1}}}
+
+	splits.Set("chat", split)
+	if splits.Get("chat") != split {
+		t.Errorf("split isn't set")
+	}
+
+	splits.Set("chat", nil)
+	if splits.Get("chat") != nil {
+		t.Errorf("split isn't removed")
+	}
+}
@@ -0,0 +1,101 @@
+package cube_websocket_gateway
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/akaumov/cube"
+	"github.com/akaumov/cube-websocket-gateway/js"
+	"github.com/akaumov/cube-websocket-gateway/lib"
+)
+
+func (h *Handler) onSetRetainedMessage(tenantId lib.TenantId, message cube.Message) {
+
+	if message.Params == nil {
+		fmt.Println("onSetRetainedMessage: no params")
+		return
+	}
+
+	var params js.SetRetainedMessageParams
+	err := json.Unmarshal(*message.Params, &params)
+	if err != nil {
+		fmt.Println("onSetRetainedMessage: wrong params")
+		return
+	}
+
+	if params.UserId == "" || params.Key == "" {
+		fmt.Println("onSetRetainedMessage: user id and key are required")
+		return
+	}
+
+	err = h.server.SetRetainedMessage(tenantId, lib.UserId(params.UserId), (*lib.DeviceId)(params.DeviceId), params.Key,
+		params.Type, params.Body)
+
+	if err != nil {
+		fmt.Println("onSetRetainedMessage:", err)
+	}
+}
+
+func parseRetainedMessagesParams(rawParams *json.RawMessage) (*js.RetainedMessagesParams, error) {
+
+	if rawParams == nil {
+		return nil, fmt.Errorf("no params")
+	}
+
+	var params js.RetainedMessagesParams
+	err := json.Unmarshal(*rawParams, &params)
+	if err != nil {
+		return nil, fmt.Errorf("wrong params")
+	}
+
+	if params.UserId == "" {
+		return nil, fmt.Errorf("user id is required")
+	}
+
+	return &params, nil
+}
+
+func (h *Handler) clearRetainedMessages(tenantId lib.TenantId, params *js.RetainedMessagesParams) (int, error) {
+	return h.server.GetRetainedMessages().Clear(tenantId, lib.UserId(params.UserId), (*lib.DeviceId)(params.DeviceId), params.Key)
+}
+
+func (h *Handler) onClearRetainedMessages(tenantId lib.TenantId, message cube.Message) {
+
+	params, err := parseRetainedMessagesParams(message.Params)
+	if err != nil {
+		fmt.Println("onClearRetainedMessages:", err)
+		return
+	}
+
+	_, err = h.clearRetainedMessages(tenantId, params)
+	if err != nil {
+		fmt.Println("onClearRetainedMessages:", err)
+	}
+}
+
+func (h *Handler) onClearRetainedMessagesRequest(tenantId lib.TenantId, request cube.Request) cube.Response {
+
+	params, err := parseRetainedMessagesParams(request.Params)
+	if err != nil {
+		return cube.NewErrorResponse("", "WrongParams", err.Error())
+	}
+
+	removed, err := h.clearRetainedMessages(tenantId, params)
+	if err != nil {
+		return cube.NewErrorResponse("", "ServerError", err.Error())
+	}
+
+	return packResult(js.ClearRetainedMessagesResult{Removed: removed})
+}
+
+func (h *Handler) onGetRetainedMessages(tenantId lib.TenantId, request cube.Request) cube.Response {
+
+	params, err := parseRetainedMessagesParams(request.Params)
+	if err != nil {
+		return cube.NewErrorResponse("", "WrongParams", err.Error())
+	}
+
+	return packResult(js.GetRetainedMessagesResult{
+		Messages: h.server.GetRetainedMessages().List(tenantId, lib.UserId(params.UserId), (*lib.DeviceId)(params.DeviceId), params.Key),
+	})
+}